@@ -0,0 +1,195 @@
+package ahas
+
+import (
+	"context"
+	"sync"
+
+	"github.com/alibaba/sentinel-golang/logging"
+	"github.com/pkg/errors"
+	"github.com/sumansoul/aliyun-ahas-go-sdk/aliyun"
+	"github.com/sumansoul/aliyun-ahas-go-sdk/config"
+	"github.com/sumansoul/aliyun-ahas-go-sdk/heartbeat"
+	"github.com/sumansoul/aliyun-ahas-go-sdk/logger"
+	"github.com/sumansoul/aliyun-ahas-go-sdk/meta"
+	"github.com/sumansoul/aliyun-ahas-go-sdk/sentinel/datasource"
+	"github.com/sumansoul/aliyun-ahas-go-sdk/sentinel/handler"
+	"github.com/sumansoul/aliyun-ahas-go-sdk/tools"
+	"github.com/sumansoul/aliyun-ahas-go-sdk/transport"
+)
+
+// Client is an AHAS client instance owning its gateway connections, handlers,
+// metadata and credentials, so that several clients can run in one process.
+type Client struct {
+	conf *config.Config
+	// the default client is built on the package level singletons
+	isDefault bool
+
+	metadata  *meta.Meta
+	transport *transport.Transport
+
+	shutdownMutex sync.Mutex
+	shutdownHooks []func(ctx context.Context) error
+}
+
+// NewClient creates a standalone client from conf, see config.LoadConfig.
+// Sentinel and the logger are process wide, they have to be initialized before
+// the client is started.
+func NewClient(conf *config.Config) (*Client, error) {
+	if conf == nil {
+		return nil, errors.New("nil AHAS config")
+	}
+	return &Client{conf: conf}, nil
+}
+
+// Transport returns the transport of the client, nil before the client is started
+func (c *Client) Transport() *transport.Transport {
+	return c.transport
+}
+
+// Metadata returns the metadata of the client, nil before the client is started
+func (c *Client) Metadata() *meta.Meta {
+	return c.metadata
+}
+
+// Start connects the client to AHAS, then starts the heartbeat and the ACM rule data source.
+func (c *Client) Start() (err error) {
+	conf := c.conf
+	var m *meta.Meta
+	if c.isDefault {
+		m, err = meta.InitMetadata(conf.License, conf.Namespace,
+			conf.Env, resolveRegionId(conf), conf.Transport.Secure)
+	} else {
+		m, err = meta.NewMetadata(conf.License, conf.Namespace,
+			conf.Env, resolveRegionId(conf), conf.Transport.Secure)
+	}
+	if err != nil {
+		return err
+	}
+	c.metadata = m
+
+	aliyunChannel := aliyun.GetInstance()
+	if err = aliyunChannel.Start(); err != nil {
+		return err
+	}
+	if c.isDefault {
+		// the channel is shared by all the clients, only the default one stops it
+		c.addShutdownHook(func(ctx context.Context) error {
+			return aliyunChannel.Stop()
+		})
+	}
+
+	tools.InitConstant(conf.Env, m.RegionId())
+
+	acmHost, ok := aliyun.GetAcmEndpoint(m.RegionId())
+	if !ok {
+		return errors.New("no available ACM endpoint for region: " + m.RegionId())
+	}
+
+	// Initialize AHAS transport module.
+	tc := conf.Transport
+	var tsp *transport.Transport
+	if c.isDefault {
+		tsp, err = transport.New(&tc, m)
+	} else {
+		// keys of a standalone client are kept in memory only
+		tsp, err = transport.NewIndependent(&tc, m, tools.NewCredentials(""))
+	}
+	if err != nil {
+		return err
+	}
+	if tsp, err = tsp.Start(); err != nil {
+		return err
+	}
+	c.transport = tsp
+	c.addShutdownHook(tsp.Shutdown)
+	registerTransportHandlers(tsp)
+	// Initialize heartbeat task.
+	beat := heartbeat.New(conf.Heartbeat, tsp).Start()
+	c.addShutdownHook(func(ctx context.Context) error {
+		beat.Stop()
+		return nil
+	})
+
+	var acm *datasource.AcmDataSource
+	if !c.isDefault {
+		acm = datasource.NewAcmDataSource(acmHost, conf.DataSource, m)
+	}
+	c.addShutdownHook(func(ctx context.Context) error {
+		if acm == nil {
+			return datasource.CloseAcm()
+		}
+		return acm.Close()
+	})
+	go initializeAcmDataSource(acm, acmHost, conf.DataSource, m)
+
+	return nil
+}
+
+// Shutdown stops the components started by Start in reverse order: ACM listeners,
+// heartbeat, transport (which notifies the AHAS server, drains in-flight gateway
+// calls until ctx is done and closes the connections).
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.shutdownMutex.Lock()
+	hooks := c.shutdownHooks
+	c.shutdownHooks = nil
+	c.shutdownMutex.Unlock()
+
+	var err error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if e := hooks[i](ctx); e != nil {
+			logger.Warnf("Error occurs when shutting down AHAS: %+v", e)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	logger.Info("AHAS shutdown finished")
+	return err
+}
+
+func (c *Client) addShutdownHook(hook func(ctx context.Context) error) {
+	c.shutdownMutex.Lock()
+	defer c.shutdownMutex.Unlock()
+	c.shutdownHooks = append(c.shutdownHooks, hook)
+}
+
+func resolveRegionId(conf *config.Config) string {
+	regionId := conf.RegionId
+	if len(regionId) > 0 {
+		logger.Info("AHAS regionId resolved from YAML config or system env: " + regionId)
+		return regionId
+	}
+	regionId = aliyun.GetRegionId()
+	if len(regionId) > 0 {
+		logger.Info("AHAS regionId resolved from Aliyun metadata: " + regionId)
+		return regionId
+	}
+	return ""
+}
+
+func initializeAcmDataSource(acm *datasource.AcmDataSource, acmHost string, conf datasource.Config, m *meta.Meta) {
+	defer tools.PrintPanicStackV2("failed to init ACM data-source")
+	var err error
+	if acm == nil {
+		err = datasource.InitAcm(acmHost, conf, m)
+	} else {
+		err = acm.Start()
+	}
+	if err != nil {
+		logging.Error(err, "Failed to initialize ACM data source")
+	}
+}
+
+func registerTransportHandlers(tsp *transport.Transport) {
+	handlers := map[string]transport.RequestHandler{
+		handler.GetResourceNodeCommandName: &handler.ResourceNodeHandler{},
+		handler.FetchMetricCommandName:     handler.NewFetchMetricHandler(),
+		handler.ApiCommandName:             handler.NewApiHandler(tsp),
+	}
+	for name, h := range handlers {
+		requestHandler := transport.NewCommonHandler(h)
+		if err := tsp.RegisterHandler(name, &requestHandler); err != nil {
+			logging.Error(err, "Failed to register transport handler", "command", name)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+// Command agwdump decodes the frame captures of the AGW client, see gateway.CaptureConfig.
+//
+//	agwdump capture.bin                    print the frames as JSON lines
+//	agwdump -replay capture.bin            replay the requests of the client against a local
+//	                                       gateway answering with the captured responses
+//	agwdump -listen :9527 capture.bin      serve the captured responses to a real client and
+//	                                       send it the captured requests of the gateway
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/sumansoul/aliyun-ahas-go-sdk/gateway"
+	"github.com/sumansoul/aliyun-ahas-go-sdk/gateway/gatewaytest"
+)
+
+var (
+	replay  = flag.Bool("replay", false, "replay the requests of the client against a local gateway")
+	listen  = flag.String("listen", "", "serve the captured responses on this address")
+	timeout = flag.Duration("timeout", 3*time.Second, "timeout of every replayed request")
+)
+
+// frameVO is the JSON form of a captured frame
+type frameVO struct {
+	Time              string      `json:"time"`
+	Direction         string      `json:"direction"`
+	ConnId            uint32      `json:"connId"`
+	Type              string      `json:"type"`
+	Kind              string      `json:"kind"`
+	ReqId             uint64      `json:"reqId"`
+	OuterReqId        string      `json:"outerReqId,omitempty"`
+	ServerName        string      `json:"serverName,omitempty"`
+	HandlerName       string      `json:"handlerName,omitempty"`
+	TimeoutMs         uint32      `json:"timeoutMs,omitempty"`
+	InnerCode         uint32      `json:"innerCode"`
+	InnerMsg          string      `json:"innerMsg,omitempty"`
+	Version           uint32      `json:"version"`
+	ClientVpcId       string      `json:"clientVpcId,omitempty"`
+	ClientIp          string      `json:"clientIp,omitempty"`
+	ClientProcessFlag string      `json:"clientProcessFlag,omitempty"`
+	Body              interface{} `json:"body,omitempty"`
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: agwdump [-replay | -listen addr] capture...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var records []*gateway.CaptureRecord
+	for _, file := range flag.Args() {
+		r, err := readCapture(file)
+		if err != nil {
+			log.Fatalf("read %s: %v", file, err)
+		}
+		records = append(records, r...)
+	}
+
+	switch {
+	case *listen != "":
+		err := serve(*listen, records)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case *replay:
+		err := replayClient(records)
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		encoder := json.NewEncoder(os.Stdout)
+		for _, record := range records {
+			if err := encoder.Encode(toVO(record)); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+}
+
+// readCapture returns the records of a capture, a truncated last record is dropped
+// with a warning as the client may still be writing the file.
+func readCapture(file string) ([]*gateway.CaptureRecord, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := gateway.NewCaptureReader(f)
+	var records []*gateway.CaptureRecord
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Printf("%s: %v, skipped", file, err)
+				return records, nil
+			}
+			return nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+func toVO(record *gateway.CaptureRecord) *frameVO {
+	msg := record.Msg
+	vo := &frameVO{
+		Time:              record.Time.Format(time.RFC3339Nano),
+		Direction:         "in",
+		ConnId:            record.ConnId,
+		Type:              "biz",
+		Kind:              "request",
+		ReqId:             msg.ReqId(),
+		OuterReqId:        msg.OuterReqId(),
+		ServerName:        msg.ServerName(),
+		HandlerName:       msg.HandlerName(),
+		TimeoutMs:         msg.TimeoutMs(),
+		InnerCode:         msg.InnerCode(),
+		InnerMsg:          msg.InnerMsg(),
+		Version:           msg.Version(),
+		ClientVpcId:       msg.ClientVpcId(),
+		ClientIp:          clientIp(msg),
+		ClientProcessFlag: msg.ClientProcessFlag(),
+	}
+	if record.Direction == gateway.CaptureOutbound {
+		vo.Direction = "out"
+	}
+	switch msg.MessageType() {
+	case gateway.MessageTypeHeartbeat:
+		vo.Type = "heartbeat"
+	case gateway.MessageTypeStream:
+		vo.Type = "stream"
+	}
+	if msg.MessageDirection() == gateway.MessageDirectionResponse {
+		vo.Kind = "response"
+	}
+	if body := msg.Body(); body != "" {
+		if json.Valid([]byte(body)) {
+			vo.Body = json.RawMessage(body)
+		} else {
+			vo.Body = body
+		}
+	}
+	return vo
+}
+
+func clientIp(msg *gateway.AgwMessage) string {
+	if msg.ClientIpString() != "" {
+		return msg.ClientIpString()
+	}
+	ip := msg.ClientIp()
+	if ip == 0 {
+		return ""
+	}
+	return net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip)).String()
+}
+
+func isBiz(record *gateway.CaptureRecord, direction uint8, messageDirection uint8) bool {
+	return record.Direction == direction && record.Msg.MessageType() == gateway.MessageTypeBiz &&
+		record.Msg.MessageDirection() == messageDirection
+}
+
+type exchangeKey struct {
+	connId uint32
+	reqId  uint64
+}
+
+type streamKey struct {
+	connId    uint32
+	direction uint8
+}
+
+// joinStreams replaces the chunks of the streamed bodies by the whole messages,
+// recorded at the time of their last chunk.
+func joinStreams(records []*gateway.CaptureRecord) []*gateway.CaptureRecord {
+	var joined []*gateway.CaptureRecord
+	streams := make(map[streamKey]*gateway.StreamAssembler)
+	for _, record := range records {
+		if record.Msg.MessageType() != gateway.MessageTypeStream {
+			joined = append(joined, record)
+			continue
+		}
+		key := streamKey{connId: record.ConnId, direction: record.Direction}
+		assembler, ok := streams[key]
+		if !ok {
+			assembler = gateway.NewStreamAssembler(0)
+			streams[key] = assembler
+		}
+		msg, err := assembler.Add(record.Msg)
+		if err != nil {
+			log.Printf("conn %d reqId:%d: %v, skipped", record.ConnId, record.Msg.ReqId(), err)
+			continue
+		}
+		if msg != nil {
+			joined = append(joined, &gateway.CaptureRecord{Direction: record.Direction, ConnId: record.ConnId, Time: record.Time, Msg: msg})
+		}
+	}
+	return joined
+}
+
+// exchange is a captured request with its captured response, if any
+type exchange struct {
+	request  *gateway.AgwMessage
+	response *gateway.AgwMessage
+}
+
+// exchanges pairs the requests sent in the direction with the responses coming back
+func exchanges(records []*gateway.CaptureRecord, direction uint8) []*exchange {
+	back := gateway.CaptureInbound
+	if direction == gateway.CaptureInbound {
+		back = gateway.CaptureOutbound
+	}
+	var result []*exchange
+	pending := make(map[exchangeKey]*exchange)
+	for _, record := range joinStreams(records) {
+		key := exchangeKey{connId: record.ConnId, reqId: record.Msg.ReqId()}
+		if isBiz(record, direction, gateway.MessageDirectionRequest) {
+			e := &exchange{request: record.Msg}
+			pending[key] = e
+			result = append(result, e)
+		} else if isBiz(record, back, gateway.MessageDirectionResponse) {
+			if e, ok := pending[key]; ok {
+				e.response = record.Msg
+				delete(pending, key)
+			}
+		}
+	}
+	return result
+}
+
+// script answers the requests of the client with the captured responses of the same
+// handler in their captured order, the last one is repeated once they run out.
+func script(server *gatewaytest.Server, records []*gateway.CaptureRecord) {
+	var lock sync.Mutex
+	responses := make(map[string][]*gateway.AgwMessage)
+	for _, e := range exchanges(records, gateway.CaptureOutbound) {
+		if e.response == nil {
+			continue
+		}
+		key := e.request.ServerName() + "_" + e.request.HandlerName()
+		if _, ok := responses[key]; !ok {
+			serverName, handlerName := e.request.ServerName(), e.request.HandlerName()
+			server.Handle(serverName, handlerName, func(req *gateway.AgwMessage) (string, error) {
+				lock.Lock()
+				queue := responses[key]
+				response := queue[0]
+				if len(queue) > 1 {
+					responses[key] = queue[1:]
+				}
+				lock.Unlock()
+				if response.InnerCode() != 0 {
+					return "", &gateway.RemoteError{Code: response.InnerCode(), Msg: response.InnerMsg()}
+				}
+				return response.Body(), nil
+			})
+		}
+		responses[key] = append(responses[key], e.response)
+	}
+}
+
+// replayClient sends the captured requests of the client to a local gateway
+// scripted with the captured responses, and reports the answers which differ.
+func replayClient(records []*gateway.CaptureRecord) error {
+	server, err := gatewaytest.NewServer()
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	script(server, records)
+
+	client, err := gateway.NewAgwClient(server.Config())
+	if err != nil {
+		return err
+	}
+	defer client.Close(context.Background())
+
+	mismatches := 0
+	for _, e := range exchanges(records, gateway.CaptureOutbound) {
+		req := e.request
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		metadata := gateway.RpcMetadata{ServerName: req.ServerName(), HandlerName: req.HandlerName(), Version: req.Version()}
+		body, err := client.CallContext(ctx, req.OuterReqId(), metadata, req.Body())
+		cancel()
+
+		result := "ok"
+		switch {
+		case e.response == nil:
+			result = "unanswered in capture"
+		case err != nil:
+			var remote *gateway.RemoteError
+			if !errors.As(err, &remote) || remote.Code != e.response.InnerCode() {
+				result = "error: " + err.Error()
+				mismatches++
+			}
+		case body != e.response.Body():
+			result = "body mismatch"
+			mismatches++
+		}
+		fmt.Printf("%s_%s reqId:%d outerReqId:%s %s\n", req.ServerName(), req.HandlerName(), req.ReqId(), req.OuterReqId(), result)
+	}
+	fmt.Printf("%d mismatches\n", mismatches)
+	return nil
+}
+
+// serve answers a real client with the captured responses, and sends the captured
+// requests of the gateway to the first client connecting, until interrupted.
+func serve(addr string, records []*gateway.CaptureRecord) error {
+	server, err := gatewaytest.NewServerAt(addr)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	script(server, records)
+	log.Printf("serving %d captured frames on %s", len(records), addr)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		for len(server.Conns()) == 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		conn := server.Conns()[0]
+		for _, e := range exchanges(records, gateway.CaptureInbound) {
+			req := e.request
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			response, err := conn.Call(ctx, req.HandlerName(), req.Body(), req.Version())
+			cancel()
+			if err != nil {
+				log.Printf("%s reqId:%d failed: %v", req.HandlerName(), req.ReqId(), err)
+				continue
+			}
+			vo := toVO(&gateway.CaptureRecord{Direction: gateway.CaptureInbound, Time: time.Now(), Msg: response})
+			out, _ := json.Marshal(vo)
+			log.Printf("%s reqId:%d answered %s", req.HandlerName(), req.ReqId(), out)
+		}
+	}()
+	<-interrupt
+	return nil
+}
@@ -77,35 +77,50 @@ func resolveConfigFilePath(filePath string) string {
 	return config.DefaultConfigFilename
 }
 
+// InitConfigFromFile loads the config backing the package level functions
 func InitConfigFromFile(p string) error {
+	return loadConfig(localConf, p)
+}
+
+// LoadConfig loads a standalone config from the YAML file and the system env,
+// the package level functions are not affected.
+func LoadConfig(p string) (*Config, error) {
+	conf := NewDefaultConfig()
+	if err := loadConfig(conf, p); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func loadConfig(conf *Config, p string) error {
 	filePath := resolveConfigFilePath(p)
-	err := loadConfFromYamlFile(filePath)
+	err := loadConfFromYamlFile(conf, filePath)
 	if err != nil {
 		return err
 	}
 
-	loadConfFromSystemEnv()
-	if err = checkAndFillDefaultValues(); err != nil {
+	loadConfFromSystemEnv(conf)
+	if err = checkAndFillDefaultValues(conf); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func checkAndFillDefaultValues() error {
-	if localConf.DataSource.TimeoutMs == 0 {
-		localConf.DataSource.TimeoutMs = datasource.DefaultTimeoutMs
+func checkAndFillDefaultValues(conf *Config) error {
+	if conf.DataSource.TimeoutMs == 0 {
+		conf.DataSource.TimeoutMs = datasource.DefaultTimeoutMs
 	}
-	if localConf.DataSource.ListenIntervalMs == 0 {
-		localConf.DataSource.ListenIntervalMs = datasource.DefaultListenIntervalMs
+	if conf.DataSource.ListenIntervalMs == 0 {
+		conf.DataSource.ListenIntervalMs = datasource.DefaultListenIntervalMs
 	}
-	if localConf.DataSource.ListenIntervalMs < localConf.DataSource.TimeoutMs {
+	if conf.DataSource.ListenIntervalMs < conf.DataSource.TimeoutMs {
 		return errors.New("DataSource.ListenIntervalMs should be greater than DataSource.TimeoutMs")
 	}
 	return nil
 }
 
-func loadConfFromYamlFile(filePath string) error {
+func loadConfFromYamlFile(conf *Config, filePath string) error {
 	if filePath == config.DefaultConfigFilename {
 		if _, err := os.Stat(filePath); err != nil {
 			return nil
@@ -119,7 +134,7 @@ func loadConfFromYamlFile(filePath string) error {
 		Version string
 		AHAS    *Config `yaml:"ahas"`
 	}{
-		AHAS: localConf,
+		AHAS: conf,
 	}
 	err = yaml.Unmarshal(content, &data)
 	if err != nil {
@@ -129,21 +144,26 @@ func loadConfFromYamlFile(filePath string) error {
 	return nil
 }
 
-func loadConfFromSystemEnv() {
+func loadConfFromSystemEnv(conf *Config) {
 	if license := os.Getenv(LicenseEnvKey); !util.IsBlank(license) {
-		localConf.License = license
+		conf.License = license
 	}
 	if namespace := os.Getenv(NamespaceEnvKey); !util.IsBlank(namespace) {
-		localConf.Namespace = namespace
+		conf.Namespace = namespace
 	}
 	if ahasEnv := os.Getenv(EnvironmentEnvKey); !util.IsBlank(ahasEnv) {
-		localConf.Env = ahasEnv
+		conf.Env = ahasEnv
 	}
 	if ahasRegionId := os.Getenv(RegionIdEnvKey); !util.IsBlank(ahasRegionId) {
-		localConf.RegionId = ahasRegionId
+		conf.RegionId = ahasRegionId
 	}
 }
 
+// Default returns the config backing the package level functions
+func Default() *Config {
+	return localConf
+}
+
 func License() string {
 	return localConf.License
 }
@@ -0,0 +1,166 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// Callers of the frames, the caller byte is zero on every frame but the capability
+// handshake.
+const (
+	CallerUnknown uint8 = 0
+	CallerClient  uint8 = 1
+	CallerGateway uint8 = 2
+)
+
+const (
+	// CapabilitiesHandlerName is the handler name of the capability handshake
+	CapabilitiesHandlerName = "CAPS"
+	// ProtocolVersion is the version of the frame protocol of this client
+	ProtocolVersion = 1
+)
+
+// Capabilities are the protocol features of one side of a connection, exchanged by
+// the handshake which opens every connection. The handshake is a heartbeat frame in
+// the legacy encoding, with CapabilitiesHandlerName, the caller byte set to
+// CallerClient and the capabilities of the client as JSON body. A gateway which knows
+// the handshake answers with CallerGateway and its own capabilities. Older gateways
+// echo the heartbeat or ignore it, the connection then keeps the legacy protocol.
+// The frames of the connection are encoded with the negotiated capabilities only.
+//
+// The handshake is the source of truth for the codec of a connection: its requests are
+// compressed with the first of the client codecs the gateway lists, gzip if none. The
+// codecs exchanged by the connect request, see AgwClient.SetPeerCodecs, only apply to
+// the connections of older gateways, which keep the legacy protocol.
+type Capabilities struct {
+	Protocol int `json:"protocol"`
+	// Codecs lists the accepted codec names in preference order
+	Codecs []string `json:"codecs"`
+	// MaxFrameSize bounds the bodies accepted as sent on the wire, 0 if unknown
+	MaxFrameSize uint32 `json:"maxFrameSize"`
+	// StringIp tells whether frames with IPv6 client ids are understood, see
+	// AgwMessage.SetClientAddr
+	StringIp bool `json:"stringIp"`
+	// Streaming tells whether bodies split across continuation frames are understood
+	Streaming bool `json:"streaming"`
+}
+
+// localCapabilities returns the capabilities announced by the client
+func (c *AgwClient) localCapabilities() Capabilities {
+	return Capabilities{
+		Protocol:     ProtocolVersion,
+		Codecs:       c.SupportedCodecs(),
+		MaxFrameSize: c.config.FrameLimits.MaxBodySize,
+		StringIp:     true,
+		Streaming:    true,
+	}
+}
+
+// negotiate returns the capabilities shared by the client and the gateway: the codecs
+// of both in the preference order of the client, and the frame size of the gateway.
+func negotiate(local, peer Capabilities) Capabilities {
+	shared := Capabilities{
+		Protocol:     peer.Protocol,
+		MaxFrameSize: peer.MaxFrameSize,
+		StringIp:     peer.StringIp,
+		Streaming:    local.Streaming && peer.Streaming,
+	}
+	if local.Protocol < shared.Protocol {
+		shared.Protocol = local.Protocol
+	}
+	for _, name := range local.Codecs {
+		if containsFold(peer.Codecs, name) {
+			shared.Codecs = append(shared.Codecs, name)
+		}
+	}
+	return shared
+}
+
+// handshake negotiates the capabilities of a new connection. It runs in the background,
+// the connection uses the legacy protocol until the gateway answered.
+func (c *AgwClient) handshake(conn *AgwConn) {
+	local := c.localCapabilities()
+	body, err := json.Marshal(local)
+	if err != nil {
+		return
+	}
+	msg := NewAgwMessage()
+	msg.SetReqId(generateId())
+	msg.SetMessageType(MessageTypeHeartbeat)
+	msg.SetMessageDirection(MessageDirectionRequest)
+	msg.SetCaller(CallerClient)
+	// nothing is negotiated yet, the handshake has to be understood by every gateway
+	msg.SetClientIp(StringIpToUint64(c.config.ClientIp))
+	msg.SetClientVpcId(c.config.ClientVpcId)
+	msg.SetServerName(HeartbeatServerName)
+	msg.SetTimeoutMs(default_handshake_timeout_ms)
+	msg.SetClientProcessFlag(c.config.ClientProcessFlag)
+	msg.SetConnectionId(conn.connId)
+	msg.SetHandlerName(CapabilitiesHandlerName)
+	msg.SetOuterReqId("noReqIdForCaps")
+	msg.SetBody(string(body))
+
+	ctx, cancel := context.WithTimeout(context.Background(), default_handshake_timeout_ms*time.Millisecond)
+	defer cancel()
+	response, _, err := conn.writeSync(ctx, msg)
+	if err != nil {
+		logInfof("[AGW] No capability handshake on connection %d, keep the legacy protocol: %v", conn.connId, err)
+		return
+	}
+	var peer Capabilities
+	if response.Caller() != CallerGateway || json.Unmarshal([]byte(response.Body()), &peer) != nil || peer.Protocol <= 0 {
+		logInfof("[AGW] Gateway does not negotiate capabilities on connection %d, keep the legacy protocol", conn.connId)
+		return
+	}
+
+	shared := negotiate(local, peer)
+	codec, _ := preferredCodec(local.Codecs, peer.Codecs)
+	conn.setCapabilities(&shared, codec)
+	logInfof("[AGW] Capabilities negotiated on connection %d: %+v", conn.connId, shared)
+	if !shared.StringIp && net.ParseIP(c.config.ClientIp).To4() == nil {
+		logWarnf("[AGW] Gateway does not support the client ip %s on connection %d, the frames carry no client ip", c.config.ClientIp, conn.connId)
+	}
+}
+
+// capabilities returns the negotiated capabilities of the connection, nil while it
+// uses the legacy protocol.
+func (c *AgwConn) capabilities() *Capabilities {
+	c.capsLock.RLock()
+	defer c.capsLock.RUnlock()
+	return c.caps
+}
+
+func (c *AgwConn) setCapabilities(caps *Capabilities, codec uint8) {
+	c.capsLock.Lock()
+	c.caps = caps
+	c.codec = codec
+	c.capsLock.Unlock()
+}
+
+// peerMaxFrameSize bounds the bodies sent on the connection, 0 if unknown
+func (c *AgwConn) peerMaxFrameSize() uint32 {
+	if caps := c.capabilities(); caps != nil {
+		return caps.MaxFrameSize
+	}
+	return 0
+}
+
+// stringIpSupported tells whether the connection negotiated IPv6 client ids
+func (c *AgwConn) stringIpSupported() bool {
+	caps := c.capabilities()
+	return caps != nil && caps.StringIp
+}
+
+// wireMessage returns msg as it is sent on the connection. The address of a client
+// which is not IPv4 is only sent to the gateways which negotiated StringIp, the
+// others get a copy with the legacy zero clientIp and no versionFlagStringIp.
+func (c *AgwConn) wireMessage(msg *AgwMessage) *AgwMessage {
+	if msg.clientIpString == "" || c.stringIpSupported() {
+		return msg
+	}
+	legacy := *msg
+	legacy.clientIpString = ""
+	return &legacy
+}
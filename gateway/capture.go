@@ -0,0 +1,231 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Directions of the captured frames
+const (
+	CaptureInbound  uint8 = 1
+	CaptureOutbound uint8 = 2
+)
+
+const (
+	// direction, connId and timestamp
+	captureHeaderSize = 13
+	captureRedacted   = "***"
+)
+
+// CaptureConfig records every frame of the client to a rotating file, see cmd/agwdump.
+// A record is the big endian uint32 length of the rest, the direction byte, the
+// uint32 connection id, the int64 unix nanoseconds and the frame. The chunks of a
+// streamed body are recorded once joined, as a single frame, so that the body is
+// redacted as a whole.
+type CaptureConfig struct {
+	// File is the path of the capture, the rotated files are kept next to it
+	File string
+	// MaxSizeMB is the size after which the file is rotated, 100 by default
+	MaxSizeMB int
+	// MaxBackups is the number of rotated files kept, 3 by default
+	MaxBackups int
+	// RedactKeys lists the keys of the JSON bodies whose values are masked, at any depth.
+	// Defaults to the auth headers and the keys returned by connect.
+	RedactKeys []string
+}
+
+// CaptureRecord is a frame read back from a capture
+type CaptureRecord struct {
+	Direction uint8
+	ConnId    uint32
+	Time      time.Time
+	Msg       *AgwMessage
+}
+
+type recorder struct {
+	lock   sync.Mutex
+	w      io.WriteCloser
+	redact map[string]bool
+	// the partial streamed bodies of each connection and direction
+	streams map[captureStream]*StreamAssembler
+}
+
+type captureStream struct {
+	direction uint8
+	connId    uint32
+}
+
+func newRecorder(config *CaptureConfig) *recorder {
+	maxSize := config.MaxSizeMB
+	if maxSize <= 0 {
+		maxSize = default_capture_max_size_mb
+	}
+	maxBackups := config.MaxBackups
+	if maxBackups <= 0 {
+		maxBackups = default_capture_max_backups
+	}
+	keys := config.RedactKeys
+	if len(keys) == 0 {
+		keys = []string{"ak", "sk", "sn"}
+	}
+	r := &recorder{
+		w: &lumberjack.Logger{
+			Filename:   config.File,
+			MaxSize:    maxSize,
+			MaxBackups: maxBackups,
+		},
+		redact:  make(map[string]bool),
+		streams: make(map[captureStream]*StreamAssembler),
+	}
+	for _, key := range keys {
+		r.redact[key] = true
+	}
+	logInfof("[AGW] Capturing frames to %s", config.File)
+	return r
+}
+
+// record appends msg to the capture, a failure is logged and the frame is skipped.
+func (r *recorder) record(direction uint8, connId uint32, msg *AgwMessage) {
+	if msg.messageType == MessageTypeStream {
+		if msg = r.joinStream(direction, connId, msg); msg == nil {
+			return
+		}
+	}
+	redacted := *msg
+	redacted.body = r.redactBody(msg.body)
+	record := make([]byte, 4, 4+captureHeaderSize+frameFixedSize+len(redacted.body))
+	record = append(record, direction)
+	record = appendUint32(record, connId)
+	record = appendUint64(record, uint64(time.Now().UnixNano()))
+	record, err := redacted.appendFrame(record, 0)
+	if err != nil {
+		logWarnf("[AGW] Capture frame %d failed: %v", msg.ReqId(), err)
+		return
+	}
+	binary.BigEndian.PutUint32(record, uint32(len(record)-4))
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, err := r.w.Write(record); err != nil {
+		logWarnf("[AGW] Capture frame %d failed: %v", msg.ReqId(), err)
+	}
+}
+
+// joinStream buffers the chunk of a stream, it returns the whole message once the
+// chunk ends the stream, nil before. Redacting the chunks one by one would leave
+// the keys and values split across chunks in clear.
+func (r *recorder) joinStream(direction uint8, connId uint32, chunk *AgwMessage) *AgwMessage {
+	key := captureStream{direction: direction, connId: connId}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	streams, ok := r.streams[key]
+	if !ok {
+		streams = NewStreamAssembler(0)
+		r.streams[key] = streams
+	}
+	whole, err := streams.Add(chunk)
+	if streams.Len() == 0 {
+		delete(r.streams, key)
+	}
+	if err != nil {
+		logWarnf("[AGW] Capture stream %d failed: %v", chunk.ReqId(), err)
+		return nil
+	}
+	return whole
+}
+
+// redactBody masks the values of the redacted keys of a JSON body, other bodies are kept.
+func (r *recorder) redactBody(body string) string {
+	if len(body) == 0 || (body[0] != '{' && body[0] != '[') {
+		return body
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(body), &v); err != nil {
+		return body
+	}
+	if !r.redactValue(v) {
+		return body
+	}
+	redacted, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return string(redacted)
+}
+
+// redactValue masks v in place and tells whether anything was masked
+func (r *recorder) redactValue(v interface{}) bool {
+	masked := false
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			if r.redact[key] {
+				value[key] = captureRedacted
+				masked = true
+			} else if r.redactValue(child) {
+				masked = true
+			}
+		}
+	case []interface{}:
+		for _, child := range value {
+			if r.redactValue(child) {
+				masked = true
+			}
+		}
+	}
+	return masked
+}
+
+func (r *recorder) close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.w.Close()
+}
+
+// CaptureReader reads the records of a capture file.
+type CaptureReader struct {
+	r *bufio.Reader
+}
+
+func NewCaptureReader(r io.Reader) *CaptureReader {
+	return &CaptureReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next record, io.EOF at the end of the capture
+func (c *CaptureReader) Next() (*CaptureRecord, error) {
+	var header [4 + captureHeaderSize]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated capture record: %w", err)
+		}
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:])
+	if length < captureHeaderSize+frameFixedSize {
+		return nil, fmt.Errorf("%w: capture record of %d bytes", ErrMalformedFrame, length)
+	}
+	record := &CaptureRecord{
+		Direction: header[4],
+		ConnId:    binary.BigEndian.Uint32(header[5:]),
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(header[9:]))),
+		Msg:       NewAgwMessage(),
+	}
+	frame := io.LimitReader(c.r, int64(length-captureHeaderSize))
+	br := bufio.NewReader(frame)
+	if err := record.Msg.Decode(br); err != nil {
+		return nil, err
+	}
+	// skip what the frame decoder left, e.g. a frame of a newer protocol
+	if _, err := io.Copy(ioutil.Discard, br); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
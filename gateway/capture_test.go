@@ -0,0 +1,166 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestRecorder returns a recorder writing to a temporary file and the func which
+// closes it and reads its records back.
+func newTestRecorder(t *testing.T, config CaptureConfig) (*recorder, func() []*CaptureRecord) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.File = filepath.Join(dir, "agw.capture")
+	r := newRecorder(&config)
+	return r, func() []*CaptureRecord {
+		defer os.RemoveAll(dir)
+		if err := r.close(); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(config.File)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var records []*CaptureRecord
+		reader := NewCaptureReader(f)
+		for {
+			record, err := reader.Next()
+			if err == io.EOF {
+				return records
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, record)
+		}
+	}
+}
+
+func TestCaptureStreamRedaction(t *testing.T) {
+	r, records := newTestRecorder(t, CaptureConfig{})
+	// the secret is split across the chunks, neither chunk parses on its own
+	for _, chunk := range []string{`{"ak":"public","s`, `k":"secret"}`, ""} {
+		r.record(CaptureOutbound, 1, newChunk(7, MessageDirectionRequest, chunk))
+	}
+	// the chunks of another connection are joined apart
+	r.record(CaptureOutbound, 2, newChunk(7, MessageDirectionRequest, `{"sk":"other"`))
+	got := records()
+	if len(got) != 1 {
+		t.Fatalf("%d records, want the stream recorded once joined", len(got))
+	}
+	msg := got[0].Msg
+	if msg.MessageType() != MessageTypeBiz || msg.ReqId() != 7 || got[0].ConnId != 1 {
+		t.Fatalf("record of type %d, reqId %d, connId %d", msg.MessageType(), msg.ReqId(), got[0].ConnId)
+	}
+	if msg.Body() != `{"ak":"***","sk":"***"}` {
+		t.Fatalf("joined body recorded as %s", msg.Body())
+	}
+}
+
+func TestCaptureRedactBody(t *testing.T) {
+	r := newRecorder(&CaptureConfig{File: os.DevNull})
+	defer r.close()
+	custom := newRecorder(&CaptureConfig{File: os.DevNull, RedactKeys: []string{"token"}})
+	defer custom.close()
+	cases := []struct {
+		name     string
+		r        *recorder
+		body     string
+		redacted string
+	}{
+		{"top level", r, `{"ak":"a","sk":"s","name":"n"}`, `{"ak":"***","name":"n","sk":"***"}`},
+		{"nested", r, `{"auth":{"sn":"x","list":[{"sk":"s"}]}}`, `{"auth":{"list":[{"sk":"***"}],"sn":"***"}}`},
+		{"object value", r, `{"sk":{"k":"v"}}`, `{"sk":"***"}`},
+		{"array", r, `[{"ak":1},2]`, `[{"ak":"***"},2]`},
+		{"nothing to mask", r, `{"name": "kept as is"}`, `{"name": "kept as is"}`},
+		{"not json", r, `ak=secret`, `ak=secret`},
+		{"invalid json", r, `{"ak":`, `{"ak":`},
+		{"empty", r, ``, ``},
+		{"custom keys", custom, `{"token":"t","sk":"s"}`, `{"sk":"s","token":"***"}`},
+	}
+	for _, c := range cases {
+		if redacted := c.r.redactBody(c.body); redacted != c.redacted {
+			t.Errorf("%s: %s redacted as %s, want %s", c.name, c.body, redacted, c.redacted)
+		}
+	}
+}
+
+func TestCaptureReader(t *testing.T) {
+	r, records := newTestRecorder(t, CaptureConfig{})
+	request := newTestMessage(MessageDirectionRequest, AllCompress, `{"sk":"secret","rules":[]}`)
+	response := newTestMessage(MessageDirectionResponse, NoCompress, "plain")
+	r.record(CaptureOutbound, 3, request)
+	r.record(CaptureInbound, 4, response)
+	got := records()
+	if len(got) != 2 {
+		t.Fatalf("%d records, want 2", len(got))
+	}
+	if got[0].Direction != CaptureOutbound || got[0].ConnId != 3 || got[1].Direction != CaptureInbound || got[1].ConnId != 4 {
+		t.Fatalf("records of %d/%d and %d/%d", got[0].Direction, got[0].ConnId, got[1].Direction, got[1].ConnId)
+	}
+	if got[0].Time.IsZero() || got[1].Time.Before(got[0].Time) {
+		t.Fatalf("record times %v then %v", got[0].Time, got[1].Time)
+	}
+	if body := got[0].Msg.Body(); body != `{"rules":[],"sk":"***"}` {
+		t.Fatalf("request recorded with %s", body)
+	}
+	if got[0].Msg.HandlerName() != request.HandlerName() || got[0].Msg.ReqId() != request.ReqId() {
+		t.Fatalf("request recorded as %s/%d", got[0].Msg.HandlerName(), got[0].Msg.ReqId())
+	}
+	if got[1].Msg.Body() != "plain" || got[1].Msg.MessageDirection() != MessageDirectionResponse {
+		t.Fatalf("response recorded with %q", got[1].Msg.Body())
+	}
+	// the recorded message is a copy
+	if request.Body() != `{"sk":"secret","rules":[]}` {
+		t.Fatalf("recording changed the body to %s", request.Body())
+	}
+}
+
+func TestCaptureReaderErrors(t *testing.T) {
+	record := make([]byte, 4, 64)
+	record = append(record, CaptureInbound)
+	record = appendUint32(record, 1)
+	record = appendUint64(record, 0)
+	record, err := newTestMessage(MessageDirectionRequest, NoCompress, "body").appendFrame(record, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint32(record, uint32(len(record)-4))
+
+	if _, err := NewCaptureReader(bytes.NewReader(nil)).Next(); err != io.EOF {
+		t.Fatalf("empty capture returned %v, want EOF", err)
+	}
+	if _, err := NewCaptureReader(bytes.NewReader(record[:10])).Next(); err == nil || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated header returned %v", err)
+	}
+	if _, err := NewCaptureReader(bytes.NewReader(record[:len(record)-2])).Next(); err == nil {
+		t.Fatal("truncated frame read")
+	}
+	short := append([]byte(nil), record...)
+	binary.BigEndian.PutUint32(short, captureHeaderSize)
+	if _, err := NewCaptureReader(bytes.NewReader(short)).Next(); !errors.Is(err, ErrMalformedFrame) {
+		t.Fatalf("record shorter than a frame returned %v, want %v", err, ErrMalformedFrame)
+	}
+
+	// the bytes a newer frame has past the known fields are skipped
+	longer := append(append([]byte(nil), record...), "extension"...)
+	binary.BigEndian.PutUint32(longer, uint32(len(longer)-4))
+	reader := NewCaptureReader(bytes.NewReader(append(longer, record...)))
+	for i := 0; i < 2; i++ {
+		if next, err := reader.Next(); err != nil || next.Msg.Body() != "body" {
+			t.Fatalf("record %d read as %v, %v", i, next, err)
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Fatalf("end of the capture returned %v, want EOF", err)
+	}
+}
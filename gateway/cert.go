@@ -0,0 +1,324 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/sumansoul/aliyun-ahas-go-sdk/aliyun"
+	"github.com/sumansoul/aliyun-ahas-go-sdk/tools"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CertPath is where the gateway certificate is kept, in a directory private to the user.
+// It is empty if neither the home nor the cache directory of the user is known.
+var CertPath = defaultCertPath()
+
+func defaultCertPath() string {
+	dir := tools.GetUserHome()
+	if !filepath.IsAbs(dir) {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil || !filepath.IsAbs(cacheDir) {
+			return ""
+		}
+		dir = cacheDir
+	}
+	return filepath.Join(dir, ".ahas", "certs", "sChat.pem")
+}
+
+// certPinPath keeps the public keys pinned on the first download of the certificate
+func certPinPath() string {
+	return CertPath + ".spki"
+}
+
+// certManager owns the downloaded gateway certificate and the TLS config built on it.
+// New connections take the current config, refreshes swap it atomically so that
+// established connections are not affected.
+type certManager struct {
+	config AgwConfig
+	// fetch downloads the certificate to the given path
+	fetch func(dst string) error
+	// serializes loads and refreshes
+	lock        sync.Mutex
+	state       atomic.Value
+	refreshedAt time.Time
+}
+
+// certState is swapped as a whole by the certManager
+type certState struct {
+	tlsConfig *tls.Config
+	// expiry of the downloaded certificate, zero if it is not used
+	notAfter time.Time
+	loadedAt time.Time
+}
+
+func (s *certState) stale() bool {
+	if !s.notAfter.IsZero() && expiresSoon(s.notAfter) {
+		return true
+	}
+	return time.Since(s.loadedAt) > default_tls_reload_interval_sec*time.Second
+}
+
+// expiresSoon tells whether a certificate expiring at notAfter is due for renewal
+func expiresSoon(notAfter time.Time) bool {
+	return time.Now().Add(default_cert_renew_before_sec * time.Second).After(notAfter)
+}
+
+func newCertManager(config AgwConfig) *certManager {
+	m := &certManager{config: config}
+	m.fetch = func(dst string) error {
+		remoteFilePath := path.Join(tools.Constant.OSAgentRemotePath, "cert", "sChat.pem")
+		return aliyun.Download(dst, config.ClientRegionId, remoteFilePath, config.ClientInVpc)
+	}
+	return m
+}
+
+// current returns the TLS config of new connections. It is rebuilt when the downloaded
+// certificate is about to expire, and periodically to pick up rotated CA and client
+// certificate files.
+func (m *certManager) current() (*tls.Config, error) {
+	if state, ok := m.state.Load().(*certState); ok && !state.stale() {
+		return state.tlsConfig, nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if state, ok := m.state.Load().(*certState); ok && !state.stale() {
+		return state.tlsConfig, nil
+	}
+	return m.load(false)
+}
+
+// refresh re-downloads the certificate after a failed handshake and rebuilds the TLS
+// config. It returns false if nothing was refreshed, as it runs at most once per
+// default_cert_refresh_interval_sec.
+func (m *certManager) refresh(reason error) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if time.Since(m.refreshedAt) < default_cert_refresh_interval_sec*time.Second {
+		return false, nil
+	}
+	m.refreshedAt = time.Now()
+	logWarnf("[AGW] Refresh the gateway certificate, reason: %v", reason)
+	if _, err := m.load(true); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// load builds the TLS config, the caller must hold m.lock. The downloaded certificate
+// is fetched again if forced, missing, invalid or about to expire.
+func (m *certManager) load(force bool) (*tls.Config, error) {
+	var notAfter time.Time
+	if m.config.TlsFlag && m.config.Tls.usesDownloadedCert() {
+		var err error
+		notAfter, err = m.ensureCert(force)
+		if err != nil {
+			return nil, err
+		}
+	}
+	conf, err := buildTlsConfig(m.config)
+	if err != nil {
+		return nil, err
+	}
+	m.state.Store(&certState{tlsConfig: conf, notAfter: notAfter, loadedAt: time.Now()})
+	return conf, nil
+}
+
+func (m *certManager) ensureCert(force bool) (time.Time, error) {
+	if !force {
+		if info, err := os.Stat(CertPath); err == nil && info.Mode().Perm()&0077 != 0 {
+			// written by an older version or by someone else, do not trust it
+			logWarnf("[AGW] Local gateway certificate %s is accessible by others, download again", CertPath)
+		} else if pemBytes, err := ioutil.ReadFile(CertPath); err == nil {
+			notAfter, err := m.verifyCert(pemBytes)
+			if err == nil && !expiresSoon(notAfter) {
+				return notAfter, nil
+			}
+			if err == nil {
+				err = fmt.Errorf("it expires at %v", notAfter)
+			}
+			logWarnf("[AGW] Local gateway certificate is not usable, download again, err: %v", err)
+		}
+	}
+	return m.downloadCert()
+}
+
+// downloadCert downloads the certificate into a temporary file next to CertPath,
+// verifies it and renames it over CertPath, so that readers never see a partial file.
+// The certificate comes over plain http, it is only trusted if its public keys match
+// the pins, see TlsConfig.CertSpki.
+func (m *certManager) downloadCert() (time.Time, error) {
+	if !filepath.IsAbs(CertPath) {
+		// a relative path would write the certificate to the working directory
+		return time.Time{}, fmt.Errorf("no private directory for the gateway certificate, CertPath %q", CertPath)
+	}
+	dir := filepath.Dir(CertPath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return time.Time{}, fmt.Errorf("create cert dir failed, %v", err)
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return time.Time{}, fmt.Errorf("chmod cert dir failed, %v", err)
+	}
+
+	tmpPath, err := m.download(dir)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("download cert failed, err: %v", err)
+	}
+	defer os.Remove(tmpPath)
+
+	pemBytes, err := ioutil.ReadFile(tmpPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	notAfter, err := m.verifyCert(pemBytes)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("verify downloaded cert failed, %v", err)
+	}
+	if err := os.Rename(tmpPath, CertPath); err != nil {
+		return time.Time{}, fmt.Errorf("save cert failed, %v", err)
+	}
+	logInfof("[AGW] Gateway certificate downloaded, expires at %v", notAfter)
+	return notAfter, nil
+}
+
+func (m *certManager) download(dir string) (string, error) {
+	tmpFile, err := ioutil.TempFile(dir, ".download-")
+	if err != nil {
+		return "", err
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+	err = m.fetch(tmpPath)
+	if err == nil {
+		err = os.Chmod(tmpPath, 0600)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return tmpPath, nil
+}
+
+// verifyCert authenticates the certificates of the PEM against the pins and checks
+// their validity period, it returns the earliest expiry. Without configured pins, the
+// keys of the first certificate verified are pinned to certPinPath.
+func (m *certManager) verifyCert(pemBytes []byte) (time.Time, error) {
+	certs, notAfter, err := parseCerts(pemBytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	pins, err := m.pins()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(pins) == 0 {
+		logWarnf("[AGW] No pinned key for the gateway certificate, trusting the keys of %s from now on", certs[0].Subject)
+		return notAfter, savePins(certs)
+	}
+	if err := verifyCertPins(certs, pins); err != nil {
+		return time.Time{}, err
+	}
+	return notAfter, nil
+}
+
+// pins returns the configured pins, or the ones saved on the first download
+func (m *certManager) pins() (map[string]bool, error) {
+	pins := make(map[string]bool)
+	for _, pin := range m.config.Tls.CertSpki {
+		pins[pin] = true
+	}
+	if len(pins) > 0 {
+		return pins, nil
+	}
+	content, err := ioutil.ReadFile(certPinPath())
+	if os.IsNotExist(err) {
+		return pins, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read pinned keys failed, %v", err)
+	}
+	for _, pin := range strings.Fields(string(content)) {
+		pins[pin] = true
+	}
+	return pins, nil
+}
+
+func savePins(certs []*x509.Certificate) error {
+	var content strings.Builder
+	for _, cert := range certs {
+		content.WriteString(spkiDigest(cert))
+		content.WriteString("\n")
+	}
+	if err := ioutil.WriteFile(certPinPath(), []byte(content.String()), 0600); err != nil {
+		return fmt.Errorf("save pinned keys failed, %v", err)
+	}
+	return nil
+}
+
+// verifyCertPins checks that every certificate either has a pinned key or is signed by
+// a certificate of the PEM which has one. The PEM becomes the trusted roots, so that
+// an unpinned self-signed certificate next to a pinned one must not pass.
+func verifyCertPins(certs []*x509.Certificate, pins map[string]bool) error {
+	anchors := x509.NewCertPool()
+	pinned := 0
+	for _, cert := range certs {
+		if pins[spkiDigest(cert)] {
+			anchors.AddCert(cert)
+			pinned++
+		}
+	}
+	if pinned == 0 {
+		return errors.New("no certificate matches the pinned keys")
+	}
+	for _, cert := range certs {
+		if pins[spkiDigest(cert)] {
+			continue
+		}
+		opts := x509.VerifyOptions{Roots: anchors, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
+		if _, err := cert.Verify(opts); err != nil {
+			return fmt.Errorf("certificate %s is neither pinned nor signed by a pinned key, %v", cert.Subject, err)
+		}
+	}
+	return nil
+}
+
+// parseCerts parses the certificates of the PEM and checks their validity period, it
+// returns them with the earliest expiry.
+func parseCerts(pemBytes []byte) ([]*x509.Certificate, time.Time, error) {
+	var certs []*x509.Certificate
+	var notAfter time.Time
+	now := time.Now()
+	for rest := pemBytes; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			return nil, time.Time{}, fmt.Errorf("certificate %s is out of its validity period", cert.Subject)
+		}
+		if notAfter.IsZero() || cert.NotAfter.Before(notAfter) {
+			notAfter = cert.NotAfter
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, time.Time{}, errors.New("no certificate found")
+	}
+	return certs, notAfter, nil
+}
@@ -0,0 +1,246 @@
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCert issues a certificate valid for validity, signed by parent or self-signed
+// if parent is nil. A nil key generates a new one.
+func newTestCert(t *testing.T, name string, key *ecdsa.PrivateKey, parent *testCert, validity time.Duration) *testCert {
+	t.Helper()
+	if key == nil {
+		var err error
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			t.Fatal(err)
+		}
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validity),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		DNSNames:              []string{name},
+	}
+	issuer, signer := template, key
+	if parent != nil {
+		issuer, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func bundle(certs ...*testCert) []byte {
+	var b []byte
+	for _, c := range certs {
+		b = append(b, c.pem...)
+	}
+	return b
+}
+
+// withCertDir points CertPath to a temporary directory, the returned func restores it
+func withCertDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "ahas-cert-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := CertPath
+	CertPath = filepath.Join(dir, "certs", "sChat.pem")
+	return func() {
+		CertPath = saved
+		os.RemoveAll(dir)
+	}
+}
+
+// newTestCertManager serves the PEMs of downloads, one per fetch, the last one repeated
+func newTestCertManager(pins []string, downloads *[][]byte, fetches *int) *certManager {
+	m := newCertManager(AgwConfig{GatewayIp: "gateway", TlsFlag: true, Tls: TlsConfig{CertSpki: pins}})
+	m.fetch = func(dst string) error {
+		pemBytes := (*downloads)[0]
+		if len(*downloads) > 1 {
+			*downloads = (*downloads)[1:]
+		}
+		*fetches++
+		return ioutil.WriteFile(dst, pemBytes, 0644)
+	}
+	return m
+}
+
+func currentNotAfter(m *certManager) time.Time {
+	return m.state.Load().(*certState).notAfter
+}
+
+func TestCertPinnedIssuerSurvivesRenewal(t *testing.T) {
+	defer withCertDir(t)()
+	ca := newTestCert(t, "ahas-ca", nil, nil, 24*365*time.Hour)
+	leaf := newTestCert(t, "gateway", nil, ca, 30*24*time.Hour)
+	renewed := newTestCert(t, "gateway", nil, ca, 60*24*time.Hour)
+	downloads := [][]byte{bundle(leaf, ca), bundle(renewed, ca)}
+	fetches := 0
+	m := newTestCertManager([]string{spkiDigest(ca.cert)}, &downloads, &fetches)
+
+	if _, err := m.current(); err != nil {
+		t.Fatal(err)
+	}
+	if !currentNotAfter(m).Equal(leaf.cert.NotAfter) {
+		t.Fatalf("expiry %v, want the one of the leaf %v", currentNotAfter(m), leaf.cert.NotAfter)
+	}
+	if info, err := os.Stat(CertPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("certificate saved with %v, %v", info.Mode(), err)
+	}
+
+	refreshed, err := m.refresh(errors.New("handshake failed"))
+	if err != nil || !refreshed {
+		t.Fatalf("refresh %v, %v", refreshed, err)
+	}
+	if fetches != 2 || !currentNotAfter(m).Equal(renewed.cert.NotAfter) {
+		t.Fatalf("%d fetches, expiry %v, want the renewed certificate", fetches, currentNotAfter(m))
+	}
+	if refreshed, _ := m.refresh(errors.New("handshake failed")); refreshed || fetches != 2 {
+		t.Fatalf("refreshed again within the refresh interval")
+	}
+}
+
+func TestCertExpiryRedownload(t *testing.T) {
+	defer withCertDir(t)()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	expiring := newTestCert(t, "gateway", key, nil, time.Hour)
+	renewed := newTestCert(t, "gateway", key, nil, 90*24*time.Hour)
+	if err := os.MkdirAll(filepath.Dir(CertPath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(CertPath, expiring.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	downloads := [][]byte{renewed.pem}
+	fetches := 0
+	m := newTestCertManager([]string{spkiDigest(expiring.cert)}, &downloads, &fetches)
+
+	if _, err := m.current(); err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 1 || !currentNotAfter(m).Equal(renewed.cert.NotAfter) {
+		t.Fatalf("%d fetches, expiry %v, want the certificate about to expire downloaded again", fetches, currentNotAfter(m))
+	}
+	if local, _ := ioutil.ReadFile(CertPath); string(local) != string(renewed.pem) {
+		t.Fatal("renewed certificate not saved")
+	}
+	if _, err := m.current(); err != nil || fetches != 1 {
+		t.Fatalf("downloaded again a valid certificate, %d fetches, %v", fetches, err)
+	}
+}
+
+func TestCertPinMismatch(t *testing.T) {
+	ca := newTestCert(t, "ahas-ca", nil, nil, 24*365*time.Hour)
+	leaf := newTestCert(t, "gateway", nil, ca, 30*24*time.Hour)
+	rogue := newTestCert(t, "gateway", nil, nil, 30*24*time.Hour)
+	cases := map[string][]byte{
+		"other key":               rogue.pem,
+		"pinned issuer missing":   leaf.pem,
+		"unpinned next to pinned": bundle(ca, rogue),
+		"empty":                   []byte("not a certificate"),
+	}
+	for name, download := range cases {
+		t.Run(name, func(t *testing.T) {
+			defer withCertDir(t)()
+			downloads := [][]byte{download}
+			fetches := 0
+			m := newTestCertManager([]string{spkiDigest(ca.cert)}, &downloads, &fetches)
+			if _, err := m.current(); err == nil {
+				t.Fatal("certificate trusted despite the pins")
+			}
+			if _, err := os.Stat(CertPath); !os.IsNotExist(err) {
+				t.Fatalf("rejected certificate saved, %v", err)
+			}
+		})
+	}
+}
+
+func TestCertTrustOnFirstUse(t *testing.T) {
+	defer withCertDir(t)()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	first := newTestCert(t, "gateway", key, nil, 30*24*time.Hour)
+	renewed := newTestCert(t, "gateway", key, nil, 60*24*time.Hour)
+	rogue := newTestCert(t, "gateway", nil, nil, 60*24*time.Hour)
+	downloads := [][]byte{first.pem, renewed.pem, rogue.pem}
+	fetches := 0
+	m := newTestCertManager(nil, &downloads, &fetches)
+
+	if _, err := m.downloadCert(); err != nil {
+		t.Fatal(err)
+	}
+	pins, _ := ioutil.ReadFile(certPinPath())
+	if strings.TrimSpace(string(pins)) != spkiDigest(first.cert) {
+		t.Fatalf("pinned %q, want the key of the first certificate", pins)
+	}
+	if notAfter, err := m.downloadCert(); err != nil || !notAfter.Equal(renewed.cert.NotAfter) {
+		t.Fatalf("renewed certificate with the same key rejected, %v", err)
+	}
+	if _, err := m.downloadCert(); err == nil {
+		t.Fatal("certificate with another key trusted after the first use")
+	}
+}
+
+func TestDownloadedCertIsTheDefaultRoot(t *testing.T) {
+	defer withCertDir(t)()
+	gateway := newTestCert(t, "gateway", nil, nil, 30*24*time.Hour)
+	downloads := [][]byte{gateway.pem}
+	fetches := 0
+	m := newTestCertManager(nil, &downloads, &fetches)
+	conf, err := m.current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 1 {
+		t.Fatalf("%d fetches, want the certificate downloaded by default", fetches)
+	}
+	if _, err := gateway.cert.Verify(x509.VerifyOptions{Roots: conf.RootCAs, DNSName: "gateway"}); err != nil {
+		t.Fatalf("downloaded certificate not trusted, %v", err)
+	}
+	if subjects := conf.RootCAs.Subjects(); len(subjects) != 1 {
+		t.Fatalf("%d trusted roots, want the downloaded certificate only", len(subjects))
+	}
+}
+
+func TestDownloadRefusesRelativeCertPath(t *testing.T) {
+	saved := CertPath
+	defer func() { CertPath = saved }()
+	CertPath = filepath.Join(".ahas", "certs", "sChat.pem")
+	downloads := [][]byte{[]byte("unused")}
+	fetches := 0
+	m := newTestCertManager(nil, &downloads, &fetches)
+	if _, err := m.downloadCert(); err == nil || fetches != 0 {
+		t.Fatalf("download to a relative path, %d fetches, %v", fetches, err)
+	}
+	if _, err := os.Stat(".ahas"); !os.IsNotExist(err) {
+		t.Fatalf("certificate directory created in the working directory, %v", err)
+	}
+}
@@ -0,0 +1,272 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Ids of the codecs, carried in the second byte of the frame version. The low 7 bits
+// keep the compress mode (NoCompress, AllCompress, ...), so frames of older peers,
+// which leave the second byte zero, are gzip.
+const (
+	CodecGzip   uint8 = 0
+	CodecNone   uint8 = 1
+	CodecSnappy uint8 = 2
+	CodecZstd   uint8 = 3
+)
+
+// Codec compresses the bodies of frames.
+type Codec interface {
+	// Name is announced to the gateway during connect, e.g. "gzip"
+	Name() string
+	// AppendCompressed appends the compressed body to dst
+	AppendCompressed(dst []byte, body string) ([]byte, error)
+	// Decompress returns the decompressed body, or ErrFrameTooLarge as soon as it
+	// exceeds limit bytes
+	Decompress(body []byte, limit uint32) (string, error)
+}
+
+var (
+	codecLock sync.RWMutex
+	codecs    = map[uint8]Codec{
+		CodecGzip:   gzipCodec{},
+		CodecNone:   noneCodec{},
+		CodecSnappy: snappyCodec{},
+		CodecZstd:   zstdCodec{},
+	}
+
+	gzipWriterPool = sync.Pool{New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}}
+	gzipReaderPool = sync.Pool{New: func() interface{} {
+		return new(gzip.Reader)
+	}}
+)
+
+// RegisterCodec registers codec under id, replacing the codec registered before.
+// A codec has to be registered before it is announced to the gateway.
+func RegisterCodec(id uint8, codec Codec) error {
+	if codec == nil {
+		return errors.New("codec can not be null")
+	}
+	if codec.Name() == "" {
+		return errors.New("codec name can not be blank")
+	}
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	codecs[id] = codec
+	return nil
+}
+
+func getCodec(id uint8) (Codec, bool) {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	codec, ok := codecs[id]
+	return codec, ok
+}
+
+func getCodecByName(name string) (uint8, bool) {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	for id, codec := range codecs {
+		if strings.EqualFold(codec.Name(), name) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// WithCodec returns version with the codec id replaced, the compress mode is kept.
+func WithCodec(version uint32, id uint8) uint32 {
+	return version&^0xff00 | uint32(id)<<8
+}
+
+func compressMode(version uint32) uint32 {
+	return version & compressModeMask
+}
+
+func codecOf(version uint32) uint8 {
+	return uint8(version >> 8)
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string {
+	return "gzip"
+}
+
+// AppendCompressed feeds the body in chunks to avoid copying it at once
+func (gzipCodec) AppendCompressed(dst []byte, body string) ([]byte, error) {
+	w := &appendWriter{buf: dst}
+	zw := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(zw)
+	zw.Reset(w)
+
+	chunk := getBuffer()
+	defer putBuffer(chunk)
+	for len(body) > 0 {
+		n := copy((*chunk)[:cap(*chunk)], body)
+		if _, err := zw.Write((*chunk)[:n]); err != nil {
+			return dst, err
+		}
+		body = body[n:]
+	}
+	if err := zw.Close(); err != nil {
+		return dst, err
+	}
+	return w.buf, nil
+}
+
+func (gzipCodec) Decompress(body []byte, limit uint32) (string, error) {
+	zr := gzipReaderPool.Get().(*gzip.Reader)
+	defer gzipReaderPool.Put(zr)
+	if err := zr.Reset(bytes.NewReader(body)); err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	n, err := io.Copy(&sb, io.LimitReader(zr, int64(limit)+1))
+	if err != nil {
+		return "", err
+	}
+	if n > int64(limit) {
+		return "", ErrFrameTooLarge
+	}
+	return sb.String(), nil
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string {
+	return "none"
+}
+
+func (noneCodec) AppendCompressed(dst []byte, body string) ([]byte, error) {
+	return append(dst, body...), nil
+}
+
+func (noneCodec) Decompress(body []byte, limit uint32) (string, error) {
+	if uint64(len(body)) > uint64(limit) {
+		return "", ErrFrameTooLarge
+	}
+	return string(body), nil
+}
+
+// snappyCodec uses the snappy block format, the body is compressed as one block
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string {
+	return "snappy"
+}
+
+func (snappyCodec) AppendCompressed(dst []byte, body string) ([]byte, error) {
+	src := getBuffer()
+	defer putBuffer(src)
+	*src = append((*src)[:0], body...)
+
+	start := len(dst)
+	maxLen := snappy.MaxEncodedLen(len(body))
+	if maxLen < 0 {
+		return dst, fmt.Errorf("snappy: body too large, %d bytes", len(body))
+	}
+	if cap(dst)-start < maxLen {
+		grown := make([]byte, start, start+maxLen)
+		copy(grown, dst)
+		dst = grown
+	}
+	encoded := snappy.Encode(dst[start:start+maxLen], *src)
+	return dst[:start+len(encoded)], nil
+}
+
+func (snappyCodec) Decompress(body []byte, limit uint32) (string, error) {
+	n, err := snappy.DecodedLen(body)
+	if err != nil {
+		return "", err
+	}
+	if uint64(n) > uint64(limit) {
+		return "", ErrFrameTooLarge
+	}
+	dst := getBuffer()
+	defer putBuffer(dst)
+	if cap(*dst) < n {
+		*dst = make([]byte, n)
+	}
+	decoded, err := snappy.Decode((*dst)[:n], body)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+var (
+	zstdEncoderOnce sync.Once
+	zstdEncoder     *zstd.Encoder
+	zstdEncoderErr  error
+	// decoders by decompression limit, the limits come from the configs so they are few
+	zstdDecoders sync.Map
+)
+
+// zstdCodec compresses the body as one zstd frame. The encoder and the decoders are
+// shared, EncodeAll and DecodeAll are safe for concurrent use.
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string {
+	return "zstd"
+}
+
+func (zstdCodec) AppendCompressed(dst []byte, body string) ([]byte, error) {
+	zstdEncoderOnce.Do(func() {
+		zstdEncoder, zstdEncoderErr = zstd.NewWriter(nil)
+	})
+	if zstdEncoderErr != nil {
+		return dst, zstdEncoderErr
+	}
+	src := getBuffer()
+	defer putBuffer(src)
+	*src = append((*src)[:0], body...)
+	return zstdEncoder.EncodeAll(*src, dst), nil
+}
+
+func (zstdCodec) Decompress(body []byte, limit uint32) (string, error) {
+	dec, err := zstdDecoder(limit)
+	if err != nil {
+		return "", err
+	}
+	dst := getBuffer()
+	defer putBuffer(dst)
+	decoded, err := dec.DecodeAll(body, (*dst)[:0])
+	switch err {
+	case zstd.ErrDecoderSizeExceeded, zstd.ErrFrameSizeExceeded, zstd.ErrWindowSizeExceeded:
+		// the window of the frame is bounded by the limit as well
+		return "", ErrFrameTooLarge
+	}
+	if err != nil {
+		return "", err
+	}
+	if uint64(len(decoded)) > uint64(limit) {
+		return "", ErrFrameTooLarge
+	}
+	return string(decoded), nil
+}
+
+func zstdDecoder(limit uint32) (*zstd.Decoder, error) {
+	if dec, ok := zstdDecoders.Load(limit); ok {
+		return dec.(*zstd.Decoder), nil
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	if actual, loaded := zstdDecoders.LoadOrStore(limit, dec); loaded {
+		dec.Close()
+		return actual.(*zstd.Decoder), nil
+	}
+	return dec, nil
+}
@@ -1,217 +1,376 @@
 package gateway
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"context"
+	"encoding/binary"
 	"errors"
-	"fmt"
-	"github.com/sumansoul/aliyun-ahas-go-sdk/logger"
-	"io/ioutil"
 	"net"
-	"os"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const (
-	connectTimeoutSec = 5
-)
-
-var createOnce sync.Once
-var poolInstance *ConnectionPool
-
 type AgwConn struct {
-	connId   uint32
-	conn     *net.Conn
-	pool     *ConnectionPool
-	channels sync.Map
+	connId    uint32
+	conn      *net.Conn
+	pool      *ConnectionPool
+	channels  sync.Map
+	closeOnce sync.Once
+	// number of requests waiting for their responses
+	inFlight int32
+	// frames queued to the writer coroutine
+	writeCh chan *writeRequest
+	// closed when the connection is closed
+	closing chan struct{}
+	// heartbeat round-trips, see ConnStats
+	heartbeat heartbeat
+	createdAt time.Time
+	// index of the endpoint in AgwClient.endpoints
+	endpoint int
+	// negotiated by the capability handshake, nil for the legacy protocol
+	capsLock sync.RWMutex
+	caps     *Capabilities
+	// codec of the requests once caps is negotiated, see AgwClient.requestCodec
+	codec uint8
 }
 
-func (c *AgwConn) writeSync(msg *AgwMessage) (*AgwMessage, error) {
+func newAgwConn(connId uint32, conn net.Conn, pool *ConnectionPool) *AgwConn {
+	return &AgwConn{
+		connId:    connId,
+		conn:      &conn,
+		pool:      pool,
+		writeCh:   make(chan *writeRequest, default_write_queue_size),
+		closing:   make(chan struct{}),
+		createdAt: time.Now(),
+	}
+}
 
-	msgBytes, ok := msg.Encode()
+func (c *AgwConn) inFlightCount() int32 {
+	return atomic.LoadInt32(&c.inFlight)
+}
 
-	if !ok {
-		return nil, errors.New("encode wrong")
+// writeSync writes msg and waits for its response, the returned bool tells whether
+// the frame has been (maybe partially) written to the connection.
+func (c *AgwConn) writeSync(ctx context.Context, msg *AgwMessage) (*AgwMessage, bool, error) {
+	// the response echoes the client address as sent, the sync id has to match it
+	msg = c.wireMessage(msg)
+	// register before writing, the response may arrive before send returns
+	msgId, channel, err := register(c, msg)
+	if err != nil {
+		return nil, false, err
 	}
 
-	if _, e := (*c.conn).Write(msgBytes); e != nil {
-		return nil, e
+	send := c.send
+	if len(msg.body) > default_stream_chunk_size && c.streaming() {
+		send = c.sendStream
+	}
+	if sent, err := send(msg); err != nil {
+		unregister(c, msgId)
+		return nil, sent, err
 	}
 
-	response, err := wait(c, msg)
+	response, err := wait(ctx, c, msgId, channel)
 	if err != nil {
-		return nil, err
+		return nil, true, err
 	}
-	return response, nil
+	return response, true, nil
 }
 
 func (c *AgwConn) write(msg *AgwMessage) error {
-	msgBytes, ok := msg.Encode()
-	if !ok {
-		return errors.New("encode wrong")
-	}
+	_, err := c.send(msg)
+	return err
+}
 
-	if _, e := (*c.conn).Write(msgBytes); e != nil {
-		logWarnf("[AGW] gateway write err: %+v", e.Error())
-		return e
+// send queues msg to the writer coroutine and waits until it has been written.
+func (c *AgwConn) send(msg *AgwMessage) (bool, error) {
+	req := &writeRequest{msg: c.wireMessage(msg), done: make(chan error, 1)}
+	select {
+	case c.writeCh <- req:
+	case <-c.closing:
+		return false, ErrConnClosed
 	}
 
-	return nil
+	select {
+	case err := <-req.done:
+		return req.written, err
+	case <-c.closing:
+		// the writer may have taken the frame before exiting
+		return true, ErrConnClosed
+	}
 }
 
 func (c *AgwConn) close() {
 	if c == nil {
 		return
 	}
-	logInfof("[AGW] Close connection, connId : %d", c.connId)
-
-	c.pool.remove(c.connId)
-	(*c.conn).Close()
-
-	connClosedMsg := NewAgwMessage()
-	connClosedMsg.SetInnerMsg(ErrorMsgConnClosed)
-
-	c.channels.Range(func(k, v interface{}) bool {
-		if channel, ok := v.(chan *AgwMessage); ok {
-			channel <- connClosedMsg
-		}
-		return true
+	c.closeOnce.Do(func() {
+		logInfof("[AGW] Close connection, connId : %d", c.connId)
+
+		c.pool.remove(c.connId, c)
+		close(c.closing)
+		(*c.conn).Close()
+
+		connClosedMsg := NewAgwMessage()
+		connClosedMsg.SetInnerMsg(ErrorMsgConnClosed)
+
+		c.channels.Range(func(k, v interface{}) bool {
+			if channel, ok := v.(chan *AgwMessage); ok {
+				select {
+				case channel <- connClosedMsg:
+				default:
+				}
+			}
+			return true
+		})
 	})
 }
 
 type ConnectionPool struct {
-	ring *ring
-	pool sync.Map
-	lock sync.Mutex
-	size uint32
+	client *AgwClient
+	ring   *ring
+	pool   sync.Map
+	slots  []*connSlot
+	lock   sync.Mutex
+	size   uint32
+	closed bool
 }
 
-func getConnectionPoolInstance(size uint32) *ConnectionPool {
+func newConnectionPool(client *AgwClient, size uint32) *ConnectionPool {
 
 	if size <= 0 {
 		return nil
 	}
 
-	if poolInstance != nil {
-		return poolInstance
+	pool := &ConnectionPool{
+		client: client,
+		ring:   newRing(),
+		size:   size,
 	}
-	createOnce.Do(func() {
-		if poolInstance == nil {
-			poolInstance = new(ConnectionPool)
-			poolInstance.ring = newRing()
-			poolInstance.size = size
-			for i := uint32(0); i < size; i++ {
-				poolInstance.ring.add(i)
-			}
-		}
-	})
-	return poolInstance
+	for i := uint32(0); i < size; i++ {
+		pool.ring.add(i)
+		pool.slots = append(pool.slots, &connSlot{connId: i})
+	}
+	return pool
 }
 
+// get selects a connection for a request: the ready connection with the least
+// in-flight requests wins, ties are broken round-robin. Slots which are backing off
+// are skipped, and an idle slot is dialed when every ready connection is busy.
 func (p *ConnectionPool) get() (*AgwConn, error) {
-	var connId uint32
+	var start uint32
 	if value, ok := p.ring.next().(uint32); ok {
-		connId = value
+		start = value
 	} else {
 		return nil, errors.New("connId should be uint32")
 	}
 
+	var best *AgwConn
+	var idle *connSlot
+	var unavailable *UnavailableError
+	for i := uint32(0); i < p.size; i++ {
+		connId := (start + i) % p.size
+		if conn := p.load(connId); conn != nil {
+			if best == nil || conn.inFlightCount() < best.inFlightCount() {
+				best = conn
+			}
+			continue
+		}
+		s := p.slots[connId]
+		switch s.loadState() {
+		case connStateIdle:
+			if idle == nil {
+				idle = s
+			}
+		case connStateFailed:
+			s.lock.Lock()
+			if s.state == connStateFailed {
+				retryAfter := time.Until(s.retryAt)
+				if unavailable == nil || retryAfter < unavailable.RetryAfter {
+					unavailable = &UnavailableError{ConnId: connId, RetryAfter: retryAfter, Cause: s.lastErr}
+				}
+			}
+			s.lock.Unlock()
+		}
+	}
+
+	if best != nil && (best.inFlightCount() == 0 || idle == nil) {
+		return best, nil
+	}
+	if idle != nil {
+		conn, err := p.getById(idle.connId)
+		if err == nil || best == nil {
+			return conn, err
+		}
+		return best, nil
+	}
+	if best != nil {
+		return best, nil
+	}
+	if unavailable != nil {
+		return nil, unavailable
+	}
+	// every slot is connecting by now, wait for the one we started from
+	return p.getById(start)
+}
+
+func (p *ConnectionPool) load(connId uint32) *AgwConn {
 	if conn, ok := p.pool.Load(connId); ok {
 		if value, ok := conn.(*AgwConn); ok {
-			return value, nil
-		} else {
-			return nil, errors.New("connection type should be *AgwConn")
+			return value
 		}
 	}
+	return nil
+}
 
-	p.lock.Lock()
-	defer p.lock.Unlock()
-
+func (p *ConnectionPool) getById(connId uint32) (*AgwConn, error) {
 	if conn, ok := p.pool.Load(connId); ok {
 		if value, ok := conn.(*AgwConn); ok {
 			return value, nil
 		} else {
-			return nil, errors.New("unknown connection type")
+			return nil, errors.New("connection type should be *AgwConn")
 		}
 	}
 
-	gatewayIp := GetAgwClientInstance().config.GatewayIp
-	gatewayPort := GetAgwClientInstance().config.GatewayPort
+	s := p.slots[connId]
+	for {
+		s.lock.Lock()
+		if conn := p.load(connId); conn != nil {
+			s.lock.Unlock()
+			return conn, nil
+		}
+		switch s.state {
+		case connStateFailed:
+			// the reconnect timer of this slot owns the next dial
+			err := &UnavailableError{ConnId: connId, RetryAfter: time.Until(s.retryAt), Cause: s.lastErr}
+			s.lock.Unlock()
+			return nil, err
+		case connStateConnecting:
+			// wait for the dial of another caller, then look again
+			done := s.dialDone
+			s.lock.Unlock()
+			<-done
+		default:
+			s.beginDial()
+			s.lock.Unlock()
+			return p.dial(s)
+		}
+	}
+}
+
+// dial connects the slot claimed with beginDial. s.lock is only taken once the
+// network dial is over, so that the slot can be inspected meanwhile.
+func (p *ConnectionPool) dial(s *connSlot) (*AgwConn, error) {
+	p.lock.Lock()
+	closed := p.closed
+	p.lock.Unlock()
+
 	var conn net.Conn
-	var err error
-	// tls conn or not
-	if GetAgwClientInstance().config.TlsFlag {
-		conn, err = getTlsConn(gatewayIp, gatewayPort)
-		// retry once
-		if err != nil {
-			logger.Warnf("[AGW] Get TLS connection err, %v, retry again", err)
-			err := checkOrDownloadCert()
-			if err != nil {
-				return nil, err
-			}
-			conn, err = getTlsConn(gatewayIp, gatewayPort)
+	endpoint := -1
+	err := ErrClientClosed
+	if !closed {
+		conn, endpoint, err = dialGateway(p.client.config, p.client.dial, p.client.certs, p.client.endpoints)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	defer close(s.dialDone)
+	connId := s.connId
+	// the pool may have been closed during the dial, it is checked again and the
+	// connection stored under p.lock so that close either sees it or is seen
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if closed || p.closed {
+		if conn != nil {
+			conn.Close()
 		}
-	} else {
-		conn, err = net.DialTimeout("tcp", fmt.Sprintf("%s:%d", gatewayIp, gatewayPort), connectTimeoutSec*time.Second)
+		s.setState(connStateIdle)
+		return nil, ErrClientClosed
 	}
 	if err != nil {
+		s.failures++
+		s.lastErr = err
+		s.setState(connStateFailed)
+		backoff := reconnectBackoff(p.client.config, s.failures)
+		s.retryAt = time.Now().Add(backoff)
+		logWarnf("[AGW] Connect failed, connectionId: %d, failures: %d, retry after %v, err: %v",
+			connId, s.failures, backoff, err)
+		time.AfterFunc(backoff, func() {
+			p.reconnect(s)
+		})
 		return nil, err
 	}
-	logInfof("AGW connect [%s:%d] success, connectionId: %d", gatewayIp, gatewayPort, connId)
+	logInfof("AGW connect [%s] success, connectionId: %d", conn.RemoteAddr(), connId)
 
-	agwConn := &AgwConn{
-		connId: connId,
-		conn:   &conn,
-		pool:   p,
-	}
+	agwConn := newAgwConn(connId, conn, p)
+	agwConn.endpoint = endpoint
 
+	s.setState(connStateReady)
+	s.failures = 0
+	s.lastErr = nil
 	p.pool.Store(connId, agwConn)
 
 	go runReaderCoroutine(agwConn)
+	go runWriterCoroutine(agwConn)
+	if !p.client.config.DisableHandshake {
+		go p.client.handshake(agwConn)
+	}
+
+	if s.connected {
+		atomic.AddUint64(&p.client.metrics.reconnects, 1)
+		p.client.notifyReconnected(connId)
+	}
+	s.connected = true
 
 	return agwConn, nil
 }
 
-func getTlsConn(gatewayIp string, gatewayPort uint32) (net.Conn, error) {
-	certFile, err := os.OpenFile(CertPath, os.O_RDONLY, 0664)
-	if err != nil {
-		return nil, fmt.Errorf("open cert file failed, %v", err)
+// reconnect is fired by the backoff timer of a failed slot.
+func (p *ConnectionPool) reconnect(s *connSlot) {
+	s.lock.Lock()
+	if s.state != connStateFailed {
+		s.lock.Unlock()
+		return
 	}
-	certBytes, err := ioutil.ReadAll(certFile)
-	if err != nil {
-		return nil, fmt.Errorf("read cert file failed, %v", err)
+	s.beginDial()
+	s.lock.Unlock()
+	if _, err := p.dial(s); err != nil {
+		return
 	}
-	certPool := x509.NewCertPool()
-	ok := certPool.AppendCertsFromPEM(certBytes)
-	if !ok {
-		return nil, fmt.Errorf("parse cert file failed")
+	logInfof("[AGW] Reconnected, connectionId: %d", s.connId)
+}
+
+func (p *ConnectionPool) remove(connId uint32, conn *AgwConn) {
+	if value, ok := p.pool.Load(connId); ok && value == conn {
+		p.pool.Delete(connId)
 	}
-	conf := &tls.Config{
-		InsecureSkipVerify: true,
-		RootCAs:            certPool,
+	s := p.slots[connId]
+	s.lock.Lock()
+	if s.state == connStateReady {
+		s.setState(connStateIdle)
 	}
-	dialer := &net.Dialer{Timeout: connectTimeoutSec * time.Second}
-	return tls.DialWithDialer(dialer, "tcp", fmt.Sprintf("%s:%d", gatewayIp, gatewayPort), conf)
+	s.lock.Unlock()
 }
 
-func (p *ConnectionPool) remove(connId uint32) {
-	p.pool.Delete(connId)
+// close closes all pooled connections and refuses to dial new ones.
+func (p *ConnectionPool) close() {
+	p.lock.Lock()
+	p.closed = true
+	p.lock.Unlock()
+
+	p.pool.Range(func(k, v interface{}) bool {
+		if conn, ok := v.(*AgwConn); ok {
+			conn.close()
+		}
+		return true
+	})
 }
 
+// StringIpToUint64 converts an IPv4 address to the clientIp of the frames, other
+// addresses give zero, see AgwMessage.SetClientAddr.
 func StringIpToUint64(ip string) uint64 {
-	ipSegs := strings.Split(ip, ".")
-	var ipUint64 uint64 = 0
-	var pos uint = 24
-	var tmp uint64 = 0
-	for _, ipSeg := range ipSegs {
-		tempInt, _ := strconv.Atoi(ipSeg)
-		tmp = uint64(tempInt)
-		tmp = tmp << pos
-		ipUint64 = ipUint64 | tmp
-		pos -= 8
-	}
-	return ipUint64
+	ip4 := net.ParseIP(ip).To4()
+	if ip4 == nil {
+		return 0
+	}
+	return uint64(binary.BigEndian.Uint32(ip4))
 }
@@ -6,4 +6,15 @@ const (
 	ErrorMsgConnClosed      = "connection closed"
 	ErrorMsgRequestTimeout  = "request timeout"
 	ErrorMsgDupId           = "dup msg id"
+	ErrorMsgClientClosed    = "client closed"
+	ErrorMsgFrameTooLarge   = "frame too large"
+	ErrorMsgMalformedFrame  = "malformed frame"
+)
+
+// inner codes of the responses to the requests of the gateway
+const (
+	InnerCodeNoHandler      = 8034
+	InnerCodeHandlerError   = 8035
+	InnerCodeBusy           = 8036
+	InnerCodeHandlerTimeout = 8037
 )
@@ -0,0 +1,139 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+var errHandlerTimeout = errors.New("handler timeout")
+
+// inboundRequest is a request of the gateway waiting for a worker
+type inboundRequest struct {
+	msg      *AgwMessage
+	conn     *AgwConn
+	received time.Time
+}
+
+// dispatcher runs the requests initiated by the gateway on a bounded pool of workers,
+// so that a slow handler never blocks the reader of a connection.
+type dispatcher struct {
+	client *AgwClient
+	queue  chan *inboundRequest
+
+	limitLock sync.Mutex
+	// per handler semaphores, only for the handlers with a concurrency limit
+	limits map[string]chan struct{}
+}
+
+func newDispatcher(client *AgwClient) *dispatcher {
+	workers := client.config.Workers
+	if workers <= 0 {
+		workers = default_workers
+	}
+	queueSize := client.config.WorkerQueueSize
+	if queueSize <= 0 {
+		queueSize = default_worker_queue_size
+	}
+	d := &dispatcher{
+		client: client,
+		queue:  make(chan *inboundRequest, queueSize),
+		limits: make(map[string]chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go d.runWorker()
+	}
+	return d
+}
+
+// dispatch queues the request, a full queue is answered with a busy response at once.
+func (d *dispatcher) dispatch(msg *AgwMessage, conn *AgwConn) {
+	select {
+	case d.queue <- &inboundRequest{msg: msg, conn: conn, received: time.Now()}:
+	default:
+		logWarnf("AGW worker queue is full, reject handlerName:%s, reqId:%d, outerReqId:%s",
+			msg.HandlerName(), msg.ReqId(), msg.OuterReqId())
+		replyError(msg, conn, InnerCodeBusy, "client busy, worker queue is full")
+	}
+}
+
+func (d *dispatcher) runWorker() {
+	for {
+		select {
+		case req := <-d.queue:
+			handleRequest(req, d)
+		case <-d.client.closed:
+			return
+		}
+	}
+}
+
+// acquire takes a slot of the concurrency limit of the handler, it returns false when
+// the limit is reached. release has to be called once the handler returns.
+func (d *dispatcher) acquire(handlerName string) (release func(), ok bool) {
+	limit := d.client.config.HandlerConcurrency[handlerName]
+	if limit <= 0 {
+		return func() {}, true
+	}
+	d.limitLock.Lock()
+	semaphore, ok := d.limits[handlerName]
+	if !ok {
+		semaphore = make(chan struct{}, limit)
+		d.limits[handlerName] = semaphore
+	}
+	d.limitLock.Unlock()
+
+	select {
+	case semaphore <- struct{}{}:
+		return func() { <-semaphore }, true
+	default:
+		return nil, false
+	}
+}
+
+type handlerResult struct {
+	response string
+	err      error
+}
+
+// runHandler runs the handler in its own goroutine and waits for it at most until the
+// deadline, zero meaning no deadline. A handler which panics fails with an error. The
+// concurrency slot is released when the handler returns, even after the deadline.
+func runHandler(handler AgwHandler, request string, deadline time.Time, release func()) (string, error) {
+	done := make(chan handlerResult, 1)
+	go func() {
+		defer release()
+		defer func() {
+			if r := recover(); r != nil {
+				logWarnf("AGW client handler panic: %v, stack: %s", r, debug.Stack())
+				done <- handlerResult{err: fmt.Errorf("handler panic: %v", r)}
+			}
+		}()
+		response, err := handler.Handle(request)
+		done <- handlerResult{response: response, err: err}
+	}()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case result := <-done:
+		return result.response, result.err
+	case <-timeout:
+		return "", errHandlerTimeout
+	}
+}
+
+func replyError(msg *AgwMessage, conn *AgwConn, code uint32, innerMsg string) {
+	msg.SetInnerCode(code)
+	msg.SetInnerMsg(innerMsg)
+	msg.SetMessageDirection(MessageDirectionResponse)
+	msg.SetBody("")
+
+	go conn.write(msg)
+}
@@ -0,0 +1,174 @@
+package gateway
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Endpoint is one address of the gateway.
+type Endpoint struct {
+	Host string
+	Port uint32
+	// Tls dials the endpoint with TLS, see AgwConfig.Tls
+	Tls bool
+}
+
+func (e Endpoint) address() string {
+	return net.JoinHostPort(e.Host, strconv.Itoa(int(e.Port)))
+}
+
+func (e Endpoint) String() string {
+	if e.Tls {
+		return "tls://" + e.address()
+	}
+	return e.address()
+}
+
+// endpointSet tracks which endpoint the pool dials. Dials start from the active
+// endpoint and fail over to the others in preference order, the first endpoint which
+// accepts the connection becomes the active one.
+type endpointSet struct {
+	endpoints []Endpoint
+	lock      sync.Mutex
+	active    int
+}
+
+func newEndpointSet(endpoints []Endpoint) *endpointSet {
+	return &endpointSet{endpoints: endpoints}
+}
+
+// order returns the indexes of the endpoints to dial, the active one first
+func (s *endpointSet) order() []int {
+	s.lock.Lock()
+	active := s.active
+	s.lock.Unlock()
+	order := make([]int, 0, len(s.endpoints))
+	order = append(order, active)
+	for i := range s.endpoints {
+		if i != active {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+func (s *endpointSet) activeIndex() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.active
+}
+
+func (s *endpointSet) onConnected(i int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.active != i {
+		logInfof("[AGW] Switch gateway endpoint from %s to %s", s.endpoints[s.active], s.endpoints[i])
+		s.active = i
+	}
+}
+
+// dialGateway dials the endpoints in the order of the set until one accepts the
+// connection, it returns the index of that endpoint.
+func dialGateway(config AgwConfig, dial DialFunc, certs *certManager, endpoints *endpointSet) (net.Conn, int, error) {
+	var lastErr error
+	for _, i := range endpoints.order() {
+		endpoint := endpoints.endpoints[i]
+		conn, err := dialEndpoint(config, dial, certs, endpoint)
+		if err == nil {
+			if !endpoint.Tls && anyTls(endpoints.endpoints) {
+				logErrorf("[AGW] Connected to the plain gateway endpoint %s, the traffic is not encrypted", endpoint)
+			}
+			endpoints.onConnected(i)
+			return conn, i, nil
+		}
+		if len(endpoints.endpoints) > 1 {
+			logWarnf("[AGW] Dial gateway endpoint %s failed, err: %v", endpoint, err)
+		}
+		lastErr = err
+	}
+	if len(endpoints.endpoints) > 1 {
+		return nil, -1, fmt.Errorf("all %d gateway endpoints failed, last error: %w", len(endpoints.endpoints), lastErr)
+	}
+	return nil, -1, lastErr
+}
+
+func dialEndpoint(config AgwConfig, dial DialFunc, certs *certManager, endpoint Endpoint) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.ConnectTimeout)
+	defer cancel()
+	// tls conn or not
+	if !endpoint.Tls {
+		return dial(ctx, "tcp", endpoint.address())
+	}
+	conn, err := getTlsConn(ctx, config, endpoint, dial, certs)
+	// retry once with a refreshed certificate when the gateway certificate was rejected
+	if err != nil && isCertError(err) {
+		logWarnf("[AGW] Get TLS connection err, %v, retry again", err)
+		refreshed, e := certs.refresh(err)
+		if e != nil {
+			return nil, e
+		}
+		if refreshed {
+			retryCtx, retryCancel := context.WithTimeout(context.Background(), config.ConnectTimeout)
+			defer retryCancel()
+			conn, err = getTlsConn(retryCtx, config, endpoint, dial, certs)
+		}
+	}
+	return conn, err
+}
+
+// isCertError tells whether the TLS handshake failed on the certificate of the gateway,
+// the errors of the network do not call for a new certificate.
+func isCertError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &invalid) || errors.As(err, &hostname)
+}
+
+// runFailbackCoroutine probes the preferred endpoint while the pool uses another one.
+// Once it accepts a connection again, the idle connections to other endpoints are
+// closed and redialed, the busy ones are recycled by the later rounds.
+func runFailbackCoroutine(c *AgwClient) {
+	endpoints := c.endpoints
+	for c.sleep(c.config.FailbackInterval) {
+		if endpoints.activeIndex() != 0 {
+			conn, err := dialEndpoint(c.config, c.dial, c.certs, endpoints.endpoints[0])
+			if err != nil {
+				logDebugf("[AGW] Preferred gateway endpoint %s still unavailable: %v", endpoints.endpoints[0], err)
+				continue
+			}
+			conn.Close()
+			endpoints.onConnected(0)
+		}
+
+		active := endpoints.activeIndex()
+		for i := uint32(0); i < c.pool.size; i++ {
+			conn := c.pool.load(i)
+			if conn == nil || conn.endpoint == active || conn.inFlightCount() > 0 {
+				continue
+			}
+			logInfof("[AGW] Move connection %d to gateway endpoint %s", i, endpoints.endpoints[active])
+			conn.close()
+			c.pool.getById(i)
+		}
+	}
+}
+
+// Endpoint returns the gateway endpoint the pool currently dials
+func (c *AgwClient) Endpoint() Endpoint {
+	return c.endpoints.endpoints[c.endpoints.activeIndex()]
+}
+
+func anyTls(endpoints []Endpoint) bool {
+	for _, e := range endpoints {
+		if e.Tls {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Errors returned by AgwClient, they can be matched with errors.Is.
+var (
+	// ErrTimeout means no response arrived within the timeout of an attempt
+	ErrTimeout = errors.New(ErrorMsgRequestTimeout)
+	// ErrConnClosed means the connection was broken before the response arrived
+	ErrConnClosed = errors.New(ErrorMsgConnClosed)
+	// ErrDuplicateId means another in-flight request on the connection has the same sync id
+	ErrDuplicateId = errors.New(ErrorMsgDupId)
+	// ErrClientClosed means the client has been closed
+	ErrClientClosed = errors.New(ErrorMsgClientClosed)
+	// ErrUnavailable matches every *UnavailableError
+	ErrUnavailable = errors.New("connection unavailable")
+	// ErrFrameTooLarge means a length field of a received frame exceeds FrameLimits
+	ErrFrameTooLarge = errors.New(ErrorMsgFrameTooLarge)
+	// ErrHandlerExists means a handler of the same name and version is already registered
+	ErrHandlerExists = errors.New("handler already exists")
+	// ErrMalformedFrame means a received frame can not be decoded
+	ErrMalformedFrame = errors.New(ErrorMsgMalformedFrame)
+	// ErrTooManyStreams means a frame opens a stream beyond the open streams allowed per connection
+	ErrTooManyStreams = errors.New("too many open streams")
+)
+
+// RemoteError is a business failure reported by the gateway or the remote handler
+// through the innerCode/innerMsg of the response.
+type RemoteError struct {
+	Code uint32
+	Msg  string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("call error [%d:%s]", e.Code, e.Msg)
+}
+
+// UnavailableError is returned when the chosen connection slot is backing off
+// after failed dials, so callers fail fast instead of dialing on their own.
+type UnavailableError struct {
+	ConnId     uint32
+	RetryAfter time.Duration
+	Cause      error
+}
+
+func (e *UnavailableError) Error() string {
+	if e.Cause == nil {
+		return fmt.Sprintf("connection %d unavailable, retry after %v", e.ConnId, e.RetryAfter)
+	}
+	return fmt.Sprintf("connection %d unavailable, retry after %v: %v", e.ConnId, e.RetryAfter, e.Cause)
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Cause
+}
+
+func (e *UnavailableError) Is(target error) bool {
+	return target == ErrUnavailable
+}
+
+// DecodeError is returned by AgwMessage.Decode when a frame violates FrameLimits or
+// is malformed. The reader closes the connection it came from, other connections
+// of the pool are not affected.
+type DecodeError struct {
+	// Field is the frame field which failed, e.g. "body" or "handlerName"
+	Field string
+	// Size and Limit are set when the field is too large
+	Size  uint64
+	Limit uint64
+	Err   error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Limit > 0 {
+		return fmt.Sprintf("decode frame field %s: %v, size %d exceeds limit %d", e.Field, e.Err, e.Size, e.Limit)
+	}
+	return fmt.Sprintf("decode frame field %s: %v", e.Field, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
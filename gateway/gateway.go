@@ -1,15 +1,11 @@
 package gateway
 
 import (
+	"context"
 	"errors"
-	"fmt"
-	"github.com/sumansoul/aliyun-ahas-go-sdk/aliyun"
-	"github.com/sumansoul/aliyun-ahas-go-sdk/meta"
-	"github.com/sumansoul/aliyun-ahas-go-sdk/tools"
-	"os"
-	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,6 +17,8 @@ type RpcMetadata struct {
 	ServerName  string
 	HandlerName string
 	Version     uint32
+	// NonIdempotent calls are never retried once the request frame has been written
+	NonIdempotent bool
 }
 
 type AgwConfig struct {
@@ -33,22 +31,101 @@ type AgwConfig struct {
 	// add for tls
 	ClientEnv      string
 	ClientRegionId string
+	ClientInVpc    bool
 	TlsFlag        bool
-	Timeout        time.Duration
+	// Tls configures the verification of the gateway when TlsFlag is set
+	Tls     TlsConfig
+	Timeout time.Duration
+	// backoff of redialing a broken connection, doubled after each failure
+	ReconnectBaseDelay time.Duration
+	ReconnectMaxDelay  time.Duration
+	// RetryPolicy of the calls, nil retries timeout and connection closed errors once
+	RetryPolicy *RetryPolicy
+	// PoolSize is the number of connections to the gateway, 0 means default_pool_size
+	PoolSize uint32
+	// FrameLimits bounds the frames received from the gateway, a violating frame closes its connection
+	FrameLimits FrameLimits
+	// Codecs lists the codec names the client accepts in preference order, nil means
+	// snappy then gzip. The first one also supported by the gateway compresses the
+	// requests: the capability handshake of each connection decides, the codecs passed
+	// to SetPeerCodecs only apply to the connections of older gateways.
+	Codecs []string
+	// CompressThreshold is the body size below which frames are sent uncompressed,
+	// 0 means default_compress_threshold and a negative value compresses every body
+	CompressThreshold int
+	// HeartbeatInterval is the period of the heartbeats on every connection, 20s by default
+	HeartbeatInterval time.Duration
+	// MaxMissedHeartbeats is the number of heartbeats in a row left unanswered after
+	// which a connection is closed and redialed, 3 by default
+	MaxMissedHeartbeats int
+	// Workers is the number of goroutines running the requests of the gateway, 8 by default
+	Workers int
+	// WorkerQueueSize bounds the requests waiting for a worker, 256 by default.
+	// Requests beyond it are answered with InnerCodeBusy.
+	WorkerQueueSize int
+	// HandlerConcurrency limits the requests of a handler running at the same time,
+	// keyed by handler name. Handlers without a limit share the workers only.
+	HandlerConcurrency map[string]int
+	// DialContext opens the TCP connections to the gateway, nil uses a net.Dialer.
+	// The TLS handshake and the proxy, if any, are done on top of it.
+	DialContext DialFunc
+	// Proxy is the url of the proxy the gateway is reached through,
+	// http://[user:password@]host:port for HTTP CONNECT or socks5://[user:password@]host:port
+	Proxy string
+	// ConnectTimeout bounds dialing a connection, proxy and TLS handshakes included, 5s by default
+	ConnectTimeout time.Duration
+	// Endpoints lists the gateway endpoints in preference order, nil means GatewayIp
+	// and GatewayPort with TlsFlag. A dial which fails fails over to the next endpoint.
+	Endpoints []Endpoint
+	// FailbackInterval is the period of the probes of the first endpoint while the
+	// pool uses another one, 5 minutes by default
+	FailbackInterval time.Duration
+	// Capture records every frame to a file when set, for debugging
+	Capture *CaptureConfig
+	// DisableHandshake skips the capability handshake of the new connections, for
+	// gateways which do not tolerate it, see Capabilities
+	DisableHandshake bool
+	// Tracer traces the calls, their attempts and the requests of the gateway, nil traces nothing
+	Tracer Tracer
+	// KeepAlive is the TCP keepalive period of the default dialer, 0 means the
+	// default of net.Dialer and a negative value disables keepalive
+	KeepAlive time.Duration
 }
 
 type AgwClient struct {
 	config      AgwConfig
 	initialized bool
+	initOnce    sync.Once
 	pool        *ConnectionPool
+	dispatcher  *dispatcher
+	certs       *certManager
+	dial        DialFunc
+	endpoints   *endpointSet
+	recorder    *recorder
+	metrics     *metrics
+	tracer      Tracer
 	timeout     uint32
+	budget      *retryBudget
+
+	handlers handlerRegistry
+
+	stateLock sync.RWMutex
+	closing   bool
+	closed    chan struct{}
+	inFlight  sync.WaitGroup
+
+	listenerLock       sync.RWMutex
+	reconnectListeners []func(connId uint32)
+
+	// codec of the requests on the connections without capabilities, chosen by SetPeerCodecs
+	codecLock sync.RWMutex
+	codec     uint8
 }
 
 var instance *AgwClient
 var cLock sync.Mutex
-var initOnce sync.Once
-var handlers = make(map[string]AgwHandler)
 
+// GetAgwClientInstance returns the default client shared in the process, it has to be initialized by Init.
 func GetAgwClientInstance() *AgwClient {
 
 	if instance != nil {
@@ -62,14 +139,31 @@ func GetAgwClientInstance() *AgwClient {
 		return instance
 	}
 
-	instance = &AgwClient{
-		initialized: false,
-		pool:        getConnectionPoolInstance(2),
-	}
+	instance = newAgwClient()
 
 	return instance
 }
 
+// NewAgwClient creates and initializes a client which owns its connections and handlers,
+// independent of the default client.
+func NewAgwClient(config AgwConfig) (*AgwClient, error) {
+	c := newAgwClient()
+	if err := c.Init(config); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newAgwClient() *AgwClient {
+	return &AgwClient{
+		initialized: false,
+		handlers:    newHandlerRegistry(),
+		metrics:     newMetrics(),
+		tracer:      noopTracer{},
+		closed:      make(chan struct{}),
+	}
+}
+
 func (c *AgwClient) Init(config AgwConfig) error {
 	if c.initialized {
 		return errors.New("dup init")
@@ -86,24 +180,73 @@ func (c *AgwClient) Init(config AgwConfig) error {
 	if config.ClientVpcId == "" {
 		return errors.New("vpcId can not be blank")
 	}
-	// check or download the cert if not exists
-	if config.TlsFlag {
-		err := checkOrDownloadCert()
-		if err != nil {
+	// check or download the cert if not exists, and fail fast on unreadable CA,
+	// client cert or key files
+	if len(config.Endpoints) == 0 {
+		config.Endpoints = []Endpoint{{Host: config.GatewayIp, Port: config.GatewayPort, Tls: config.TlsFlag}}
+	}
+	var certs *certManager
+	if anyTls(config.Endpoints) {
+		certs = newCertManager(config)
+		if _, err := certs.current(); err != nil {
 			return err
 		}
 	}
-	initOnce.Do(func() {
+	dial, err := newDialFunc(config)
+	if err != nil {
+		return err
+	}
+	c.initOnce.Do(func() {
 		c.config = config
+		c.certs = certs
+		c.dial = dial
 		c.timeout = uint32(c.config.Timeout.Milliseconds())
+		if c.config.PoolSize == 0 {
+			c.config.PoolSize = default_pool_size
+		}
+		c.config.FrameLimits = c.config.FrameLimits.withDefaults()
+		if len(c.config.Codecs) == 0 {
+			c.config.Codecs = []string{"snappy", "gzip"}
+		}
+		if c.config.ConnectTimeout <= 0 {
+			c.config.ConnectTimeout = default_connect_timeout_ms * time.Millisecond
+		}
+		if c.config.CompressThreshold == 0 {
+			c.config.CompressThreshold = default_compress_threshold
+		}
+		if c.config.FailbackInterval <= 0 {
+			c.config.FailbackInterval = default_failback_interval_sec * time.Second
+		}
+		c.endpoints = newEndpointSet(c.config.Endpoints)
+		if c.config.Tracer != nil {
+			c.tracer = c.config.Tracer
+		}
+		if c.config.Capture != nil && c.config.Capture.File != "" {
+			c.recorder = newRecorder(c.config.Capture)
+		}
+		c.dispatcher = newDispatcher(c)
+		c.pool = newConnectionPool(c, c.config.PoolSize)
+		if c.config.RetryPolicy != nil {
+			c.budget = newRetryBudget(c.config.RetryPolicy.Budget)
+		}
 		c.initialized = true
 		go runHeartBeatCoroutine(c)
+		if len(c.config.Endpoints) > 1 {
+			go runFailbackCoroutine(c)
+		}
 	})
 
 	return nil
 }
 
 func (c *AgwClient) Call(outerReqId string, rpcMetadata RpcMetadata, jsonParam string) (string, error) {
+	return c.CallContext(context.Background(), outerReqId, rpcMetadata, jsonParam)
+}
+
+// CallContext calls the remote handler like Call, but gives up as soon as ctx is done.
+// Each attempt waits at most AgwConfig.Timeout, and the remaining time of the attempt
+// is sent to the gateway as timeoutMs of the message.
+func (c *AgwClient) CallContext(ctx context.Context, outerReqId string, rpcMetadata RpcMetadata, jsonParam string) (string, error) {
 	if !c.initialized {
 		return "", errors.New("the client has not be initialized")
 	}
@@ -112,42 +255,74 @@ func (c *AgwClient) Call(outerReqId string, rpcMetadata RpcMetadata, jsonParam s
 		return "", errors.New("reqId can not be blank")
 	}
 
+	if !c.acquire() {
+		return "", ErrClientClosed
+	}
+	defer c.inFlight.Done()
+
 	tsUtil := newTimestampUtilV2(outerReqId, c.config.ClientVpcId, c.config.ClientProcessFlag, c.config.ClientIp)
 	tsUtil.mark("client_call_gateway")
+	start := time.Now()
+	atomic.AddInt64(&c.metrics.inFlightCalls, 1)
+	defer atomic.AddInt64(&c.metrics.inFlightCalls, -1)
+
+	ctx, span := c.tracer.StartSpan(ctx, SpanCall,
+		Attribute{Key: AttrServerName, Value: rpcMetadata.ServerName},
+		Attribute{Key: AttrHandlerName, Value: rpcMetadata.HandlerName},
+		Attribute{Key: AttrOuterReqId, Value: outerReqId})
 
 	var response *AgwMessage
 	var responseError error
 	var reqId uint64
-	for retryTime := default_req_retry_time; retryTime > 0; retryTime-- {
+	retries := 0
+	policy := c.config.RetryPolicy.policyFor(rpcMetadata)
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			responseError = err
+			break
+		}
+		if attempt > 1 {
+			retries++
+			atomic.AddUint64(&c.metrics.retries, 1)
+		}
 		reqId = generateId()
-		response, responseError = c.innerCall(reqId, outerReqId, rpcMetadata, jsonParam)
+		var sent bool
+		response, sent, responseError = c.tracedCall(ctx, attempt, reqId, outerReqId, rpcMetadata, jsonParam)
+		if errors.Is(responseError, ErrTimeout) {
+			atomic.AddUint64(&c.metrics.timeouts, 1)
+		}
 		if responseError == nil {
+			c.budget.onSuccess()
 			break
 		}
-		errMsg := responseError.Error()
-		if strings.Compare(errMsg, ErrorMsgRequestTimeout) == 0 {
-			logWarnf("gateway retry for timeout, reqId:%d, outerReqId:%s", reqId, outerReqId)
-			continue
+		if ctx.Err() != nil {
+			responseError = ctx.Err()
+			break
 		}
-		if strings.Compare(errMsg, ErrorMsgConnClosed) == 0 {
-			logWarnf("gateway retry for connection close, reqId:%d, outerReqId:%s", reqId, outerReqId)
-			continue
+		if attempt >= policy.MaxAttempts || !policy.retryable(responseError) {
+			break
 		}
-		if strings.Contains(errMsg, ErrorMsgWriteClosedConn) {
-			logWarnf("gateway retry for broken pipe, reqId:%d, outerReqId:%s", reqId, outerReqId)
-			continue
+		if sent && rpcMetadata.NonIdempotent {
+			logWarnf("gateway does not retry non-idempotent call, reqId:%d, outerReqId:%s", reqId, outerReqId)
+			break
 		}
-		if strings.Contains(errMsg, ErrorMsgUseClosedConn) {
-			logWarnf("gateway retry for using closed connection, reqId:%d, outerReqId:%s", reqId, outerReqId)
-			continue
+		if !c.budget.onFailure() {
+			logWarnf("gateway retry budget exhausted, reqId:%d, outerReqId:%s", reqId, outerReqId)
+			break
+		}
+		logWarnf("gateway retry for %v, reqId:%d, outerReqId:%s", responseError, reqId, outerReqId)
+		if !sleepContext(ctx, policy.backoff(attempt)) {
+			responseError = ctx.Err()
+			break
 		}
-
-		break
 	}
 
 	tsUtil.SetReqId(reqId)
+	span.SetAttributes(Attribute{Key: AttrReqId, Value: reqId}, Attribute{Key: AttrRetries, Value: retries})
 	if responseError != nil {
 		logWarnf("a net error happens after some times of retry, reqId:%d, outerReqId:%s", reqId, outerReqId)
+		c.metrics.observeCall(rpcMetadata, time.Since(start), responseError)
+		span.End(responseError)
 		tsUtil.mark("rpc_error")
 		logDebug(tsUtil.GetResultV2())
 		return "", responseError
@@ -155,65 +330,220 @@ func (c *AgwClient) Call(outerReqId string, rpcMetadata RpcMetadata, jsonParam s
 
 	if response.InnerCode() != 0 {
 		logWarnf("a biz error happens, reqId:%d, outerReqId:%s", reqId, outerReqId)
+		remoteErr := &RemoteError{Code: response.InnerCode(), Msg: response.InnerMsg()}
+		c.metrics.observeCall(rpcMetadata, time.Since(start), remoteErr)
+		span.SetAttributes(Attribute{Key: AttrInnerCode, Value: response.InnerCode()})
+		span.End(remoteErr)
 		tsUtil.mark("biz_error")
 		logDebug(tsUtil.GetResultV2())
-		return "", errors.New(fmt.Sprintf("call error [%d:%s]", response.InnerCode(), response.InnerMsg()))
+		return "", remoteErr
 	}
 
+	c.metrics.observeCall(rpcMetadata, time.Since(start), nil)
+	span.End(nil)
+
 	tsUtil.mark("after_call")
 	logDebug(tsUtil.GetResultV2())
 	return response.Body(), nil
 }
 
-func (c *AgwClient) innerCall(reqId uint64, outerReqId string, rpcMetadata RpcMetadata, jsonParam string) (*AgwMessage, error) {
+// acquire registers an in-flight call, it returns false once the client is closing.
+func (c *AgwClient) acquire() bool {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	if c.closing {
+		return false
+	}
+	c.inFlight.Add(1)
+	return true
+}
+
+// Close stops the heartbeat coroutine, rejects new calls, waits for in-flight
+// calls to finish (or ctx to be done) and then closes all pooled connections.
+func (c *AgwClient) Close(ctx context.Context) error {
+	c.stateLock.Lock()
+	if c.closing {
+		c.stateLock.Unlock()
+		return nil
+	}
+	c.closing = true
+	c.stateLock.Unlock()
+
+	close(c.closed)
+
+	drained := make(chan struct{})
+	go func() {
+		c.inFlight.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		logWarnf("[AGW] Close client before in-flight calls drained: %v", ctx.Err())
+		err = ctx.Err()
+	}
+
+	if c.pool != nil {
+		c.pool.close()
+	}
+	if c.recorder != nil {
+		c.recorder.close()
+	}
+	logInfo("[AGW] Client closed")
+	return err
+}
+
+// callTimeout returns the timeout of a single attempt
+func (c *AgwClient) callTimeout() time.Duration {
+	if c.config.Timeout > 0 {
+		return c.config.Timeout
+	}
+	return req_timeout_sec * time.Second
+}
+
+// tracedCall sends one attempt in its own span, see innerCall.
+func (c *AgwClient) tracedCall(ctx context.Context, attempt int, reqId uint64, outerReqId string, rpcMetadata RpcMetadata, jsonParam string) (*AgwMessage, bool, error) {
+	ctx, span := c.tracer.StartSpan(ctx, SpanAttempt,
+		Attribute{Key: AttrServerName, Value: rpcMetadata.ServerName},
+		Attribute{Key: AttrHandlerName, Value: rpcMetadata.HandlerName},
+		Attribute{Key: AttrOuterReqId, Value: outerReqId},
+		Attribute{Key: AttrReqId, Value: reqId},
+		Attribute{Key: AttrAttempt, Value: attempt})
+	response, sent, err := c.innerCall(ctx, span, reqId, outerReqId, rpcMetadata, jsonParam)
+	if err == nil && response.InnerCode() != 0 {
+		span.SetAttributes(Attribute{Key: AttrInnerCode, Value: response.InnerCode()})
+		span.End(&RemoteError{Code: response.InnerCode(), Msg: response.InnerMsg()})
+	} else {
+		span.End(err)
+	}
+	return response, sent, err
+}
+
+// innerCall sends one attempt, the returned bool tells whether the request frame has been written.
+func (c *AgwClient) innerCall(ctx context.Context, span Span, reqId uint64, outerReqId string, rpcMetadata RpcMetadata, jsonParam string) (*AgwMessage, bool, error) {
 	conn, err := c.pool.get()
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	span.SetAttributes(Attribute{Key: AttrConnId, Value: conn.connId})
+
+	ctx, cancel := context.WithTimeout(ctx, c.callTimeout())
+	defer cancel()
+	timeoutMs := c.timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); remaining > 0 {
+			timeoutMs = uint32(remaining.Milliseconds())
+		}
 	}
 
 	msg := NewAgwMessage()
 	msg.SetReqId(reqId)
 	msg.SetMessageType(MessageTypeBiz)
 	msg.SetMessageDirection(MessageDirectionRequest)
-	msg.SetClientIp(StringIpToUint64(c.config.ClientIp))
+	msg.SetClientAddr(c.config.ClientIp)
 	msg.SetClientVpcId(c.config.ClientVpcId)
 	msg.SetServerName(rpcMetadata.ServerName)
-	msg.SetTimeoutMs(c.timeout)
+	msg.SetTimeoutMs(timeoutMs)
 	msg.SetClientProcessFlag(c.config.ClientProcessFlag)
 	msg.SetConnectionId(conn.connId)
 	msg.SetHandlerName(rpcMetadata.HandlerName)
 	msg.SetOuterReqId(outerReqId)
 	msg.SetBody(jsonParam)
-	msg.SetVersion(rpcMetadata.Version)
+	msg.SetVersion(c.requestVersion(conn, rpcMetadata.Version))
 
-	return conn.writeSync(msg)
+	return conn.writeSync(ctx, msg)
 }
 
-func (c *AgwClient) AddHandler(handlerName string, handler AgwHandler) error {
-	if handlerName == "" {
-		return errors.New("handlerName can not be blank")
+// SupportedCodecs returns the names of the registered codecs the client accepts, in
+// preference order, to be announced to the gateway.
+func (c *AgwClient) SupportedCodecs() []string {
+	names := make([]string, 0, len(c.config.Codecs))
+	for _, name := range c.config.Codecs {
+		if _, ok := getCodecByName(name); ok {
+			names = append(names, name)
+		}
 	}
+	return names
+}
 
-	if handler == nil {
-		return errors.New("hander can not be null")
+// SetPeerCodecs selects the most preferred codec which the gateway supports for the
+// requests, e.g. from the answer to the connect request, and returns its name. Gzip is
+// used if no codec is shared, as every gateway understands it. The codec only applies
+// to the connections which keep the legacy protocol: a connection which negotiated
+// its capabilities uses the codec of its handshake, see Capabilities.
+func (c *AgwClient) SetPeerCodecs(peerCodecs []string) string {
+	selected, name := preferredCodec(c.SupportedCodecs(), peerCodecs)
+	c.codecLock.Lock()
+	c.codec = selected
+	c.codecLock.Unlock()
+	logInfof("[AGW] Codec negotiated: %s, peer codecs: %v", name, peerCodecs)
+	return name
+}
+
+// requestVersion sets the codec of the connection on a compressed version, a version
+// which names a codec already is kept.
+func (c *AgwClient) requestVersion(conn *AgwConn, version uint32) uint32 {
+	if compressMode(version) == NoCompress || codecOf(version) != CodecGzip {
+		return version
 	}
+	return WithCodec(version, c.requestCodec(conn))
+}
 
-	logInfof("Adding handler to AgwClient: %s", handlerName)
-	handlers[handlerName] = handler
+// requestCodec returns the codec of the requests on conn: the one of its capability
+// handshake, or the one of SetPeerCodecs for the legacy protocol.
+func (c *AgwClient) requestCodec(conn *AgwConn) uint8 {
+	conn.capsLock.RLock()
+	if conn.caps != nil {
+		defer conn.capsLock.RUnlock()
+		return conn.codec
+	}
+	conn.capsLock.RUnlock()
+	c.codecLock.RLock()
+	defer c.codecLock.RUnlock()
+	return c.codec
+}
 
-	return nil
+// preferredCodec returns the first codec of local which peer accepts, gzip if none
+func preferredCodec(local, peer []string) (uint8, string) {
+	for _, name := range local {
+		if !containsFold(peer, name) {
+			continue
+		}
+		if id, ok := getCodecByName(name); ok {
+			return id, name
+		}
+	}
+	return CodecGzip, "gzip"
 }
 
-var CertPath = path.Join(os.TempDir(), ".server.cert")
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
 
-func checkOrDownloadCert() error {
-	if tools.IsExist(CertPath) {
-		return nil
+// AddReconnectListener registers a listener invoked in its own goroutine each time
+// a pooled connection is re-established after it had been lost, so that a slow
+// listener does not delay the others.
+func (c *AgwClient) AddReconnectListener(listener func(connId uint32)) {
+	if listener == nil {
+		return
 	}
-	remoteFilePath := path.Join(tools.Constant.OSAgentRemotePath, "cert", "sChat.pem")
-	err := aliyun.Download(CertPath, meta.RegionId(), remoteFilePath, meta.IsPrivate())
-	if err != nil {
-		return fmt.Errorf("download cert failed, err: %v", err)
+	c.listenerLock.Lock()
+	defer c.listenerLock.Unlock()
+	c.reconnectListeners = append(c.reconnectListeners, listener)
+}
+
+func (c *AgwClient) notifyReconnected(connId uint32) {
+	c.listenerLock.RLock()
+	listeners := c.reconnectListeners
+	c.listenerLock.RUnlock()
+	for _, listener := range listeners {
+		go listener(connId)
 	}
-	return nil
 }
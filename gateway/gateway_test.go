@@ -0,0 +1,902 @@
+package gateway_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sumansoul/aliyun-ahas-go-sdk/gateway"
+	"github.com/sumansoul/aliyun-ahas-go-sdk/gateway/gatewaytest"
+)
+
+var echoMetadata = gateway.RpcMetadata{ServerName: "Sentinel", HandlerName: "echo"}
+
+func echo(req *gateway.AgwMessage) (string, error) {
+	return req.Body(), nil
+}
+
+// echoHandler answers the requests of the gateway with their body
+type echoHandler struct{}
+
+func (echoHandler) Handle(request string) (string, error) {
+	return request, nil
+}
+
+// newServer starts a gateway answering echoMetadata, the caller closes it
+func newServer(t *testing.T) *gatewaytest.Server {
+	s, err := gatewaytest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Handle(echoMetadata.ServerName, echoMetadata.HandlerName, echo)
+	return s
+}
+
+// newClient connects a client to s, configure adjusts the config of the server if not
+// nil. The caller closes the client.
+func newClient(t *testing.T, s *gatewaytest.Server, configure func(*gateway.AgwConfig)) *gateway.AgwClient {
+	config := s.Config()
+	if configure != nil {
+		configure(&config)
+	}
+	client, err := gateway.NewAgwClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// eventually polls cond until it holds or the timeout elapses
+func eventually(t *testing.T, timeout time.Duration, cond func() bool, format string, args ...interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+var compressModes = map[string]uint32{
+	"NoCompress":       gateway.NoCompress,
+	"AllCompress":      gateway.AllCompress,
+	"RequestCompress":  gateway.RequestCompress,
+	"ResponseCompress": gateway.ResponseCompress,
+}
+
+func TestCallCompressModes(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	client := newClient(t, s, nil)
+	defer client.Close(context.Background())
+	body := strings.Repeat(`{"resource":"GET:/api/orders","passQps":12}`, 200)
+	for name, mode := range compressModes {
+		t.Run(name, func(t *testing.T) {
+			s.Reset()
+			metadata := echoMetadata
+			metadata.Version = mode
+			response, err := client.Call("outer-"+name, metadata, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response != body {
+				t.Fatalf("response of %d bytes, want the %d bytes of the request", len(response), len(body))
+			}
+			for _, frame := range s.Frames() {
+				if frame.Msg.HandlerName() == metadata.HandlerName && frame.Msg.Version()&0x7f != mode {
+					t.Fatalf("frame sent with version %#x, want compress mode %d", frame.Msg.Version(), mode)
+				}
+			}
+		})
+	}
+}
+
+func TestGatewayCallCompressModes(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	client := newClient(t, s, nil)
+	defer client.Close(context.Background())
+	if err := client.AddHandler("echo", echoHandler{}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, 3*time.Second, func() bool { return len(s.Conns()) > 0 }, "client not connected")
+	body := strings.Repeat("1700000000000|GET:/api/orders|12|0|3\n", 200)
+	for name, mode := range compressModes {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			response, err := s.Conns()[0].Call(ctx, "echo", body, mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.InnerCode() != 0 || response.Body() != body {
+				t.Fatalf("response [%d:%s] of %d bytes", response.InnerCode(), response.InnerMsg(), len(response.Body()))
+			}
+		})
+	}
+}
+
+func TestReconnectAfterDrop(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	var reconnected int32
+	client := newClient(t, s, func(config *gateway.AgwConfig) {
+		config.PoolSize = 1
+		config.ReconnectBaseDelay = 10 * time.Millisecond
+	})
+	defer client.Close(context.Background())
+	client.AddReconnectListener(func(connId uint32) {
+		atomic.AddInt32(&reconnected, 1)
+	})
+	if _, err := client.Call("outer-1", echoMetadata, "before"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.DropConnections()
+	eventually(t, 3*time.Second, func() bool {
+		response, err := client.Call("outer-2", echoMetadata, "after")
+		return err == nil && response == "after"
+	}, "no call succeeded after the connections were dropped")
+	eventually(t, time.Second, func() bool { return atomic.LoadInt32(&reconnected) > 0 }, "reconnect listener not called")
+	if stats := client.Stats(); stats.Reconnects == 0 {
+		t.Fatalf("no reconnect counted, stats %+v", stats)
+	}
+}
+
+func TestHeartbeatMiss(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	client := newClient(t, s, func(config *gateway.AgwConfig) {
+		config.PoolSize = 1
+		config.HeartbeatInterval = 50 * time.Millisecond
+		config.MaxMissedHeartbeats = 2
+	})
+	defer client.Close(context.Background())
+	eventually(t, 3*time.Second, func() bool {
+		stats := client.ConnStats()
+		return len(stats) == 1 && !stats[0].LastPong.IsZero()
+	}, "no heartbeat answered")
+	first := s.Conns()[0].Id()
+
+	s.SetHeartbeats(false)
+	eventually(t, 3*time.Second, func() bool {
+		conns := s.Conns()
+		return len(conns) == 1 && conns[0].Id() != first
+	}, "connection %d not redialed after missed heartbeats", first)
+	if _, err := client.Call("outer-1", echoMetadata, "after"); err != nil {
+		t.Fatalf("call on the redialed connection failed: %v", err)
+	}
+}
+
+func TestCloseWithCallInFlight(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	started := make(chan struct{}, 1)
+	s.Handle(echoMetadata.ServerName, "slow", func(req *gateway.AgwMessage) (string, error) {
+		started <- struct{}{}
+		time.Sleep(200 * time.Millisecond)
+		return "done", nil
+	})
+	client := newClient(t, s, nil)
+	defer client.Close(context.Background())
+
+	result := make(chan error, 1)
+	go func() {
+		response, err := client.Call("outer-1", gateway.RpcMetadata{ServerName: echoMetadata.ServerName, HandlerName: "slow"}, "{}")
+		if err == nil && response != "done" {
+			err = errors.New("unexpected response " + response)
+		}
+		result <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := client.Close(ctx); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if err := <-result; err != nil {
+		t.Fatalf("in-flight call failed: %v", err)
+	}
+	if _, err := client.Call("outer-2", echoMetadata, "{}"); !errors.Is(err, gateway.ErrClientClosed) {
+		t.Fatalf("call after close returned %v, want %v", err, gateway.ErrClientClosed)
+	}
+}
+
+func TestCloseTimeoutWithCallInFlight(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	s.Handle(echoMetadata.ServerName, "silent", func(req *gateway.AgwMessage) (string, error) {
+		return "", gatewaytest.ErrNoResponse
+	})
+	client := newClient(t, s, func(config *gateway.AgwConfig) {
+		config.Timeout = 5 * time.Second
+	})
+	defer client.Close(context.Background())
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := client.Call("outer-1", gateway.RpcMetadata{ServerName: echoMetadata.ServerName, HandlerName: "silent"}, "{}")
+		result <- err
+	}()
+	eventually(t, 3*time.Second, func() bool { return client.Stats().InFlightCalls == 1 }, "call not in flight")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("close returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Fatal("call succeeded without a response")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("in-flight call not failed by close")
+	}
+}
+
+func TestCloseDuringDial(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	dialing := make(chan struct{}, 1)
+	release := make(chan struct{})
+	client := newClient(t, s, func(config *gateway.AgwConfig) {
+		config.PoolSize = 1
+		config.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialing <- struct{}{}
+			<-release
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		}
+	})
+	defer client.Close(context.Background())
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := client.Call("outer-1", echoMetadata, "{}")
+		result <- err
+	}()
+	<-dialing
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	client.Close(ctx)
+	close(release)
+
+	if err := <-result; !errors.Is(err, gateway.ErrClientClosed) {
+		t.Fatalf("call dialing during close returned %v, want %v", err, gateway.ErrClientClosed)
+	}
+	eventually(t, 3*time.Second, func() bool { return len(s.Conns()) == 0 }, "connection dialed during close left open")
+}
+
+func TestCallRetry(t *testing.T) {
+	cases := []struct {
+		name    string
+		policy  *gateway.RetryPolicy
+		drops   int32
+		wantErr error
+		retries uint64
+	}{
+		{"default policy", nil, 1, nil, 1},
+		{"attempts exhausted", &gateway.RetryPolicy{MaxAttempts: 2}, 2, gateway.ErrConnClosed, 1},
+		{"not retried", &gateway.RetryPolicy{MaxAttempts: 3, RetryOn: []error{gateway.ErrTimeout}}, 1, gateway.ErrConnClosed, 0},
+		{"budget exhausted", &gateway.RetryPolicy{MaxAttempts: 3, Budget: &gateway.RetryBudget{MaxTokens: 1}}, 1, gateway.ErrConnClosed, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newServer(t)
+			defer s.Close()
+			drops := c.drops
+			s.Handle(echoMetadata.ServerName, "flaky", func(req *gateway.AgwMessage) (string, error) {
+				if atomic.AddInt32(&drops, -1) >= 0 {
+					return "", gatewaytest.ErrDrop
+				}
+				return req.Body(), nil
+			})
+			client := newClient(t, s, func(config *gateway.AgwConfig) {
+				config.PoolSize = 1
+				config.ReconnectBaseDelay = 10 * time.Millisecond
+				config.RetryPolicy = c.policy
+			})
+			defer client.Close(context.Background())
+
+			metadata := gateway.RpcMetadata{ServerName: echoMetadata.ServerName, HandlerName: "flaky"}
+			response, err := client.Call("outer-1", metadata, "body")
+			if c.wantErr == nil && (err != nil || response != "body") {
+				t.Fatalf("call returned %q, %v", response, err)
+			}
+			if c.wantErr != nil && !errors.Is(err, c.wantErr) {
+				t.Fatalf("call returned %v, want %v", err, c.wantErr)
+			}
+			if retries := client.Stats().Retries; retries != c.retries {
+				t.Fatalf("%d retries, want %d", retries, c.retries)
+			}
+		})
+	}
+}
+
+// handlerFunc adapts a function to gateway.AgwHandler
+type handlerFunc func(request string) (string, error)
+
+func (f handlerFunc) Handle(request string) (string, error) {
+	return f(request)
+}
+
+func TestDispatchErrorCodes(t *testing.T) {
+	cases := []struct {
+		name      string
+		configure func(*gateway.AgwConfig)
+		handler   string
+		// blocked requests in flight before the checked one
+		inFlight int
+		timeout  time.Duration
+		code     uint32
+	}{
+		{"no handler", nil, "missing", 0, 0, gateway.InnerCodeNoHandler},
+		{"handler error", nil, "failing", 0, 0, gateway.InnerCodeHandlerError},
+		{"handler panic", nil, "panicking", 0, 0, gateway.InnerCodeHandlerError},
+		{"handler concurrency limit", func(config *gateway.AgwConfig) {
+			config.HandlerConcurrency = map[string]int{"block": 1}
+		}, "block", 1, 0, gateway.InnerCodeBusy},
+		{"worker queue full", func(config *gateway.AgwConfig) {
+			config.Workers = 1
+			config.WorkerQueueSize = 1
+		}, "block", 2, 0, gateway.InnerCodeBusy},
+		{"handler timeout", nil, "block", 0, 100 * time.Millisecond, gateway.InnerCodeHandlerTimeout},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newServer(t)
+			defer s.Close()
+			s.SetRequestTimeout(c.timeout)
+			client := newClient(t, s, func(config *gateway.AgwConfig) {
+				config.PoolSize = 1
+				if c.configure != nil {
+					c.configure(config)
+				}
+			})
+			defer client.Close(context.Background())
+			started := make(chan struct{}, c.inFlight+1)
+			release := make(chan struct{})
+			handlers := map[string]gateway.AgwHandler{
+				"echo":    echoHandler{},
+				"failing": handlerFunc(func(string) (string, error) { return "", errors.New("failed") }),
+				"panicking": handlerFunc(func(string) (string, error) {
+					panic("handler bug")
+				}),
+				"block": handlerFunc(func(request string) (string, error) {
+					started <- struct{}{}
+					<-release
+					return request, nil
+				}),
+			}
+			for name, handler := range handlers {
+				if err := client.AddHandler(name, handler); err != nil {
+					t.Fatal(err)
+				}
+			}
+			eventually(t, 3*time.Second, func() bool { return len(s.Conns()) == 1 }, "client not connected")
+			conn := s.Conns()[0]
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+
+			for i := 0; i < c.inFlight; i++ {
+				go conn.Call(ctx, "block", "{}", gateway.NoCompress)
+				if i == 0 {
+					<-started
+					continue
+				}
+				sent := i + 1
+				eventually(t, time.Second, func() bool {
+					requests := 0
+					for _, frame := range s.Frames() {
+						if !frame.Inbound && frame.Msg.HandlerName() == "block" {
+							requests++
+						}
+					}
+					return requests == sent
+				}, "blocked request %d not sent", sent)
+			}
+			response, err := conn.Call(ctx, c.handler, "{}", gateway.NoCompress)
+			close(release)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.InnerCode() != c.code || response.Body() != "" {
+				t.Fatalf("response [%d:%s] %q, want code %d", response.InnerCode(), response.InnerMsg(), response.Body(), c.code)
+			}
+
+			// the workers keep serving once the error is answered
+			if response, err := conn.Call(ctx, "echo", "after", gateway.NoCompress); err != nil || response.Body() != "after" {
+				t.Fatalf("request after the error answered %v, %v", response, err)
+			}
+		})
+	}
+}
+
+// chunkedHandler writes its response in pieces, then fails with err if not nil
+type chunkedHandler struct {
+	pieces []string
+	err    error
+}
+
+func (h chunkedHandler) Handle(request string) (string, error) {
+	return strings.Join(h.pieces, ""), h.err
+}
+
+func (h chunkedHandler) HandleStream(request string, w io.Writer) error {
+	for _, piece := range h.pieces {
+		if _, err := io.WriteString(w, piece); err != nil {
+			return err
+		}
+	}
+	return h.err
+}
+
+func TestStreamedResponseChunks(t *testing.T) {
+	const chunkSize = 1000
+	cases := []struct {
+		name   string
+		pieces []string
+		err    error
+		// body sizes of the stream frames, the terminator included, none for a single frame
+		chunks []int
+		body   int
+		code   uint32
+	}{
+		{"single frame", []string{strings.Repeat("a", 600), strings.Repeat("b", 400)}, nil, nil, chunkSize, 0},
+		{"chunked", []string{strings.Repeat("a", 1500), strings.Repeat("b", 2000)}, nil, []int{1000, 1000, 1000, 500, 0}, 3500, 0},
+		{"exact chunks", []string{strings.Repeat("a", 2000)}, nil, []int{1000, 1000, 0}, 2000, 0},
+		// the buffered chunk is dropped, the terminator carries the error
+		{"failure after chunks", []string{strings.Repeat("a", 1500)}, errors.New("failed"), []int{1000, 0}, 1000, gateway.InnerCodeHandlerError},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newServer(t)
+			defer s.Close()
+			s.SetCapabilities(&gateway.Capabilities{Protocol: gateway.ProtocolVersion, MaxFrameSize: chunkSize, Streaming: true})
+			client := newClient(t, s, func(config *gateway.AgwConfig) { config.PoolSize = 1 })
+			defer client.Close(context.Background())
+			if err := client.AddHandler("chunked", chunkedHandler{pieces: c.pieces, err: c.err}); err != nil {
+				t.Fatal(err)
+			}
+			eventually(t, 3*time.Second, func() bool {
+				stats := client.ConnStats()
+				return len(stats) == 1 && stats[0].Capabilities != nil && stats[0].Capabilities.Streaming
+			}, "streaming not negotiated")
+			s.Reset()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			response, err := s.Conns()[0].Call(ctx, "chunked", "{}", gateway.NoCompress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.InnerCode() != c.code || len(response.Body()) != c.body {
+				t.Fatalf("response [%d:%s] of %d bytes, want code %d and %d bytes",
+					response.InnerCode(), response.InnerMsg(), len(response.Body()), c.code, c.body)
+			}
+			var chunks []int
+			for _, frame := range s.Frames() {
+				if frame.Inbound && frame.Msg.MessageDirection() == gateway.MessageDirectionResponse {
+					if frame.Msg.MessageType() == gateway.MessageTypeStream {
+						chunks = append(chunks, len(frame.Msg.Body()))
+					} else if frame.Msg.MessageType() != gateway.MessageTypeBiz || c.chunks != nil {
+						t.Fatalf("response frame of type %d", frame.Msg.MessageType())
+					}
+				}
+			}
+			if fmt.Sprint(chunks) != fmt.Sprint(c.chunks) {
+				t.Fatalf("stream frames of %v bytes, want %v", chunks, c.chunks)
+			}
+		})
+	}
+}
+
+var codecNames = map[uint8]string{gateway.CodecGzip: "gzip", gateway.CodecSnappy: "snappy"}
+
+func TestCapabilityHandshake(t *testing.T) {
+	cases := []struct {
+		name string
+		// answer of the gateway, nil echoes the handshake like an older gateway
+		caps *gateway.Capabilities
+		// codecs of the answer to the connect request
+		peerCodecs []string
+		want       *gateway.Capabilities
+		codec      uint8
+	}{
+		{"older gateway", nil, nil, nil, gateway.CodecGzip},
+		{"older gateway with connect codecs", nil, []string{"snappy"}, nil, gateway.CodecSnappy},
+		{"newer gateway", &gateway.Capabilities{Protocol: gateway.ProtocolVersion, Codecs: []string{"gzip"}, MaxFrameSize: 4096, StringIp: true, Streaming: true},
+			[]string{"snappy", "gzip"},
+			&gateway.Capabilities{Protocol: gateway.ProtocolVersion, Codecs: []string{"gzip"}, MaxFrameSize: 4096, StringIp: true, Streaming: true},
+			gateway.CodecGzip},
+		{"newer protocol", &gateway.Capabilities{Protocol: gateway.ProtocolVersion + 1, Codecs: []string{"zstd", "SNAPPY"}}, nil,
+			&gateway.Capabilities{Protocol: gateway.ProtocolVersion, Codecs: []string{"snappy"}},
+			gateway.CodecSnappy},
+		{"no shared codec", &gateway.Capabilities{Protocol: gateway.ProtocolVersion, Codecs: []string{"lz4"}}, []string{"snappy"},
+			&gateway.Capabilities{Protocol: gateway.ProtocolVersion},
+			gateway.CodecGzip},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newServer(t)
+			defer s.Close()
+			s.SetCapabilities(c.caps)
+			client := newClient(t, s, func(config *gateway.AgwConfig) { config.PoolSize = 1 })
+			defer client.Close(context.Background())
+			if c.peerCodecs != nil {
+				client.SetPeerCodecs(c.peerCodecs)
+			}
+			if _, err := client.Call("outer-1", echoMetadata, "{}"); err != nil {
+				t.Fatal(err)
+			}
+			eventually(t, 3*time.Second, func() bool {
+				for _, frame := range s.Frames() {
+					if !frame.Inbound && frame.Msg.HandlerName() == gateway.CapabilitiesHandlerName {
+						return true
+					}
+				}
+				return false
+			}, "handshake not answered")
+			if c.want != nil {
+				eventually(t, 3*time.Second, func() bool { return client.ConnStats()[0].Capabilities != nil }, "capabilities not negotiated")
+			}
+
+			stats := client.ConnStats()[0]
+			if fmt.Sprintf("%+v", stats.Capabilities) != fmt.Sprintf("%+v", c.want) {
+				t.Fatalf("capabilities %+v, want %+v", stats.Capabilities, c.want)
+			}
+			if codecNames[c.codec] != stats.Codec {
+				t.Fatalf("connection stats codec %q, want %q", stats.Codec, codecNames[c.codec])
+			}
+			s.Reset()
+			metadata := echoMetadata
+			metadata.Version = gateway.AllCompress
+			body := strings.Repeat(`{"resource":"GET:/api/orders","passQps":12}`, 100)
+			if response, err := client.Call("outer-2", metadata, body); err != nil || response != body {
+				t.Fatalf("compressed call returned %d bytes, %v", len(response), err)
+			}
+			for _, frame := range s.Frames() {
+				if frame.Inbound && frame.Msg.HandlerName() == echoMetadata.HandlerName {
+					if codec := uint8(frame.Msg.Version() >> 8); codec != c.codec {
+						t.Fatalf("request compressed with codec %d, want %d", codec, c.codec)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDialFailureBackoff(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	const failures = 2
+	var dials int32
+	client := newClient(t, s, func(config *gateway.AgwConfig) {
+		config.PoolSize = 1
+		config.ReconnectBaseDelay = 100 * time.Millisecond
+		config.RetryPolicy = &gateway.RetryPolicy{MaxAttempts: 1}
+		config.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			if atomic.AddInt32(&dials, 1) <= failures {
+				return nil, errors.New("connection refused")
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		}
+	})
+	defer client.Close(context.Background())
+
+	if _, err := client.Call("outer-1", echoMetadata, "{}"); err == nil || errors.Is(err, gateway.ErrUnavailable) {
+		t.Fatalf("first call returned %v, want the dial error", err)
+	}
+	// the slot backs off, calls fail fast instead of dialing
+	_, err := client.Call("outer-2", echoMetadata, "{}")
+	var unavailable *gateway.UnavailableError
+	if !errors.As(err, &unavailable) || unavailable.RetryAfter <= 0 || unavailable.Cause == nil {
+		t.Fatalf("call during the backoff returned %v, want an %T", err, unavailable)
+	}
+	stats := client.ConnStats()[0]
+	if stats.State != "failed" || stats.RetryAt.IsZero() || stats.LastError == "" {
+		t.Fatalf("slot stats %+v during the backoff", stats)
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatalf("%d dials during the backoff, want 1", n)
+	}
+
+	// the reconnect timer redials, the second failure doubles the backoff
+	eventually(t, 3*time.Second, func() bool { return client.ConnStats()[0].State == "ready" }, "slot not redialed by the timer")
+	if n := atomic.LoadInt32(&dials); n != failures+1 {
+		t.Fatalf("%d dials, want %d", n, failures+1)
+	}
+	if response, err := client.Call("outer-3", echoMetadata, "after"); err != nil || response != "after" {
+		t.Fatalf("call after the reconnection returned %q, %v", response, err)
+	}
+}
+
+func TestReconnectListeners(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	client := newClient(t, s, func(config *gateway.AgwConfig) {
+		config.PoolSize = 1
+		config.ReconnectBaseDelay = 10 * time.Millisecond
+	})
+	defer client.Close(context.Background())
+	blocked := make(chan struct{})
+	defer close(blocked)
+	var slow, fast int32
+	client.AddReconnectListener(nil)
+	client.AddReconnectListener(func(connId uint32) {
+		atomic.AddInt32(&slow, 1)
+		<-blocked
+	})
+	client.AddReconnectListener(func(connId uint32) {
+		atomic.AddInt32(&fast, 1)
+	})
+
+	if _, err := client.Call("outer-1", echoMetadata, "{}"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&slow) != 0 || atomic.LoadInt32(&fast) != 0 {
+		t.Fatal("listeners called on the first connection")
+	}
+
+	s.DropConnections()
+	eventually(t, 3*time.Second, func() bool {
+		_, err := client.Call("outer-2", echoMetadata, "{}")
+		return err == nil
+	}, "no call succeeded after the connection was dropped")
+	// the blocked listener does not hold back the next one
+	eventually(t, time.Second, func() bool { return atomic.LoadInt32(&fast) == 1 && atomic.LoadInt32(&slow) == 1 },
+		"listeners not called once each after the reconnection")
+}
+
+func TestVersionedHandlerDispatch(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	client := newClient(t, s, func(config *gateway.AgwConfig) { config.PoolSize = 1 })
+	defer client.Close(context.Background())
+	if err := client.AddHandler("rule", chunkedHandler{pieces: []string{"any"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AddVersionedHandler("rule", 2, chunkedHandler{pieces: []string{"v2"}}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, 3*time.Second, func() bool { return len(s.Conns()) == 1 }, "client not connected")
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	call := func(apiVersion uint16) (uint32, string) {
+		t.Helper()
+		response, err := s.Conns()[0].Call(ctx, "rule", "{}", gateway.WithApiVersion(gateway.AllCompress, apiVersion))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response.InnerCode(), response.Body()
+	}
+
+	if code, body := call(2); code != 0 || body != "v2" {
+		t.Fatalf("version 2 answered [%d] %q", code, body)
+	}
+	if code, body := call(7); code != 0 || body != "any" {
+		t.Fatalf("version 7 answered [%d] %q, want the handler of every version", code, body)
+	}
+	client.RemoveVersionedHandler("rule", 2)
+	if code, body := call(2); code != 0 || body != "any" {
+		t.Fatalf("removed version 2 answered [%d] %q, want the handler of every version", code, body)
+	}
+	client.RemoveHandler("rule")
+	if code, _ := call(2); code != gateway.InnerCodeNoHandler {
+		t.Fatalf("removed handler answered [%d], want %d", code, gateway.InnerCodeNoHandler)
+	}
+}
+
+func TestIpv6ClientAddress(t *testing.T) {
+	cases := []struct {
+		name     string
+		caps     *gateway.Capabilities
+		ipString string
+	}{
+		{"older gateway", nil, ""},
+		{"gateway without string ip", &gateway.Capabilities{Protocol: gateway.ProtocolVersion}, ""},
+		{"gateway with string ip", &gateway.Capabilities{Protocol: gateway.ProtocolVersion, StringIp: true}, "2001:db8::1"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newServer(t)
+			defer s.Close()
+			s.SetCapabilities(c.caps)
+			client := newClient(t, s, func(config *gateway.AgwConfig) {
+				config.PoolSize = 1
+				config.ClientIp = "2001:db8::1"
+			})
+			defer client.Close(context.Background())
+			if _, err := client.Call("outer-1", echoMetadata, "{}"); err != nil {
+				t.Fatal(err)
+			}
+			if c.caps != nil {
+				eventually(t, 3*time.Second, func() bool { return client.ConnStats()[0].Capabilities != nil }, "capabilities not negotiated")
+			}
+			s.Reset()
+			if response, err := client.Call("outer-2", echoMetadata, "ipv6"); err != nil || response != "ipv6" {
+				t.Fatalf("call returned %q, %v", response, err)
+			}
+			for _, frame := range s.Frames() {
+				if frame.Inbound && frame.Msg.HandlerName() == echoMetadata.HandlerName {
+					if frame.Msg.ClientIp() != 0 || frame.Msg.ClientIpString() != c.ipString {
+						t.Fatalf("request sent with client ip %d %q, want %q", frame.Msg.ClientIp(), frame.Msg.ClientIpString(), c.ipString)
+					}
+				}
+			}
+		})
+	}
+}
+
+type spanKey struct{}
+
+// recordedSpan is a span of recordingTracer
+type recordedSpan struct {
+	name   string
+	parent *recordedSpan
+	attrs  map[string]interface{}
+	err    error
+	ended  int32
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...gateway.Attribute) {
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *recordedSpan) End(err error) {
+	s.err = err
+	atomic.AddInt32(&s.ended, 1)
+}
+
+// recordingTracer keeps the spans it starts, the attributes of a span are only read
+// once it has ended.
+type recordingTracer struct {
+	lock  sync.Mutex
+	spans []*recordedSpan
+}
+
+func (r *recordingTracer) StartSpan(ctx context.Context, name string, attrs ...gateway.Attribute) (context.Context, gateway.Span) {
+	parent, _ := ctx.Value(spanKey{}).(*recordedSpan)
+	span := &recordedSpan{name: name, parent: parent, attrs: make(map[string]interface{})}
+	span.SetAttributes(attrs...)
+	r.lock.Lock()
+	r.spans = append(r.spans, span)
+	r.lock.Unlock()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// ended returns the spans named name which have ended
+func (r *recordingTracer) ended(name string) []*recordedSpan {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var spans []*recordedSpan
+	for _, span := range r.spans {
+		if span.name == name && atomic.LoadInt32(&span.ended) > 0 {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+func TestCallSpans(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	var drops int32 = 1
+	s.Handle(echoMetadata.ServerName, "flaky", func(req *gateway.AgwMessage) (string, error) {
+		if atomic.AddInt32(&drops, -1) >= 0 {
+			return "", gatewaytest.ErrDrop
+		}
+		return req.Body(), nil
+	})
+	s.Handle(echoMetadata.ServerName, "busy", func(req *gateway.AgwMessage) (string, error) {
+		return "", &gateway.RemoteError{Code: gateway.InnerCodeBusy, Msg: "busy"}
+	})
+	tracer := &recordingTracer{}
+	client := newClient(t, s, func(config *gateway.AgwConfig) {
+		config.PoolSize = 1
+		config.ReconnectBaseDelay = 10 * time.Millisecond
+		config.Tracer = tracer
+	})
+	defer client.Close(context.Background())
+
+	flaky := gateway.RpcMetadata{ServerName: echoMetadata.ServerName, HandlerName: "flaky"}
+	if _, err := client.Call("outer-1", flaky, "body"); err != nil {
+		t.Fatal(err)
+	}
+	calls, attempts := tracer.ended(gateway.SpanCall), tracer.ended(gateway.SpanAttempt)
+	if len(calls) != 1 || len(attempts) != 2 {
+		t.Fatalf("%d call and %d attempt spans, want 1 and 2", len(calls), len(attempts))
+	}
+	call := calls[0]
+	if call.err != nil || call.attrs[gateway.AttrRetries] != 1 || call.attrs[gateway.AttrOuterReqId] != "outer-1" ||
+		call.attrs[gateway.AttrHandlerName] != "flaky" || call.attrs[gateway.AttrReqId] != attempts[1].attrs[gateway.AttrReqId] {
+		t.Fatalf("call span ended with %v and %v", call.err, call.attrs)
+	}
+	for i, attempt := range attempts {
+		if attempt.parent != call || attempt.attrs[gateway.AttrAttempt] != i+1 || attempt.attrs[gateway.AttrConnId] != uint32(0) {
+			t.Fatalf("attempt span %d of %v with %v", i, attempt.parent, attempt.attrs)
+		}
+	}
+	if !errors.Is(attempts[0].err, gateway.ErrConnClosed) || attempts[1].err != nil {
+		t.Fatalf("attempts ended with %v then %v", attempts[0].err, attempts[1].err)
+	}
+
+	var remote *gateway.RemoteError
+	if _, err := client.Call("outer-2", gateway.RpcMetadata{ServerName: echoMetadata.ServerName, HandlerName: "busy"}, "{}"); !errors.As(err, &remote) {
+		t.Fatalf("busy call returned %v", err)
+	}
+	calls, attempts = tracer.ended(gateway.SpanCall), tracer.ended(gateway.SpanAttempt)
+	for _, span := range []*recordedSpan{calls[1], attempts[2]} {
+		if !errors.As(span.err, &remote) || remote.Code != gateway.InnerCodeBusy || span.attrs[gateway.AttrInnerCode] != uint32(gateway.InnerCodeBusy) {
+			t.Fatalf("%s span of a busy call ended with %v and %v", span.name, span.err, span.attrs)
+		}
+	}
+
+	for _, span := range tracer.ended(gateway.SpanCall) {
+		if span.ended != 1 {
+			t.Fatalf("call span ended %d times", span.ended)
+		}
+	}
+}
+
+func TestHandleSpans(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	tracer := &recordingTracer{}
+	client := newClient(t, s, func(config *gateway.AgwConfig) {
+		config.PoolSize = 1
+		config.Tracer = tracer
+	})
+	defer client.Close(context.Background())
+	if err := client.AddHandler("echo", echoHandler{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AddHandler("failing", handlerFunc(func(string) (string, error) { return "", errors.New("failed") })); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, 3*time.Second, func() bool { return len(s.Conns()) == 1 }, "client not connected")
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	cases := []struct {
+		handler string
+		code    interface{}
+	}{
+		{"echo", nil},
+		{"failing", uint32(gateway.InnerCodeHandlerError)},
+		{"missing", uint32(gateway.InnerCodeNoHandler)},
+	}
+	for i, c := range cases {
+		response, err := s.Conns()[0].Call(ctx, c.handler, "{}", gateway.AllCompress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var spans []*recordedSpan
+		eventually(t, time.Second, func() bool {
+			spans = tracer.ended(gateway.SpanHandle)
+			return len(spans) == i+1
+		}, "%s request not traced", c.handler)
+		span := spans[i]
+		if span.attrs[gateway.AttrHandlerName] != c.handler || span.attrs[gateway.AttrReqId] != response.ReqId() ||
+			span.attrs[gateway.AttrConnId] != uint32(0) || span.parent != nil {
+			t.Fatalf("%s span with %v", c.handler, span.attrs)
+		}
+		if span.attrs[gateway.AttrInnerCode] != c.code || (span.err != nil) != (c.code != nil) {
+			t.Fatalf("%s span ended with %v and code %v, want code %v", c.handler, span.err, span.attrs[gateway.AttrInnerCode], c.code)
+		}
+	}
+}
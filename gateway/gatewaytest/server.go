@@ -0,0 +1,459 @@
+// Package gatewaytest provides a local AGW gateway for the tests of gateway.AgwClient
+// and the packages built on it.
+//
+// The server answers heartbeats, routes the requests of the clients to scripted
+// handlers, sends requests of its own to the clients, and records every frame. The
+// streamed bodies of the clients are joined before they are routed:
+//
+//	s, _ := gatewaytest.NewServer()
+//	defer s.Close()
+//	s.Handle("Sentinel", "connect", func(req *gateway.AgwMessage) (string, error) {
+//		return `{"code":200,"success":true}`, nil
+//	})
+//	client, _ := gateway.NewAgwClient(s.Config())
+package gatewaytest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sumansoul/aliyun-ahas-go-sdk/gateway"
+)
+
+// Inner codes of the responses the server makes up
+const (
+	CodeNoHandler    = 404
+	CodeHandlerError = 500
+)
+
+var (
+	// ErrDrop makes the server close the connection of the request without answering it
+	ErrDrop = errors.New("gatewaytest: drop the connection")
+	// ErrNoResponse makes the server leave the request unanswered
+	ErrNoResponse = errors.New("gatewaytest: no response")
+	// ErrNoConnection is returned by Server.Call when no client is connected
+	ErrNoConnection = errors.New("gatewaytest: no client connected")
+)
+
+// HandlerFunc answers a request of a client with the body of the response. A
+// *gateway.RemoteError is answered with its code and message, ErrDrop and
+// ErrNoResponse are handled as documented, any other error is answered with
+// CodeHandlerError.
+type HandlerFunc func(req *gateway.AgwMessage) (string, error)
+
+// Frame is a frame received or sent by the server.
+type Frame struct {
+	// ConnId numbers the connections in the order they were accepted, from 1
+	ConnId  int
+	Inbound bool
+	At      time.Time
+	Msg     gateway.AgwMessage
+}
+
+// Server is a local AGW gateway listening on the loopback interface.
+type Server struct {
+	listener net.Listener
+
+	lock     sync.Mutex
+	conns    map[*Conn]struct{}
+	nextId   int
+	handlers map[string]HandlerFunc
+	latency  time.Duration
+	// whether heartbeats are answered
+	heartbeats bool
+	// answer of the capability handshake, nil answers it like an older gateway
+	caps *gateway.Capabilities
+	// timeout announced in the requests to the clients, zero announces the time left
+	// before the deadline of the context of Call
+	requestTimeout time.Duration
+	frames         []Frame
+	closed         bool
+
+	wg sync.WaitGroup
+}
+
+// NewServer starts a server on a random port of 127.0.0.1.
+func NewServer() (*Server, error) {
+	return NewServerAt("127.0.0.1:0")
+}
+
+// NewServerAt starts a server listening on addr, e.g. to let a whole application
+// connect to it.
+func NewServerAt(addr string) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		listener:   listener,
+		conns:      make(map[*Conn]struct{}),
+		handlers:   make(map[string]HandlerFunc),
+		heartbeats: true,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Endpoint returns the address of the server as a gateway endpoint
+func (s *Server) Endpoint() gateway.Endpoint {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	return gateway.Endpoint{Host: addr.IP.String(), Port: uint32(addr.Port)}
+}
+
+// Config returns a client config connecting to the server
+func (s *Server) Config() gateway.AgwConfig {
+	endpoint := s.Endpoint()
+	return gateway.AgwConfig{
+		ClientVpcId:       "gatewaytest",
+		ClientIp:          "127.0.0.1",
+		ClientProcessFlag: "GO_SDK:127.0.0.1:" + strconv.Itoa(os.Getpid()),
+		GatewayIp:         endpoint.Host,
+		GatewayPort:       endpoint.Port,
+		Timeout:           3 * time.Second,
+	}
+}
+
+// Handle scripts the answers to the requests of handlerName on serverName, an empty
+// serverName matches every server.
+func (s *Server) Handle(serverName, handlerName string, handler HandlerFunc) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.handlers[serverName+"_"+handlerName] = handler
+}
+
+// SetLatency delays every answer of the server, heartbeats included
+func (s *Server) SetLatency(latency time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.latency = latency
+}
+
+// SetHeartbeats sets whether the heartbeats of the clients are answered, they are by default
+func (s *Server) SetHeartbeats(answer bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.heartbeats = answer
+}
+
+// SetCapabilities makes the server answer the capability handshake of the clients
+// with caps. By default, and with nil, the handshake is echoed like any heartbeat, as
+// older gateways do, and the clients keep the legacy protocol.
+func (s *Server) SetCapabilities(caps *gateway.Capabilities) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.caps = caps
+}
+
+// SetRequestTimeout sets the timeout announced in the requests sent to the clients. By
+// default it is the time left before the deadline of the context of Call, so a client
+// timing out answers about when the caller gives up.
+func (s *Server) SetRequestTimeout(timeout time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requestTimeout = timeout
+}
+
+// Frames returns the frames recorded since the start or the last Reset
+func (s *Server) Frames() []Frame {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Frame(nil), s.frames...)
+}
+
+// Reset drops the recorded frames
+func (s *Server) Reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.frames = nil
+}
+
+// Conns returns the open connections in the order they were accepted
+func (s *Server) Conns() []*Conn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	conns := make([]*Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	for i := 1; i < len(conns); i++ {
+		for j := i; j > 0 && conns[j].id < conns[j-1].id; j-- {
+			conns[j], conns[j-1] = conns[j-1], conns[j]
+		}
+	}
+	return conns
+}
+
+// DropConnections closes every open connection, the clients are expected to redial
+func (s *Server) DropConnections() {
+	for _, c := range s.Conns() {
+		c.Close()
+	}
+}
+
+// Call sends a request to the client of the first open connection, see Conn.Call
+func (s *Server) Call(ctx context.Context, handlerName, body string) (*gateway.AgwMessage, error) {
+	conns := s.Conns()
+	if len(conns) == 0 {
+		return nil, ErrNoConnection
+	}
+	return conns[0].Call(ctx, handlerName, body, gateway.NoCompress)
+}
+
+// Close stops the server and closes every connection
+func (s *Server) Close() {
+	s.lock.Lock()
+	s.closed = true
+	s.lock.Unlock()
+	s.listener.Close()
+	s.DropConnections()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			nc.Close()
+			return
+		}
+		s.nextId++
+		c := &Conn{
+			id:      s.nextId,
+			server:  s,
+			conn:    nc,
+			pending: make(map[uint64]chan *gateway.AgwMessage),
+			closing: make(chan struct{}),
+		}
+		s.conns[c] = struct{}{}
+		s.lock.Unlock()
+
+		s.wg.Add(1)
+		go c.read()
+	}
+}
+
+func (s *Server) record(c *Conn, inbound bool, msg *gateway.AgwMessage) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.frames = append(s.frames, Frame{ConnId: c.id, Inbound: inbound, At: time.Now(), Msg: *msg})
+}
+
+func (s *Server) handler(serverName, handlerName string) (HandlerFunc, time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	handler, ok := s.handlers[serverName+"_"+handlerName]
+	if !ok {
+		handler = s.handlers["_"+handlerName]
+	}
+	return handler, s.latency
+}
+
+// Conn is a connection of a client to the server.
+type Conn struct {
+	id     int
+	server *Server
+	conn   net.Conn
+
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	// requests of the server waiting for the answer of the client, by reqId
+	pending map[uint64]chan *gateway.AgwMessage
+	reqId   uint64
+
+	closeOnce sync.Once
+	closing   chan struct{}
+}
+
+// Id numbers the connections in the order they were accepted, from 1
+func (c *Conn) Id() int {
+	return c.id
+}
+
+// Close closes the connection
+func (c *Conn) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+		c.conn.Close()
+		c.server.lock.Lock()
+		delete(c.server.conns, c)
+		c.server.lock.Unlock()
+	})
+}
+
+// Call sends a request to the client and waits for its answer. The frame version
+// sets the compression of the request and of the response, e.g. gateway.AllCompress.
+func (c *Conn) Call(ctx context.Context, handlerName, body string, version uint32) (*gateway.AgwMessage, error) {
+	msg := gateway.NewAgwMessage()
+	msg.SetReqId(atomic.AddUint64(&c.reqId, 1))
+	msg.SetMessageType(gateway.MessageTypeBiz)
+	msg.SetMessageDirection(gateway.MessageDirectionRequest)
+	msg.SetHandlerName(handlerName)
+	msg.SetOuterReqId(fmt.Sprintf("gatewaytest-%d-%d", c.id, msg.ReqId()))
+	msg.SetVersion(version)
+	msg.SetBody(body)
+	c.server.lock.Lock()
+	timeout := c.server.requestTimeout
+	c.server.lock.Unlock()
+	if deadline, ok := ctx.Deadline(); ok && timeout == 0 {
+		timeout = time.Until(deadline)
+	}
+	msg.SetTimeoutMs(uint32(timeout.Milliseconds()))
+
+	answer := make(chan *gateway.AgwMessage, 1)
+	c.lock.Lock()
+	c.pending[msg.ReqId()] = answer
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, msg.ReqId())
+		c.lock.Unlock()
+	}()
+
+	if err := c.write(msg); err != nil {
+		return nil, err
+	}
+	select {
+	case response := <-answer:
+		return response, nil
+	case <-c.closing:
+		return nil, gateway.ErrConnClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Conn) write(msg *gateway.AgwMessage) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if _, err := msg.WriteTo(c.conn); err != nil {
+		return err
+	}
+	c.server.record(c, false, msg)
+	return nil
+}
+
+func (c *Conn) read() {
+	defer c.server.wg.Done()
+	defer c.Close()
+	br := bufio.NewReader(c.conn)
+	streams := gateway.NewStreamAssembler(0)
+	for {
+		msg := gateway.NewAgwMessage()
+		if err := msg.Decode(br); err != nil {
+			return
+		}
+		c.server.record(c, true, msg)
+		if msg.MessageType() == gateway.MessageTypeStream {
+			whole, err := streams.Add(msg)
+			if err != nil {
+				return
+			}
+			if whole == nil {
+				continue
+			}
+			msg = whole
+		}
+
+		if msg.MessageDirection() == gateway.MessageDirectionResponse {
+			c.lock.Lock()
+			answer, ok := c.pending[msg.ReqId()]
+			c.lock.Unlock()
+			if ok {
+				select {
+				case answer <- msg:
+				default:
+				}
+			}
+			continue
+		}
+		if msg.MessageType() == gateway.MessageTypeHeartbeat {
+			go c.answerHeartbeat(msg)
+			continue
+		}
+		go c.answer(msg)
+	}
+}
+
+func (c *Conn) answerHeartbeat(msg *gateway.AgwMessage) {
+	c.server.lock.Lock()
+	answer, latency, caps := c.server.heartbeats, c.server.latency, c.server.caps
+	c.server.lock.Unlock()
+	if !answer {
+		return
+	}
+	c.sleep(latency)
+	msg.SetMessageDirection(gateway.MessageDirectionResponse)
+	if caps != nil && msg.HandlerName() == gateway.CapabilitiesHandlerName {
+		body, err := json.Marshal(caps)
+		if err != nil {
+			return
+		}
+		msg.SetCaller(gateway.CallerGateway)
+		msg.SetBody(string(body))
+	}
+	c.write(msg)
+}
+
+func (c *Conn) answer(msg *gateway.AgwMessage) {
+	handler, latency := c.server.handler(msg.ServerName(), msg.HandlerName())
+	var body string
+	var err error
+	if handler == nil {
+		err = &gateway.RemoteError{Code: CodeNoHandler, Msg: "no handler " + msg.ServerName() + "_" + msg.HandlerName()}
+	} else {
+		body, err = handler(msg)
+	}
+	c.sleep(latency)
+
+	switch {
+	case err == ErrDrop:
+		c.Close()
+		return
+	case err == ErrNoResponse:
+		return
+	}
+	var remote *gateway.RemoteError
+	if errors.As(err, &remote) {
+		msg.SetInnerCode(remote.Code)
+		msg.SetInnerMsg(remote.Msg)
+		body = ""
+	} else if err != nil {
+		msg.SetInnerCode(CodeHandlerError)
+		msg.SetInnerMsg(err.Error())
+		body = ""
+	} else {
+		msg.SetInnerCode(0)
+		msg.SetInnerMsg("ok")
+	}
+	msg.SetMessageDirection(gateway.MessageDirectionResponse)
+	msg.SetBody(body)
+	c.write(msg)
+}
+
+func (c *Conn) sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.closing:
+	}
+}
@@ -0,0 +1,144 @@
+package gatewaytest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sumansoul/aliyun-ahas-go-sdk/gateway"
+)
+
+func newClient(t *testing.T, s *Server, timeout time.Duration) *gateway.AgwClient {
+	config := s.Config()
+	config.PoolSize = 1
+	if timeout > 0 {
+		config.Timeout = timeout
+		config.RetryPolicy = &gateway.RetryPolicy{MaxAttempts: 1}
+	}
+	client, err := gateway.NewAgwClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func eventually(t *testing.T, timeout time.Duration, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandlerRouting(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Handle("Sentinel", "rule", func(req *gateway.AgwMessage) (string, error) { return "sentinel rule", nil })
+	s.Handle("", "rule", func(req *gateway.AgwMessage) (string, error) { return "any rule", nil })
+	s.Handle("Sentinel", "remote", func(req *gateway.AgwMessage) (string, error) {
+		return "", &gateway.RemoteError{Code: 8034, Msg: "busy"}
+	})
+	s.Handle("Sentinel", "failing", func(req *gateway.AgwMessage) (string, error) { return "", errors.New("failed") })
+	client := newClient(t, s, 0)
+	defer client.Close(context.Background())
+
+	cases := []struct {
+		serverName, handlerName string
+		response                string
+		code                    uint32
+	}{
+		{"Sentinel", "rule", "sentinel rule", 0},
+		{"Topology", "rule", "any rule", 0},
+		{"Sentinel", "missing", "", CodeNoHandler},
+		{"Sentinel", "remote", "", 8034},
+		{"Sentinel", "failing", "", CodeHandlerError},
+	}
+	for _, c := range cases {
+		response, err := client.Call("outer", gateway.RpcMetadata{ServerName: c.serverName, HandlerName: c.handlerName}, "{}")
+		var remote *gateway.RemoteError
+		switch {
+		case c.code == 0 && (err != nil || response != c.response):
+			t.Errorf("%s_%s: %q, %v, want %q", c.serverName, c.handlerName, response, err, c.response)
+		case c.code != 0 && (!errors.As(err, &remote) || remote.Code != c.code):
+			t.Errorf("%s_%s: %v, want code %d", c.serverName, c.handlerName, err, c.code)
+		}
+	}
+}
+
+func TestDropAndNoResponse(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Handle("", "drop", func(req *gateway.AgwMessage) (string, error) { return "", ErrDrop })
+	s.Handle("", "silent", func(req *gateway.AgwMessage) (string, error) { return "", ErrNoResponse })
+	client := newClient(t, s, 200*time.Millisecond)
+	defer client.Close(context.Background())
+
+	if _, err := client.Call("outer-1", gateway.RpcMetadata{HandlerName: "drop"}, "{}"); !errors.Is(err, gateway.ErrConnClosed) {
+		t.Fatalf("dropped call returned %v, want %v", err, gateway.ErrConnClosed)
+	}
+	eventually(t, time.Second, func() bool { return len(s.Conns()) == 0 }, "dropped connection still open")
+
+	if _, err := client.Call("outer-2", gateway.RpcMetadata{HandlerName: "silent"}, "{}"); !errors.Is(err, gateway.ErrTimeout) {
+		t.Fatalf("unanswered call returned %v, want %v", err, gateway.ErrTimeout)
+	}
+	if conns := s.Conns(); len(conns) != 1 {
+		t.Fatalf("%d connections after an unanswered call, want it kept open", len(conns))
+	}
+	for _, frame := range s.Frames() {
+		if !frame.Inbound && frame.Msg.MessageType() == gateway.MessageTypeBiz {
+			t.Fatalf("answer %q sent for a dropped or unanswered request", frame.Msg.HandlerName())
+		}
+	}
+}
+
+func TestStreamJoining(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetCapabilities(&gateway.Capabilities{Protocol: gateway.ProtocolVersion, Codecs: []string{"gzip"}, Streaming: true})
+	var received string
+	s.Handle("", "upload", func(req *gateway.AgwMessage) (string, error) {
+		received = req.Body()
+		return "ok", nil
+	})
+	client := newClient(t, s, 0)
+	defer client.Close(context.Background())
+	if _, err := client.Call("outer-1", gateway.RpcMetadata{HandlerName: "upload"}, "{}"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, 3*time.Second, func() bool {
+		stats := client.ConnStats()
+		return len(stats) == 1 && stats[0].Capabilities != nil && stats[0].Capabilities.Streaming
+	}, "streaming not negotiated")
+
+	body := strings.Repeat("1700000000000|GET:/api/orders|12|0|3\n", 5000)
+	response, err := client.Call("outer-2", gateway.RpcMetadata{HandlerName: "upload"}, body)
+	if err != nil || response != "ok" {
+		t.Fatalf("streamed call returned %q, %v", response, err)
+	}
+	if received != body {
+		t.Fatalf("handler received %d bytes, want the %d bytes joined", len(received), len(body))
+	}
+	chunks := 0
+	for _, frame := range s.Frames() {
+		if frame.Inbound && frame.Msg.MessageType() == gateway.MessageTypeStream {
+			chunks++
+		}
+	}
+	if chunks < 2 {
+		t.Fatalf("%d stream frames received, want the body split", chunks)
+	}
+}
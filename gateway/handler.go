@@ -0,0 +1,141 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// AnyVersion registers a handler serving the requests of every api version which has
+// no handler of its own.
+const AnyVersion uint16 = 0
+
+// HandlerInfo describes a registered handler.
+type HandlerInfo struct {
+	Name string
+	// Versions lists the api versions served by the handler, AnyVersion included
+	Versions []uint16
+}
+
+// handlerRegistry maps handler names, then api versions, to handlers.
+type handlerRegistry struct {
+	lock     sync.RWMutex
+	handlers map[string]map[uint16]AgwHandler
+}
+
+func newHandlerRegistry() handlerRegistry {
+	return handlerRegistry{handlers: make(map[string]map[uint16]AgwHandler)}
+}
+
+// WithApiVersion returns version with the api version, carried in the high 16 bits of
+// the frame version, replaced. The compress mode and the codec are kept.
+func WithApiVersion(version uint32, apiVersion uint16) uint32 {
+	return version&0xffff | uint32(apiVersion)<<16
+}
+
+func apiVersionOf(version uint32) uint16 {
+	return uint16(version >> 16)
+}
+
+// AddHandler registers the handler of every api version, it fails with ErrHandlerExists
+// if the name is already registered for AnyVersion.
+func (c *AgwClient) AddHandler(handlerName string, handler AgwHandler) error {
+	return c.AddVersionedHandler(handlerName, AnyVersion, handler)
+}
+
+// AddVersionedHandler registers the handler of the requests whose frame version carries
+// apiVersion, see WithApiVersion. It fails with ErrHandlerExists if the name is already
+// registered for that version.
+func (c *AgwClient) AddVersionedHandler(handlerName string, apiVersion uint16, handler AgwHandler) error {
+	if handlerName == "" {
+		return errors.New("handlerName can not be blank")
+	}
+
+	if handler == nil {
+		return errors.New("hander can not be null")
+	}
+
+	c.handlers.lock.Lock()
+	defer c.handlers.lock.Unlock()
+	versions, ok := c.handlers.handlers[handlerName]
+	if !ok {
+		versions = make(map[uint16]AgwHandler)
+		c.handlers.handlers[handlerName] = versions
+	}
+	if _, ok := versions[apiVersion]; ok {
+		return fmt.Errorf("%w: %s, version %d", ErrHandlerExists, handlerName, apiVersion)
+	}
+	versions[apiVersion] = handler
+
+	logInfof("Adding handler to AgwClient: %s, version %d", handlerName, apiVersion)
+	return nil
+}
+
+// RemoveHandler unregisters all versions of the handler, it returns false if there
+// was none. Requests arriving later are answered with InnerCodeNoHandler.
+func (c *AgwClient) RemoveHandler(handlerName string) bool {
+	c.handlers.lock.Lock()
+	defer c.handlers.lock.Unlock()
+	if _, ok := c.handlers.handlers[handlerName]; !ok {
+		return false
+	}
+	delete(c.handlers.handlers, handlerName)
+
+	logInfof("Removing handler from AgwClient: %s", handlerName)
+	return true
+}
+
+// RemoveVersionedHandler unregisters one version of the handler, it returns false if
+// that version was not registered.
+func (c *AgwClient) RemoveVersionedHandler(handlerName string, apiVersion uint16) bool {
+	c.handlers.lock.Lock()
+	defer c.handlers.lock.Unlock()
+	versions, ok := c.handlers.handlers[handlerName]
+	if !ok {
+		return false
+	}
+	if _, ok := versions[apiVersion]; !ok {
+		return false
+	}
+	delete(versions, apiVersion)
+	if len(versions) == 0 {
+		delete(c.handlers.handlers, handlerName)
+	}
+
+	logInfof("Removing handler from AgwClient: %s, version %d", handlerName, apiVersion)
+	return true
+}
+
+// Handlers lists the registered handlers sorted by name, their versions ascending.
+func (c *AgwClient) Handlers() []HandlerInfo {
+	c.handlers.lock.RLock()
+	defer c.handlers.lock.RUnlock()
+	infos := make([]HandlerInfo, 0, len(c.handlers.handlers))
+	for name, versions := range c.handlers.handlers {
+		info := HandlerInfo{Name: name, Versions: make([]uint16, 0, len(versions))}
+		for version := range versions {
+			info.Versions = append(info.Versions, version)
+		}
+		sort.Slice(info.Versions, func(i, j int) bool { return info.Versions[i] < info.Versions[j] })
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// getHandler returns the handler of the api version carried by the frame version,
+// falling back to the handler of AnyVersion.
+func (c *AgwClient) getHandler(handlerName string, version uint32) (AgwHandler, bool) {
+	c.handlers.lock.RLock()
+	defer c.handlers.lock.RUnlock()
+	versions, ok := c.handlers.handlers[handlerName]
+	if !ok {
+		return nil, false
+	}
+	if handler, ok := versions[apiVersionOf(version)]; ok {
+		return handler, true
+	}
+	handler, ok := versions[AnyVersion]
+	return handler, ok
+}
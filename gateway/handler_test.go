@@ -0,0 +1,103 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// namedHandler answers every request with its name
+type namedHandler string
+
+func (h namedHandler) Handle(request string) (string, error) {
+	return string(h), nil
+}
+
+func TestHandlerRegistryVersions(t *testing.T) {
+	c := &AgwClient{handlers: newHandlerRegistry()}
+	for _, err := range []error{
+		c.AddHandler("rule", namedHandler("any")),
+		c.AddVersionedHandler("rule", 2, namedHandler("v2")),
+		c.AddVersionedHandler("metric", 1, namedHandler("metric v1")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.AddVersionedHandler("rule", 2, namedHandler("other")); !errors.Is(err, ErrHandlerExists) {
+		t.Fatalf("second handler of a version returned %v, want %v", err, ErrHandlerExists)
+	}
+	if err := c.AddHandler("", namedHandler("blank")); err == nil {
+		t.Fatal("handler registered without a name")
+	}
+	if err := c.AddHandler("nil", nil); err == nil {
+		t.Fatal("nil handler registered")
+	}
+
+	cases := []struct {
+		name       string
+		apiVersion uint16
+		want       string
+	}{
+		{"rule", 2, "v2"},
+		{"rule", 0, "any"},
+		{"rule", 3, "any"},
+		{"metric", 1, "metric v1"},
+		{"metric", 2, ""},
+		{"missing", 0, ""},
+	}
+	check := func() {
+		t.Helper()
+		for _, tc := range cases {
+			// the api version is in the high bits, the compress mode and codec are ignored
+			version := WithApiVersion(WithCodec(AllCompress, CodecSnappy), tc.apiVersion)
+			got := ""
+			if handler, ok := c.getHandler(tc.name, version); ok {
+				got, _ = handler.Handle("")
+			}
+			if got != tc.want {
+				t.Errorf("%s version %d served by %q, want %q", tc.name, tc.apiVersion, got, tc.want)
+			}
+		}
+	}
+	check()
+	if got := fmt.Sprint(c.Handlers()); got != "[{metric [1]} {rule [0 2]}]" {
+		t.Fatalf("handlers %s", got)
+	}
+
+	if !c.RemoveVersionedHandler("rule", 2) || c.RemoveVersionedHandler("rule", 2) {
+		t.Fatal("RemoveVersionedHandler does not report the removal once")
+	}
+	cases[0].want = "any"
+	check()
+	if !c.RemoveVersionedHandler("metric", 1) || c.RemoveHandler("metric") {
+		t.Fatal("handler name kept once its last version is removed")
+	}
+	if !c.RemoveHandler("rule") || c.RemoveHandler("rule") {
+		t.Fatal("RemoveHandler does not report the removal once")
+	}
+	if handlers := c.Handlers(); len(handlers) != 0 {
+		t.Fatalf("handlers %v left after the removals", handlers)
+	}
+}
+
+func TestHandlerRegistryConcurrent(t *testing.T) {
+	c := &AgwClient{handlers: newHandlerRegistry()}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("handler-%d", i%2)
+			for n := 0; n < 200; n++ {
+				version := uint16(n % 4)
+				c.AddVersionedHandler(name, version, namedHandler(name))
+				c.getHandler(name, WithApiVersion(NoCompress, version))
+				c.Handlers()
+				c.RemoveVersionedHandler(name, version)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -1,6 +1,8 @@
 package gateway
 
 import (
+	"errors"
+	"sync"
 	"time"
 )
 
@@ -21,11 +23,24 @@ func runHeartBeatCoroutine(this *AgwClient) {
 
 	for {
 		for i := uint32(0); i < this.pool.size; i++ {
-			conn, err := this.pool.get()
+			conn, err := this.pool.getById(i)
+			if err == nil && conn.heartbeatMissed(this.config.MaxMissedHeartbeats) {
+				logWarnf("[AGW] Connection %d missed %d heartbeats, close and redial it",
+					conn.connId, conn.missedHeartbeats())
+				conn.close()
+				conn, err = this.pool.getById(i)
+			}
 
 			if err != nil {
+				var unavailable *UnavailableError
+				if errors.As(err, &unavailable) {
+					// the slot is backing off, its reconnect timer will redial
+					continue
+				}
 				logWarnf("get connection error:%s", err.Error())
-				time.Sleep(time.Millisecond * ErrorSleepMs)
+				if !this.sleep(time.Millisecond * ErrorSleepMs) {
+					return
+				}
 				continue
 			}
 
@@ -33,7 +48,7 @@ func runHeartBeatCoroutine(this *AgwClient) {
 			msg.SetReqId(generateId())
 			msg.SetMessageType(MessageTypeHeartbeat)
 			msg.SetMessageDirection(MessageDirectionRequest)
-			msg.SetClientIp(StringIpToUint64(this.config.ClientIp))
+			msg.SetClientAddr(this.config.ClientIp)
 			msg.SetClientVpcId(this.config.ClientVpcId)
 			msg.SetServerName(HeartbeatServerName)
 			msg.SetTimeoutMs(HeartbeatTimeoutMs)
@@ -43,14 +58,175 @@ func runHeartBeatCoroutine(this *AgwClient) {
 			msg.SetOuterReqId("noReqIdForHB")
 			msg.SetBody(HeartbeatMessageBody)
 
+			conn.onPing(msg.ReqId())
 			err = conn.write(msg)
 			if err != nil {
-				time.Sleep(time.Millisecond * ErrorSleepMs)
+				if !this.sleep(time.Millisecond * ErrorSleepMs) {
+					return
+				}
 				continue
 			}
 		}
 
-		time.Sleep(time.Millisecond * EachLoopSleepMs)
+		if !this.sleep(this.heartbeatInterval()) {
+			return
+		}
+	}
+
+}
+
+func (c *AgwClient) heartbeatInterval() time.Duration {
+	if c.config.HeartbeatInterval > 0 {
+		return c.config.HeartbeatInterval
+	}
+	return time.Millisecond * EachLoopSleepMs
+}
+
+// heartbeat tracks the heartbeat round-trips of a connection
+type heartbeat struct {
+	lock     sync.Mutex
+	pingId   uint64
+	pingSent time.Time
+	// whether the pending ping has been answered
+	answered bool
+	lastPong time.Time
+	rtt      time.Duration
+	missed   int
+}
+
+// onPing records a heartbeat request, a pending one which has not been answered is missed.
+func (c *AgwConn) onPing(reqId uint64) {
+	hb := &c.heartbeat
+	hb.lock.Lock()
+	defer hb.lock.Unlock()
+	if hb.pingId != 0 && !hb.answered {
+		hb.missed++
+	}
+	hb.pingId = reqId
+	hb.pingSent = time.Now()
+	hb.answered = false
+}
+
+// onPong records a heartbeat response, any response proves the connection alive, the
+// round-trip time is measured on the response of the latest ping only.
+func (c *AgwConn) onPong(msg *AgwMessage) {
+	hb := &c.heartbeat
+	hb.lock.Lock()
+	defer hb.lock.Unlock()
+	now := time.Now()
+	hb.lastPong = now
+	hb.missed = 0
+	if msg.ReqId() == hb.pingId && !hb.answered {
+		hb.answered = true
+		hb.rtt = now.Sub(hb.pingSent)
+	}
+}
+
+// heartbeatMissed tells whether the connection is considered dead: the latest ping is
+// still pending and max pings in a row have not been answered. A gateway which never
+// answered a heartbeat on this connection is not judged, as older gateways do not.
+func (c *AgwConn) heartbeatMissed(max int) bool {
+	if max <= 0 {
+		max = default_max_missed_heartbeats
+	}
+	hb := &c.heartbeat
+	hb.lock.Lock()
+	defer hb.lock.Unlock()
+	if hb.lastPong.IsZero() {
+		return false
+	}
+	missed := hb.missed
+	if hb.pingId != 0 && !hb.answered {
+		missed++
+	}
+	return missed >= max
+}
+
+func (c *AgwConn) missedHeartbeats() int {
+	hb := &c.heartbeat
+	hb.lock.Lock()
+	defer hb.lock.Unlock()
+	missed := hb.missed
+	if hb.pingId != 0 && !hb.answered {
+		missed++
+	}
+	return missed
+}
+
+// sleep waits for the given duration, it returns false if the client is closed meanwhile.
+func (c *AgwClient) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.closed:
+		logInfo("AgwClient closed, exit heartbeat coroutine")
+		return false
+	}
+}
+
+// ConnStats is a snapshot of one connection slot of the pool, for diagnostics.
+type ConnStats struct {
+	ConnId uint32
+	// State is one of "idle", "connecting", "ready" and "failed"
+	State       string
+	ConnectedAt time.Time
+	// Endpoint is the gateway endpoint of the connection
+	Endpoint string
+	InFlight int32
+	// LastPong is the time of the last heartbeat response, zero if none arrived yet
+	LastPong         time.Time
+	Rtt              time.Duration
+	MissedHeartbeats int
+	// Capabilities are negotiated by the handshake of the connection, nil for
+	// the legacy protocol
+	Capabilities *Capabilities
+	// Codec is the name of the codec compressing the requests of the connection
+	Codec string
+	// RetryAt and LastError are set while a failed slot is backing off
+	RetryAt   time.Time
+	LastError string
+}
+
+// ConnStats returns the state and heartbeat figures of every pooled connection. It
+// does not wait for the dials in progress, their slots are "connecting".
+func (c *AgwClient) ConnStats() []ConnStats {
+	if c.pool == nil {
+		return nil
 	}
+	stats := make([]ConnStats, 0, c.pool.size)
+	for _, s := range c.pool.slots {
+		stat := ConnStats{ConnId: s.connId}
+		s.lock.Lock()
+		stat.State = connStateNames[s.state]
+		if s.state == connStateFailed {
+			stat.RetryAt = s.retryAt
+			if s.lastErr != nil {
+				stat.LastError = s.lastErr.Error()
+			}
+		}
+		s.lock.Unlock()
 
+		if conn := c.pool.load(s.connId); conn != nil {
+			stat.ConnectedAt = conn.createdAt
+			stat.Endpoint = c.endpoints.endpoints[conn.endpoint].String()
+			stat.InFlight = conn.inFlightCount()
+			hb := &conn.heartbeat
+			hb.lock.Lock()
+			stat.LastPong = hb.lastPong
+			stat.Rtt = hb.rtt
+			hb.lock.Unlock()
+			stat.MissedHeartbeats = conn.missedHeartbeats()
+			if caps := conn.capabilities(); caps != nil {
+				shared := *caps
+				stat.Capabilities = &shared
+			}
+			if codec, ok := getCodec(c.requestCodec(conn)); ok {
+				stat.Codec = codec.Name()
+			}
+		}
+		stats = append(stats, stat)
+	}
+	return stats
 }
@@ -0,0 +1,242 @@
+package gateway
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Phases of the latency histograms, named after the marks of the timing logs
+const (
+	// PhaseCall is a whole call of the client, retries included
+	PhaseCall = "client_call_gateway"
+	// PhaseBeforeHandle is the wait of a request of the gateway until its handler runs
+	PhaseBeforeHandle = "before_handle"
+	// PhaseAfterHandle is the run of the handler of a request of the gateway
+	PhaseAfterHandle = "after_handle"
+)
+
+// latencyBuckets are the upper bounds of the histogram buckets, a last bucket counts
+// the latencies above them.
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// histogram counts latencies in the fixed latencyBuckets
+type histogram struct {
+	// accessed atomically, kept first for the 64-bit alignment
+	count  uint64
+	sum    int64
+	max    int64
+	counts []uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool {
+		return d <= latencyBuckets[i]
+	})
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+	atomic.AddUint64(&h.count, 1)
+	for {
+		current := atomic.LoadInt64(&h.max)
+		if int64(d) <= current || atomic.CompareAndSwapInt64(&h.max, current, int64(d)) {
+			return
+		}
+	}
+}
+
+func (h *histogram) snapshot() HistogramStats {
+	stats := HistogramStats{
+		Count:   atomic.LoadUint64(&h.count),
+		Sum:     time.Duration(atomic.LoadInt64(&h.sum)),
+		Max:     time.Duration(atomic.LoadInt64(&h.max)),
+		Buckets: make([]Bucket, len(h.counts)),
+	}
+	for i := range h.counts {
+		stats.Buckets[i].Count = atomic.LoadUint64(&h.counts[i])
+		if i < len(latencyBuckets) {
+			stats.Buckets[i].UpperBound = latencyBuckets[i]
+		}
+	}
+	return stats
+}
+
+// Bucket counts the latencies above the bound of the previous bucket up to UpperBound,
+// the UpperBound of the last bucket is zero as it has no bound.
+type Bucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+// HistogramStats is a snapshot of a latency histogram. The fields are read one by
+// one, so Count may be off by the latencies observed while taking the snapshot.
+type HistogramStats struct {
+	Count   uint64
+	Sum     time.Duration
+	Max     time.Duration
+	Buckets []Bucket
+}
+
+// Mean returns the average latency, zero if none was observed
+func (h HistogramStats) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Quantile estimates the q quantile, 0 < q <= 1, as the upper bound of the bucket
+// it falls in. Max is returned for the last bucket.
+func (h HistogramStats) Quantile(q float64) time.Duration {
+	var total uint64
+	for _, b := range h.Buckets {
+		total += b.Count
+	}
+	if total == 0 {
+		return 0
+	}
+	// the nearest rank, the 0.999 quantile of 100 latencies is the largest one
+	rank := uint64(math.Ceil(q * float64(total)))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for _, b := range h.Buckets {
+		seen += b.Count
+		if seen >= rank && b.UpperBound > 0 {
+			return b.UpperBound
+		}
+	}
+	return h.Max
+}
+
+// metrics is the registry of the counters and histograms of a client
+type metrics struct {
+	// accessed atomically, kept first for the 64-bit alignment
+	calls         uint64
+	errors        uint64
+	retries       uint64
+	timeouts      uint64
+	reconnects    uint64
+	decodeErrors  uint64
+	inFlightCalls int64
+
+	lock     sync.RWMutex
+	handlers map[string]*histogram
+	phases   map[string]*histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		handlers: make(map[string]*histogram),
+		phases:   make(map[string]*histogram),
+	}
+}
+
+func (m *metrics) observeCall(rpcMetadata RpcMetadata, d time.Duration, err error) {
+	atomic.AddUint64(&m.calls, 1)
+	if err != nil {
+		atomic.AddUint64(&m.errors, 1)
+	}
+	m.histogram(m.handlers, rpcMetadata.ServerName+"_"+rpcMetadata.HandlerName).observe(d)
+	m.observePhase(PhaseCall, d)
+}
+
+func (m *metrics) observePhase(phase string, d time.Duration) {
+	m.histogram(m.phases, phase).observe(d)
+}
+
+// histogram returns the histogram of key in histograms, it is created on first use
+func (m *metrics) histogram(histograms map[string]*histogram, key string) *histogram {
+	m.lock.RLock()
+	h, ok := histograms[key]
+	m.lock.RUnlock()
+	if ok {
+		return h
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if h, ok = histograms[key]; !ok {
+		h = newHistogram()
+		histograms[key] = h
+	}
+	return h
+}
+
+func (m *metrics) snapshot(histograms map[string]*histogram) map[string]HistogramStats {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	stats := make(map[string]HistogramStats, len(histograms))
+	for key, h := range histograms {
+		stats[key] = h.snapshot()
+	}
+	return stats
+}
+
+// Stats is a snapshot of the metrics of a client, the counters grow from the start of
+// the client.
+type Stats struct {
+	// Calls counts the calls of the client, Errors the ones which failed
+	Calls  uint64
+	Errors uint64
+	// Retries counts the attempts of the calls after their first one
+	Retries uint64
+	// Timeouts counts the attempts which got no response in time
+	Timeouts uint64
+	// Reconnects counts the connections redialed after they had been lost
+	Reconnects uint64
+	// DecodeErrors counts the bad frames received, each closes its connection
+	DecodeErrors uint64
+	// InFlightCalls is the number of calls running
+	InFlightCalls int64
+	// InFlight is the number of requests waiting for their response, by connection id
+	InFlight map[uint32]int32
+	// Handlers holds the latency of the calls, by "serverName_handlerName"
+	Handlers map[string]HistogramStats
+	// Phases holds the latency of the phases, see PhaseCall
+	Phases map[string]HistogramStats
+}
+
+// Stats returns a snapshot of the metrics of the client.
+func (c *AgwClient) Stats() Stats {
+	m := c.metrics
+	stats := Stats{
+		Calls:         atomic.LoadUint64(&m.calls),
+		Errors:        atomic.LoadUint64(&m.errors),
+		Retries:       atomic.LoadUint64(&m.retries),
+		Timeouts:      atomic.LoadUint64(&m.timeouts),
+		Reconnects:    atomic.LoadUint64(&m.reconnects),
+		DecodeErrors:  atomic.LoadUint64(&m.decodeErrors),
+		InFlightCalls: atomic.LoadInt64(&m.inFlightCalls),
+		InFlight:      make(map[uint32]int32),
+		Handlers:      m.snapshot(m.handlers),
+		Phases:        m.snapshot(m.phases),
+	}
+	if c.pool != nil {
+		for i := uint32(0); i < c.pool.size; i++ {
+			if conn := c.pool.load(i); conn != nil {
+				stats.InFlight[i] = conn.inFlightCount()
+			}
+		}
+	}
+	return stats
+}
@@ -0,0 +1,144 @@
+package gateway
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	h := newHistogram()
+	observed := []time.Duration{
+		0,
+		time.Millisecond,
+		time.Millisecond + 1,
+		7 * time.Millisecond,
+		time.Second,
+		10 * time.Second,
+		time.Minute,
+	}
+	for _, d := range observed {
+		h.observe(d)
+	}
+	stats := h.snapshot()
+	if len(stats.Buckets) != len(latencyBuckets)+1 {
+		t.Fatalf("%d buckets, want %d", len(stats.Buckets), len(latencyBuckets)+1)
+	}
+	// a latency equal to a bound falls in the bucket of the bound
+	want := map[time.Duration]uint64{
+		time.Millisecond:      2,
+		2 * time.Millisecond:  1,
+		10 * time.Millisecond: 1,
+		time.Second:           1,
+		10 * time.Second:      1,
+		time.Duration(0):      1,
+	}
+	for i, b := range stats.Buckets {
+		if i < len(latencyBuckets) && b.UpperBound != latencyBuckets[i] {
+			t.Fatalf("bucket %d bounded by %v, want %v", i, b.UpperBound, latencyBuckets[i])
+		}
+		if b.Count != want[b.UpperBound] {
+			t.Errorf("bucket up to %v counts %d, want %d", b.UpperBound, b.Count, want[b.UpperBound])
+		}
+	}
+
+	var sum time.Duration
+	for _, d := range observed {
+		sum += d
+	}
+	if stats.Count != uint64(len(observed)) || stats.Sum != sum || stats.Max != time.Minute {
+		t.Fatalf("count %d, sum %v, max %v", stats.Count, stats.Sum, stats.Max)
+	}
+	if mean := stats.Mean(); mean != sum/time.Duration(len(observed)) {
+		t.Fatalf("mean %v", mean)
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	if q := newHistogram().snapshot().Quantile(0.99); q != 0 {
+		t.Fatalf("quantile of an empty histogram %v", q)
+	}
+	if mean := newHistogram().snapshot().Mean(); mean != 0 {
+		t.Fatalf("mean of an empty histogram %v", mean)
+	}
+
+	h := newHistogram()
+	for i := 0; i < 90; i++ {
+		h.observe(3 * time.Millisecond)
+	}
+	for i := 0; i < 9; i++ {
+		h.observe(300 * time.Millisecond)
+	}
+	h.observe(42 * time.Second)
+	stats := h.snapshot()
+	cases := map[float64]time.Duration{
+		0:     5 * time.Millisecond,
+		0.5:   5 * time.Millisecond,
+		0.9:   5 * time.Millisecond,
+		0.91:  500 * time.Millisecond,
+		0.99:  500 * time.Millisecond,
+		0.999: 42 * time.Second,
+		1:     42 * time.Second,
+	}
+	for q, want := range cases {
+		if got := stats.Quantile(q); got != want {
+			t.Errorf("quantile %v is %v, want %v", q, got, want)
+		}
+	}
+}
+
+func TestHistogramConcurrent(t *testing.T) {
+	h := newHistogram()
+	var wg sync.WaitGroup
+	for i := 1; i <= 8; i++ {
+		wg.Add(1)
+		go func(d time.Duration) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				h.observe(d)
+			}
+		}(time.Duration(i) * time.Millisecond)
+	}
+	wg.Wait()
+	stats := h.snapshot()
+	var counted uint64
+	for _, b := range stats.Buckets {
+		counted += b.Count
+	}
+	if stats.Count != 8000 || counted != 8000 {
+		t.Fatalf("count %d, %d in the buckets, want 8000", stats.Count, counted)
+	}
+	if stats.Max != 8*time.Millisecond || stats.Sum != 36000*time.Millisecond {
+		t.Fatalf("max %v, sum %v", stats.Max, stats.Sum)
+	}
+}
+
+func TestMetricsObserveCall(t *testing.T) {
+	m := newMetrics()
+	rule := RpcMetadata{ServerName: "Sentinel", HandlerName: "rule"}
+	m.observeCall(rule, 2*time.Millisecond, nil)
+	m.observeCall(rule, 20*time.Millisecond, errors.New("failed"))
+	m.observeCall(RpcMetadata{ServerName: "Topology", HandlerName: "report"}, time.Millisecond, nil)
+	m.observePhase(PhaseBeforeHandle, time.Millisecond)
+
+	if m.calls != 3 || m.errors != 1 {
+		t.Fatalf("%d calls, %d errors, want 3 and 1", m.calls, m.errors)
+	}
+	handlers := m.snapshot(m.handlers)
+	if len(handlers) != 2 || handlers["Sentinel_rule"].Count != 2 || handlers["Topology_report"].Count != 1 {
+		t.Fatalf("handler histograms %v", handlers)
+	}
+	if max := handlers["Sentinel_rule"].Max; max != 20*time.Millisecond {
+		t.Fatalf("max of Sentinel_rule %v", max)
+	}
+	phases := m.snapshot(m.phases)
+	if phases[PhaseCall].Count != 3 || phases[PhaseBeforeHandle].Count != 1 || len(phases) != 2 {
+		t.Fatalf("phase histograms %v", phases)
+	}
+	// the snapshot is a copy
+	m.observePhase(PhaseBeforeHandle, time.Millisecond)
+	if phases[PhaseBeforeHandle].Count != 1 {
+		t.Fatal("snapshot follows the histogram")
+	}
+}
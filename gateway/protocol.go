@@ -6,13 +6,17 @@ import (
 	"errors"
 	"fmt"
 	"github.com/sumansoul/aliyun-ahas-go-sdk/logger"
-	"github.com/sumansoul/aliyun-ahas-go-sdk/tools"
+	"io"
+	"net"
 	"runtime/debug"
+	"sync"
 )
 
 const (
 	MessageTypeHeartbeat = 1
 	MessageTypeBiz       = 2
+	// MessageTypeStream frames carry the chunks of a streamed body, see StreamHandler
+	MessageTypeStream = 3
 
 	MessageDirectionRequest  = 1
 	MessageDirectionResponse = 2
@@ -25,6 +29,59 @@ const (
 	ResponseCompress = 4
 )
 
+const (
+	compressModeMask uint32 = 0x7f
+	// versionFlagStringIp is set on the wire version of frames whose client is not
+	// IPv4: clientIp is zero and the address follows the version as a length
+	// prefixed string. The flag is dropped by Decode, Version never returns it.
+	versionFlagStringIp uint32 = 0x80
+)
+
+const (
+	// bodyLength, reqId, messageType, messageDirection, caller, clientIp and clientVpcIdLength
+	frameHeaderSize = 27
+	// frameHeaderSize plus the fixed size fields behind clientVpcId
+	frameFixedSize = frameHeaderSize + 36
+)
+
+var (
+	// scratch buffers for encoded frames, received fields and compression
+	bufferPool = sync.Pool{New: func() interface{} {
+		buf := make([]byte, 0, default_pooled_buffer_size)
+		return &buf
+	}}
+)
+
+// FrameLimits bounds the sizes read from the wire by AgwMessage.Decode, zero fields use the defaults.
+type FrameLimits struct {
+	// MaxBodySize bounds the body as sent on the wire, i.e. before decompression
+	MaxBodySize uint32
+	// MaxFieldSize bounds each string field of the header
+	MaxFieldSize uint32
+	// MaxDecompressedSize bounds the body after decompression
+	MaxDecompressedSize uint32
+}
+
+func (l FrameLimits) withDefaults() FrameLimits {
+	if l.MaxBodySize == 0 {
+		l.MaxBodySize = default_max_body_size
+	}
+	if l.MaxFieldSize == 0 {
+		l.MaxFieldSize = default_max_field_size
+	}
+	if l.MaxDecompressedSize == 0 {
+		l.MaxDecompressedSize = default_max_decompressed_size
+	}
+	return l
+}
+
+func checkLength(field string, length uint32, limit uint32) error {
+	if length > limit {
+		return &DecodeError{Field: field, Size: uint64(length), Limit: uint64(limit), Err: ErrFrameTooLarge}
+	}
+	return nil
+}
+
 type AgwMessage struct {
 	tsUtil *timestampUtil
 
@@ -58,6 +115,8 @@ type AgwMessage struct {
 	outerReqIdLength uint32
 	outerReqId       string
 	version          uint32
+	// only on the wire if versionFlagStringIp is set
+	clientIpString string
 
 	body string
 }
@@ -102,6 +161,29 @@ func (m *AgwMessage) SetClientIp(clientIp uint64) {
 	m.clientIp = clientIp
 }
 
+// ClientIpString returns the address of a client which is not IPv4, e.g. IPv6,
+// empty for IPv4 clients which are identified by ClientIp.
+func (m *AgwMessage) ClientIpString() string {
+	return m.clientIpString
+}
+
+func (m *AgwMessage) SetClientIpString(clientIpString string) {
+	m.clientIpString = clientIpString
+}
+
+// SetClientAddr sets ClientIp for an IPv4 address, ClientIpString otherwise.
+// ClientIpString is only sent on the connections which negotiated StringIp, see
+// Capabilities, the legacy zero ClientIp is sent on the others.
+func (m *AgwMessage) SetClientAddr(ip string) {
+	if ip == "" || net.ParseIP(ip).To4() != nil {
+		m.clientIp = StringIpToUint64(ip)
+		m.clientIpString = ""
+		return
+	}
+	m.clientIp = 0
+	m.clientIpString = ip
+}
+
 func (m *AgwMessage) ClientVpcId() string {
 	return m.clientVpcId
 }
@@ -198,336 +280,287 @@ func NewAgwMessage() *AgwMessage {
 	}
 }
 
+// Decode reads one frame with the default FrameLimits.
 func (m *AgwMessage) Decode(br *bufio.Reader) error {
+	return m.DecodeLimited(br, FrameLimits{})
+}
+
+// DecodeLimited reads one frame, a length beyond limits fails with a *DecodeError
+// before anything is allocated for it.
+func (m *AgwMessage) DecodeLimited(br *bufio.Reader, limits FrameLimits) (decodeErr error) {
 	defer func() {
 		if err := recover(); err != nil {
 			logError("[AgwMessage] Decode recover err: %v, stack: %s", err, debug.Stack())
+			decodeErr = &DecodeError{Field: "frame", Err: fmt.Errorf("%w: %v", ErrMalformedFrame, err)}
 		}
 	}()
+	limits = limits.withDefaults()
 
-	bodyLength := [4]byte{}
-	for m := 0; m < len(bodyLength); {
-		n, err := br.Read(bodyLength[m:])
-		if e := handleReadResult(n, err); e != nil {
-			return e
-		}
-		m += n
-	}
-	m.bodyLength = uint32(binary.BigEndian.Uint32(bodyLength[:]))
-
-	reqId := [8]byte{}
-	for m := 0; m < len(reqId); {
-		n, err := br.Read(reqId[m:])
-		if e := handleReadResult(n, err); e != nil {
-			return e
-		}
-		m += n
-	}
-	m.reqId = uint64(binary.BigEndian.Uint64(reqId[:]))
-
-	messageType, err := br.ReadByte()
-	if err != nil {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
 		return err
 	}
-	m.messageType = uint8(messageType)
-
-	messageDirection, err := br.ReadByte()
-	if err != nil {
+	m.bodyLength = binary.BigEndian.Uint32(header[0:])
+	if err := checkLength("body", m.bodyLength, limits.MaxBodySize); err != nil {
 		return err
 	}
-	m.messageDirection = uint8(messageDirection)
-
-	caller, err := br.ReadByte()
-	if err != nil {
+	m.reqId = binary.BigEndian.Uint64(header[4:])
+	m.messageType = header[12]
+	m.messageDirection = header[13]
+	m.caller = header[14]
+	m.clientIp = binary.BigEndian.Uint64(header[15:])
+	m.clientVpcIdLength = binary.BigEndian.Uint32(header[23:])
+	if err := checkLength("clientVpcId", m.clientVpcIdLength, limits.MaxFieldSize); err != nil {
 		return err
 	}
-	m.caller = uint8(caller)
 
-	clientIp := [8]byte{}
-	for m := 0; m < len(clientIp); {
-		n, err := br.Read(clientIp[m:])
-		if e := handleReadResult(n, err); e != nil {
-			return e
-		}
-		m += n
+	buf := getBuffer()
+	defer putBuffer(buf)
+	d := &frameDecoder{r: br, limits: limits, buf: buf}
+	m.clientVpcId = string(d.read(m.clientVpcIdLength))
+	m.serverNameLength, m.serverName = d.string("serverName")
+	m.timeoutMs = d.uint32()
+	m.clientProcessFlagLength, m.clientProcessFlag = d.string("clientProcessFlag")
+	m.innerCode = d.uint32()
+	m.innerMsgLength, m.innerMsg = d.string("innerMsg")
+	m.connectionId = d.uint32()
+	m.handlerNameLength, m.handlerName = d.string("handlerName")
+	m.outerReqIdLength, m.outerReqId = d.string("outerReqId")
+	m.version = d.uint32()
+	if m.version&versionFlagStringIp != 0 {
+		m.version &^= versionFlagStringIp
+		_, m.clientIpString = d.string("clientIpString")
 	}
-	m.clientIp = uint64(binary.BigEndian.Uint64(clientIp[:]))
-
-	clientVpcIdLength := [4]byte{}
-	for m := 0; m < len(clientVpcIdLength); {
-		n, err := br.Read(clientVpcIdLength[m:])
-		if e := handleReadResult(n, err); e != nil {
-			return e
-		}
-		m += n
+	body := d.read(m.bodyLength)
+	if d.err != nil {
+		return d.err
 	}
-	m.clientVpcIdLength = uint32(binary.BigEndian.Uint32(clientVpcIdLength[:]))
 
-	clientVpcId := make([]byte, m.clientVpcIdLength)
-	for m := 0; m < len(clientVpcId); {
-		n, err := br.Read(clientVpcId[m:])
-		if e := handleReadResult(n, err); e != nil {
-			return e
-		}
-		m += n
+	if m.compressed() {
+		var err error
+		m.body, err = decompressBody(codecOf(m.version), body, limits.MaxDecompressedSize)
+		return err
 	}
-	m.clientVpcId = string(clientVpcId)
+	m.body = string(body)
+	return nil
+}
 
-	serverNameLength := [4]byte{}
-	for m := 0; m < len(serverNameLength); {
-		n, err := br.Read(serverNameLength[m:])
-		if e := handleReadResult(n, err); e != nil {
-			return e
-		}
-		m += n
-	}
-	m.serverNameLength = uint32(binary.BigEndian.Uint32(serverNameLength[:]))
+// frameDecoder reads the fields behind the fixed header in order, the first error
+// sticks and the later reads return zero values.
+type frameDecoder struct {
+	r      io.Reader
+	limits FrameLimits
+	// scratch space shared by the fields, valid until the next read
+	buf *[]byte
+	err error
+}
 
-	serverName := make([]byte, m.serverNameLength)
-	for m := 0; m < len(serverName); {
-		n, err := br.Read(serverName[m:])
-		if e := handleReadResult(n, err); e != nil {
-			return e
-		}
-		m += n
+func (d *frameDecoder) read(n uint32) []byte {
+	if d.err != nil {
+		return nil
 	}
-	m.serverName = string(serverName)
-
-	timeoutMs := [4]byte{}
-	for m := 0; m < len(timeoutMs); {
-		n, err := br.Read(timeoutMs[m:])
-		if e := handleReadResult(n, err); e != nil {
-			return e
-		}
-		m += n
+	buf := *d.buf
+	if uint32(cap(buf)) < n {
+		buf = make([]byte, n)
+	} else {
+		buf = buf[:n]
 	}
-	m.timeoutMs = uint32(binary.BigEndian.Uint32(timeoutMs[:]))
-
-	clientProcessFlagLength := [4]byte{}
-	for m := 0; m < len(clientProcessFlagLength); {
-		n, err := br.Read(clientProcessFlagLength[m:])
-		if e := handleReadResult(n, err); e != nil {
-			return e
-		}
-		m += n
+	*d.buf = buf
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		d.err = err
+		return nil
 	}
-	m.clientProcessFlagLength = uint32(binary.BigEndian.Uint32(clientProcessFlagLength[:]))
+	return buf
+}
 
-	clientProcessFlag := make([]byte, m.clientProcessFlagLength)
-	for m := 0; m < len(clientProcessFlag); {
-		n, err := br.Read(clientProcessFlag[m:])
-		if e := handleReadResult(n, err); e != nil {
-			return e
-		}
-		m += n
+func (d *frameDecoder) uint32() uint32 {
+	b := d.read(4)
+	if d.err != nil {
+		return 0
 	}
-	m.clientProcessFlag = string(clientProcessFlag)
+	return binary.BigEndian.Uint32(b)
+}
 
-	innerCode := [4]byte{}
-	for m := 0; m < len(innerCode); {
-		n, err := br.Read(innerCode[m:])
-		if e := handleReadResult(n, err); e != nil {
-			return e
-		}
-		m += n
+// string reads a length prefixed field
+func (d *frameDecoder) string(field string) (uint32, string) {
+	length := d.uint32()
+	if d.err != nil {
+		return 0, ""
 	}
-	m.innerCode = uint32(binary.BigEndian.Uint32(innerCode[:]))
-
-	innerMsgLength := [4]byte{}
-	for m := 0; m < len(innerMsgLength); {
-		n, err := br.Read(innerMsgLength[m:])
-		if e := handleReadResult(n, err); e != nil {
-			return e
-		}
-		m += n
+	if d.err = checkLength(field, length, d.limits.MaxFieldSize); d.err != nil {
+		return length, ""
 	}
-	m.innerMsgLength = uint32(binary.BigEndian.Uint32(innerMsgLength[:]))
+	return length, string(d.read(length))
+}
 
-	innerMsg := make([]byte, m.innerMsgLength)
-	for m := 0; m < len(innerMsg); {
-		n, err := br.Read(innerMsg[m:])
-		if e := handleReadResult(n, err); e != nil {
-			return e
-		}
-		m += n
+// decompressBody decompresses the body with the codec of the frame, the codec stops
+// as soon as the output exceeds limit, so that a small gzip bomb can not blow up the memory.
+func decompressBody(id uint8, body []byte, limit uint32) (string, error) {
+	codec, ok := getCodec(id)
+	if !ok {
+		return "", &DecodeError{Field: "version", Err: fmt.Errorf("%w: unknown codec %d", ErrMalformedFrame, id)}
 	}
-	m.innerMsg = string(innerMsg)
-
-	connectionId := [4]byte{}
-	for m := 0; m < len(connectionId); {
-		n, err := br.Read(connectionId[m:])
-		if e := handleReadResult(n, err); e != nil {
-			return e
-		}
-		m += n
+	decompressed, err := codec.Decompress(body, limit)
+	if errors.Is(err, ErrFrameTooLarge) {
+		return "", &DecodeError{Field: "body", Size: uint64(limit) + 1, Limit: uint64(limit), Err: ErrFrameTooLarge}
 	}
-	m.connectionId = uint32(binary.BigEndian.Uint32(connectionId[:]))
-
-	handlerNameLength := [4]byte{}
-	for m := 0; m < len(handlerNameLength); {
-		n, err := br.Read(handlerNameLength[m:])
-		if e := handleReadResult(n, err); e != nil {
-			return e
-		}
-		m += n
+	if err != nil {
+		return "", &DecodeError{Field: "body", Err: fmt.Errorf("%w: %s: %v", ErrMalformedFrame, codec.Name(), err)}
 	}
-	m.handlerNameLength = uint32(binary.BigEndian.Uint32(handlerNameLength[:]))
+	return decompressed, nil
+}
 
-	handlerName := make([]byte, m.handlerNameLength)
-	for m := 0; m < len(handlerName); {
-		n, err := br.Read(handlerName[m:])
-		if e := handleReadResult(n, err); e != nil {
-			return e
-		}
-		m += n
-	}
-	m.handlerName = string(handlerName)
+// compressed tells whether the body is compressed on the wire, according to the version
+func (m *AgwMessage) compressed() bool {
+	return m.compressedWith(m.version)
+}
 
-	outerReqIdLength := [4]byte{}
-	for m := 0; m < len(outerReqIdLength); {
-		n, err := br.Read(outerReqIdLength[m:])
-		if e := handleReadResult(n, err); e != nil {
-			return e
-		}
-		m += n
+func (m *AgwMessage) compressedWith(version uint32) bool {
+	switch compressMode(version) {
+	case AllCompress:
+		return true
+	case RequestCompress:
+		return m.messageDirection == MessageDirectionRequest
+	case ResponseCompress:
+		return m.messageDirection == MessageDirectionResponse
 	}
-	m.outerReqIdLength = uint32(binary.BigEndian.Uint32(outerReqIdLength[:]))
+	return false
+}
 
-	outerReqId := make([]byte, m.outerReqIdLength)
-	for m := 0; m < len(outerReqId); {
-		n, err := br.Read(outerReqId[m:])
-		if e := handleReadResult(n, err); e != nil {
-			return e
-		}
-		m += n
+// wireVersion drops the compression of the direction of this frame if the body is
+// shorter than threshold, the compression of the other direction is kept.
+func (m *AgwMessage) wireVersion(threshold int) uint32 {
+	if threshold <= 0 || len(m.body) >= threshold || !m.compressed() {
+		return m.version
 	}
-	m.outerReqId = string(outerReqId)
-
-	version := [4]byte{}
-	for m := 0; m < len(version); {
-		n, err := br.Read(version[m:])
-		if e := handleReadResult(n, err); e != nil {
-			return e
+	mode := uint32(NoCompress)
+	if compressMode(m.version) == AllCompress {
+		if m.messageDirection == MessageDirectionRequest {
+			mode = ResponseCompress
+		} else {
+			mode = RequestCompress
 		}
-		m += n
 	}
-	m.version = uint32(binary.BigEndian.Uint32(version[:]))
+	return m.version&^compressModeMask | mode
+}
 
-	body := make([]byte, m.bodyLength)
-	for m := 0; m < len(body); {
-		n, err := br.Read(body[m:])
-		if e := handleReadResult(n, err); e != nil {
-			return e
-		}
-		m += n
-	}
-	if m.version == AllCompress {
-		m.body, err = tools.DecompressByGzip(body)
-	} else if m.version == RequestCompress && m.messageDirection == MessageDirectionRequest {
-		m.body, err = tools.DecompressByGzip(body)
-	} else if m.version == ResponseCompress && m.messageDirection == MessageDirectionResponse {
-		m.body, err = tools.DecompressByGzip(body)
-	} else {
-		m.body = string(body)
+// Encode returns the frame in a new slice, false if the body can not be compressed.
+func (m *AgwMessage) Encode() ([]byte, bool) {
+	data, err := m.appendFrame(nil, 0)
+	if err != nil {
+		logger.Warnf("[AGW] Compress message err, %v", err)
+		return data, false
 	}
-	return nil
+	return data, true
 }
 
-func handleReadResult(n int, err error) error {
+// WriteTo writes the frame to w with a single Write, the frame is built in a pooled buffer.
+func (m *AgwMessage) WriteTo(w io.Writer) (int64, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	data, err := m.appendFrame((*buf)[:0], 0)
+	*buf = data
 	if err != nil {
-		return err
+		return 0, err
 	}
-
-	if n <= 0 {
-		return errors.New("read bytes less than 0")
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+// appendFrame appends the frame to dst, which is grown once for the whole frame.
+// Bodies shorter than threshold are not compressed, see wireVersion.
+// On error dst is returned without any byte of the frame.
+func (m *AgwMessage) appendFrame(dst []byte, threshold int) ([]byte, error) {
+	version := m.wireVersion(threshold)
+	start := len(dst)
+	size := frameFixedSize + len(m.clientVpcId) + len(m.serverName) + len(m.clientProcessFlag) +
+		len(m.innerMsg) + len(m.handlerName) + len(m.outerReqId) + len(m.body)
+	if m.clientIpString != "" {
+		version |= versionFlagStringIp
+		size += 4 + len(m.clientIpString)
 	}
-
-	return nil
-}
-
-func (m *AgwMessage) Encode() ([]byte, bool) {
-
-	data := make([]byte, 0)
-
-	var body []byte
-	// 根据 version 来判断是否压缩
-	var err error
-	if m.version == AllCompress {
-		body, err = tools.CompressByGzip(m.body)
-	} else if m.version == RequestCompress && m.messageDirection == MessageDirectionRequest {
-		body, err = tools.CompressByGzip(m.body)
-	} else if m.version == ResponseCompress && m.messageDirection == MessageDirectionResponse {
-		body, err = tools.CompressByGzip(m.body)
-	} else {
-		body = []byte(m.body)
+	if cap(dst)-start < size {
+		grown := make([]byte, start, start+size)
+		copy(grown, dst)
+		dst = grown
 	}
 
-	data = append(data, make([]byte, 4)...)
-	binary.BigEndian.PutUint32(data[len(data)-4:len(data)], uint32(len(body)))
-
-	data = append(data, make([]byte, 8)...)
-	binary.BigEndian.PutUint64(data[len(data)-8:len(data)], m.reqId)
-
-	data = append(data, byte(m.messageType))
-
-	data = append(data, byte(m.messageDirection))
-
-	data = append(data, byte(m.caller))
-
-	data = append(data, make([]byte, 8)...)
-	binary.BigEndian.PutUint64(data[len(data)-8:len(data)], m.clientIp)
-
-	data = append(data, make([]byte, 4)...)
-	binary.BigEndian.PutUint32(data[len(data)-4:len(data)], uint32(len(m.clientVpcId)))
-
-	data = append(data, m.clientVpcId...)
-
-	data = append(data, make([]byte, 4)...)
-	binary.BigEndian.PutUint32(data[len(data)-4:len(data)], uint32(len(m.serverName)))
-
-	data = append(data, m.serverName...)
-
-	data = append(data, make([]byte, 4)...)
-	binary.BigEndian.PutUint32(data[len(data)-4:len(data)], m.timeoutMs)
-
-	data = append(data, make([]byte, 4)...)
-	binary.BigEndian.PutUint32(data[len(data)-4:len(data)], uint32(len(m.clientProcessFlag)))
-
-	data = append(data, m.clientProcessFlag...)
-
-	data = append(data, make([]byte, 4)...)
-	binary.BigEndian.PutUint32(data[len(data)-4:len(data)], m.innerCode)
+	// the body length is patched below if the body is compressed
+	dst = appendUint32(dst, uint32(len(m.body)))
+	dst = appendUint64(dst, m.reqId)
+	dst = append(dst, m.messageType, m.messageDirection, m.caller)
+	dst = appendUint64(dst, m.clientIp)
+	dst = appendString(dst, m.clientVpcId)
+	dst = appendString(dst, m.serverName)
+	dst = appendUint32(dst, m.timeoutMs)
+	dst = appendString(dst, m.clientProcessFlag)
+	dst = appendUint32(dst, m.innerCode)
+	dst = appendString(dst, m.innerMsg)
+	dst = appendUint32(dst, m.connectionId)
+	dst = appendString(dst, m.handlerName)
+	dst = appendString(dst, m.outerReqId)
+	dst = appendUint32(dst, version)
+	if m.clientIpString != "" {
+		dst = appendString(dst, m.clientIpString)
+	}
 
-	data = append(data, make([]byte, 4)...)
-	binary.BigEndian.PutUint32(data[len(data)-4:len(data)], uint32(len(m.innerMsg)))
+	if !m.compressedWith(version) {
+		return append(dst, m.body...), nil
+	}
 
-	data = append(data, m.innerMsg...)
+	codec, ok := getCodec(codecOf(version))
+	if !ok {
+		return dst[:start], fmt.Errorf("unknown codec %d", codecOf(version))
+	}
+	bodyStart := len(dst)
+	dst, err := codec.AppendCompressed(dst, m.body)
+	if err != nil {
+		return dst[:start], err
+	}
+	binary.BigEndian.PutUint32(dst[start:], uint32(len(dst)-bodyStart))
+	return dst, nil
+}
 
-	data = append(data, make([]byte, 4)...)
-	binary.BigEndian.PutUint32(data[len(data)-4:len(data)], m.connectionId)
+type appendWriter struct {
+	buf []byte
+}
 
-	data = append(data, make([]byte, 4)...)
-	binary.BigEndian.PutUint32(data[len(data)-4:len(data)], uint32(len(m.handlerName)))
+func (w *appendWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
 
-	data = append(data, m.handlerName...)
+func appendUint32(dst []byte, v uint32) []byte {
+	return append(dst, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
 
-	data = append(data, make([]byte, 4)...)
-	binary.BigEndian.PutUint32(data[len(data)-4:len(data)], uint32(len(m.outerReqId)))
+func appendUint64(dst []byte, v uint64) []byte {
+	return append(dst, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
 
-	data = append(data, m.outerReqId...)
+func appendString(dst []byte, s string) []byte {
+	return append(appendUint32(dst, uint32(len(s))), s...)
+}
 
-	data = append(data, make([]byte, 4)...)
-	binary.BigEndian.PutUint32(data[len(data)-4:len(data)], m.version)
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
 
-	if err != nil {
-		logger.Warnf("[AGW] Compress message err, %v", err)
-		return data, false
+// putBuffer gives buf back to the pool, large buffers are dropped so that one huge
+// frame does not stay pinned in memory.
+func putBuffer(buf *[]byte) {
+	if cap(*buf) > max_pooled_buffer_size {
+		return
 	}
-	data = append(data, body...)
-	return data, true
+	*buf = (*buf)[:0]
+	bufferPool.Put(buf)
 }
 
 func (m *AgwMessage) getSyncId() string {
+	if m.clientIpString != "" {
+		return fmt.Sprintf("%s-%s-%s-%d", m.clientVpcId, m.clientIpString, m.clientProcessFlag, m.reqId)
+	}
 	return fmt.Sprintf("%s-%d-%s-%d", m.clientVpcId, m.clientIp, m.clientProcessFlag, m.reqId)
 }
 
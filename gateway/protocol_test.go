@@ -0,0 +1,329 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func newTestMessage(direction uint8, version uint32, body string) *AgwMessage {
+	msg := NewAgwMessage()
+	msg.SetReqId(42)
+	msg.SetMessageType(MessageTypeBiz)
+	msg.SetMessageDirection(direction)
+	msg.SetClientAddr("10.0.0.1")
+	msg.SetClientVpcId("vpc-test")
+	msg.SetServerName("Sentinel")
+	msg.SetTimeoutMs(3000)
+	msg.SetClientProcessFlag("GO_SDK:10.0.0.1:1234")
+	msg.SetInnerMsg("ok")
+	msg.SetConnectionId(1)
+	msg.SetHandlerName("connect")
+	msg.SetOuterReqId("outer-42")
+	msg.SetVersion(version)
+	msg.SetBody(body)
+	return msg
+}
+
+// roundTripCases are the frames of the round-trip tests, their encodings seed FuzzDecode
+func roundTripCases() map[string]*AgwMessage {
+	large := strings.Repeat(`{"resource":"GET:/api","count":10}`, 4096)
+	cases := map[string]*AgwMessage{
+		"plain":              newTestMessage(MessageDirectionRequest, NoCompress, `{"a":1}`),
+		"empty body":         newTestMessage(MessageDirectionResponse, NoCompress, ""),
+		"gzip request":       newTestMessage(MessageDirectionRequest, AllCompress, large),
+		"gzip response":      newTestMessage(MessageDirectionResponse, ResponseCompress, large),
+		"snappy request":     newTestMessage(MessageDirectionRequest, WithCodec(RequestCompress, CodecSnappy), large),
+		"snappy response":    newTestMessage(MessageDirectionResponse, WithCodec(AllCompress, CodecSnappy), large),
+		"zstd request":       newTestMessage(MessageDirectionRequest, WithCodec(AllCompress, CodecZstd), large),
+		"none codec":         newTestMessage(MessageDirectionRequest, WithCodec(AllCompress, CodecNone), large),
+		"other direction":    newTestMessage(MessageDirectionResponse, RequestCompress, large),
+		"api version":        newTestMessage(MessageDirectionRequest, WithApiVersion(AllCompress, 3), `{"v":3}`),
+		"compressed empty":   newTestMessage(MessageDirectionRequest, AllCompress, ""),
+		"utf8 body":          newTestMessage(MessageDirectionRequest, NoCompress, "规则 🚦"),
+		"heartbeat":          newTestMessage(MessageDirectionRequest, NoCompress, ""),
+		"capability request": newTestMessage(MessageDirectionRequest, NoCompress, `{"protocol":1}`),
+		"ipv6 client":        newTestMessage(MessageDirectionRequest, AllCompress, large),
+		"stream chunk":       newTestMessage(MessageDirectionResponse, NoCompress, large[:1000]),
+	}
+	cases["heartbeat"].SetMessageType(MessageTypeHeartbeat)
+	cases["heartbeat"].SetHandlerName(HeartbeatHandlerName)
+	cases["capability request"].SetMessageType(MessageTypeHeartbeat)
+	cases["capability request"].SetCaller(CallerClient)
+	cases["capability request"].SetHandlerName(CapabilitiesHandlerName)
+	cases["ipv6 client"].SetClientAddr("2001:db8::1")
+	cases["stream chunk"].SetMessageType(MessageTypeStream)
+	cases["stream chunk"].SetInnerCode(InnerCodeHandlerError)
+	return cases
+}
+
+// fuzzSeeds returns the encoded round-trip cases, followed by malformed frames
+func fuzzSeeds(t testing.TB) [][]byte {
+	var seeds [][]byte
+	for name, msg := range roundTripCases() {
+		frame, ok := msg.Encode()
+		if !ok {
+			t.Fatalf("%s: encode failed", name)
+		}
+		seeds = append(seeds, frame)
+	}
+	plain, _ := newTestMessage(MessageDirectionRequest, NoCompress, `{"a":1}`).Encode()
+	// a body length beyond the frame
+	oversized := append([]byte(nil), plain...)
+	binary.BigEndian.PutUint32(oversized, 1<<30)
+	// a field length beyond the frame, the length of clientVpcId
+	badField := append([]byte(nil), plain...)
+	binary.BigEndian.PutUint32(badField[23:], 1<<31)
+	// a compressed body which is not gzip
+	badGzip, _ := newTestMessage(MessageDirectionRequest, NoCompress, "not gzip").Encode()
+	binary.BigEndian.PutUint32(badGzip[len(badGzip)-len("not gzip")-4:], AllCompress)
+	return append(seeds,
+		nil,
+		plain[:frameHeaderSize-1],
+		plain[:len(plain)-1],
+		oversized,
+		badField,
+		badGzip,
+	)
+}
+
+// compareMessage compares the decoded fields, the body length is left out as a
+// compressed body may be encoded with different bytes.
+func compareMessage(expected, actual *AgwMessage) error {
+	if expected.ReqId() != actual.ReqId() ||
+		expected.MessageType() != actual.MessageType() ||
+		expected.MessageDirection() != actual.MessageDirection() ||
+		expected.Caller() != actual.Caller() ||
+		expected.ClientIp() != actual.ClientIp() ||
+		expected.ClientIpString() != actual.ClientIpString() ||
+		expected.ClientVpcId() != actual.ClientVpcId() ||
+		expected.ServerName() != actual.ServerName() ||
+		expected.TimeoutMs() != actual.TimeoutMs() ||
+		expected.ClientProcessFlag() != actual.ClientProcessFlag() ||
+		expected.InnerCode() != actual.InnerCode() ||
+		expected.InnerMsg() != actual.InnerMsg() ||
+		expected.ConnectionId() != actual.ConnectionId() ||
+		expected.HandlerName() != actual.HandlerName() ||
+		expected.OuterReqId() != actual.OuterReqId() ||
+		expected.Version() != actual.Version() ||
+		expected.Body() != actual.Body() {
+		return fmt.Errorf("round-trip mismatch, expected %+v, actual %+v", expected, actual)
+	}
+	return nil
+}
+
+func decodeFrame(frame []byte) (*AgwMessage, error) {
+	msg := NewAgwMessage()
+	err := msg.Decode(bufio.NewReader(bytes.NewReader(frame)))
+	return msg, err
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	for name, msg := range roundTripCases() {
+		frame, ok := msg.Encode()
+		if !ok {
+			t.Errorf("%s: encode failed", name)
+			continue
+		}
+		decoded, err := decodeFrame(frame)
+		if err != nil {
+			t.Errorf("%s: decode failed, %v", name, err)
+			continue
+		}
+		if err := compareMessage(msg, decoded); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestFrameCompressedOnTheWire(t *testing.T) {
+	msg := roundTripCases()["gzip request"]
+	frame, _ := msg.Encode()
+	if size := binary.BigEndian.Uint32(frame); int(size) >= len(msg.Body()) {
+		t.Fatalf("body of %d bytes sent with %d bytes", len(msg.Body()), size)
+	}
+	plain := roundTripCases()["other direction"]
+	frame, _ = plain.Encode()
+	if size := binary.BigEndian.Uint32(frame); int(size) != len(plain.Body()) {
+		t.Fatalf("response of a request compressed frame sent with %d bytes, want %d", size, len(plain.Body()))
+	}
+}
+
+func TestFrameStringIp(t *testing.T) {
+	msg := roundTripCases()["ipv6 client"]
+	frame, _ := msg.Encode()
+	decoded, err := decodeFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ClientIp() != 0 || decoded.ClientIpString() != "2001:db8::1" {
+		t.Fatalf("client ip %d %q", decoded.ClientIp(), decoded.ClientIpString())
+	}
+	if decoded.Version()&versionFlagStringIp != 0 {
+		t.Fatalf("version %#x keeps the string ip flag", decoded.Version())
+	}
+}
+
+func TestSetClientAddr(t *testing.T) {
+	cases := []struct {
+		addr     string
+		clientIp uint64
+		ipString string
+	}{
+		{"10.0.0.1", StringIpToUint64("10.0.0.1"), ""},
+		{"::ffff:10.0.0.1", StringIpToUint64("10.0.0.1"), ""},
+		{"2001:db8::1", 0, "2001:db8::1"},
+		{"", 0, ""},
+	}
+	for _, c := range cases {
+		msg := NewAgwMessage()
+		msg.SetClientIpString("stale")
+		msg.SetClientAddr(c.addr)
+		if msg.ClientIp() != c.clientIp || msg.ClientIpString() != c.ipString {
+			t.Errorf("%q: client ip %d %q, want %d %q", c.addr, msg.ClientIp(), msg.ClientIpString(), c.clientIp, c.ipString)
+		}
+	}
+
+	// IPv6 clients sharing the legacy zero client ip have their own sync ids
+	first, second := NewAgwMessage(), NewAgwMessage()
+	first.SetClientAddr("2001:db8::1")
+	second.SetClientAddr("2001:db8::2")
+	if first.getSyncId() == second.getSyncId() {
+		t.Fatalf("IPv6 clients share the sync id %s", first.getSyncId())
+	}
+}
+
+func TestWireMessageStringIp(t *testing.T) {
+	msg := roundTripCases()["ipv6 client"]
+	legacy := &AgwConn{}
+	wire := legacy.wireMessage(msg)
+	if wire == msg || wire.ClientIpString() != "" || wire.ClientIp() != 0 {
+		t.Fatalf("legacy connection sends the client ip %q", wire.ClientIpString())
+	}
+	if msg.ClientIpString() != "2001:db8::1" {
+		t.Fatal("message modified for the legacy connection")
+	}
+	frame, _ := wire.Encode()
+	decoded, err := decodeFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Version() != msg.Version() || decoded.ClientIpString() != "" {
+		t.Fatalf("legacy frame version %#x, client ip %q", decoded.Version(), decoded.ClientIpString())
+	}
+
+	negotiated := &AgwConn{}
+	negotiated.setCapabilities(&Capabilities{Protocol: ProtocolVersion, StringIp: true}, CodecGzip)
+	if negotiated.wireMessage(msg) != msg {
+		t.Fatal("client ip dropped on a connection which negotiated StringIp")
+	}
+	ipv4 := roundTripCases()["other direction"]
+	if legacy.wireMessage(ipv4) != ipv4 {
+		t.Fatal("IPv4 message copied for the legacy connection")
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	msg := newTestMessage(MessageDirectionRequest, NoCompress, strings.Repeat("x", 2048))
+	frame, _ := msg.Encode()
+	decoded := NewAgwMessage()
+	err := decoded.DecodeLimited(bufio.NewReader(bytes.NewReader(frame)), FrameLimits{MaxBodySize: 1024})
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || !errors.Is(err, ErrFrameTooLarge) || decodeErr.Field != "body" {
+		t.Fatalf("want a body too large error, got %v", err)
+	}
+
+	for _, codec := range []uint8{CodecGzip, CodecSnappy, CodecZstd} {
+		msg = newTestMessage(MessageDirectionRequest, WithCodec(AllCompress, codec), strings.Repeat("x", 1<<16))
+		frame, _ = msg.Encode()
+		err = decoded.DecodeLimited(bufio.NewReader(bytes.NewReader(frame)), FrameLimits{MaxDecompressedSize: 1024})
+		if !errors.Is(err, ErrFrameTooLarge) {
+			t.Fatalf("codec %d: want a decompressed body too large error, got %v", codec, err)
+		}
+	}
+}
+
+// FuzzDecode checks that every frame accepted by Decode survives an Encode/Decode
+// round-trip unchanged, go test runs it on the seeds.
+//
+//	go test -run '^$' -fuzz FuzzDecode ./gateway
+func FuzzDecode(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed)
+	}
+	limits := FrameLimits{MaxBodySize: 1 << 20, MaxFieldSize: 1 << 12, MaxDecompressedSize: 1 << 20}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg := NewAgwMessage()
+		if err := msg.DecodeLimited(bufio.NewReader(bytes.NewReader(data)), limits); err != nil {
+			return
+		}
+		frame, ok := msg.Encode()
+		if !ok {
+			t.Fatal("encode a decoded frame failed")
+		}
+		decoded := NewAgwMessage()
+		if err := decoded.DecodeLimited(bufio.NewReader(bytes.NewReader(frame)), limits); err != nil {
+			t.Fatalf("decode an encoded frame failed: %v", err)
+		}
+		if err := compareMessage(msg, decoded); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// benchBody is a metric report of about 90KB, the largest bodies the client sends
+var benchBody = strings.Repeat("1700000000000|GET:/api/orders|12|0|3|0|25|0|0|1\n", 1900)
+
+func benchmarkEncode(b *testing.B, version uint32) {
+	msg := newTestMessage(MessageDirectionRequest, version, benchBody)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchBody)))
+	for i := 0; i < b.N; i++ {
+		if _, ok := msg.Encode(); !ok {
+			b.Fatal("encode failed")
+		}
+	}
+}
+
+func BenchmarkEncode(b *testing.B)       { benchmarkEncode(b, NoCompress) }
+func BenchmarkEncodeGzip(b *testing.B)   { benchmarkEncode(b, AllCompress) }
+func BenchmarkEncodeSnappy(b *testing.B) { benchmarkEncode(b, WithCodec(AllCompress, CodecSnappy)) }
+func BenchmarkEncodeZstd(b *testing.B)   { benchmarkEncode(b, WithCodec(AllCompress, CodecZstd)) }
+
+func BenchmarkWriteTo(b *testing.B) {
+	msg := newTestMessage(MessageDirectionRequest, NoCompress, benchBody)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchBody)))
+	for i := 0; i < b.N; i++ {
+		if _, err := msg.WriteTo(ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkDecode decodes the frame through one reused reader, like the reader
+// coroutine of a connection, so that the pooled decompressors are reused as well.
+func benchmarkDecode(b *testing.B, version uint32) {
+	frame, _ := newTestMessage(MessageDirectionRequest, version, benchBody).Encode()
+	r := bytes.NewReader(frame)
+	br := bufio.NewReaderSize(r, default_read_buffer_size)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchBody)))
+	for i := 0; i < b.N; i++ {
+		r.Reset(frame)
+		br.Reset(r)
+		if err := NewAgwMessage().Decode(br); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B)       { benchmarkDecode(b, NoCompress) }
+func BenchmarkDecodeGzip(b *testing.B)   { benchmarkDecode(b, AllCompress) }
+func BenchmarkDecodeSnappy(b *testing.B) { benchmarkDecode(b, WithCodec(AllCompress, CodecSnappy)) }
+func BenchmarkDecodeZstd(b *testing.B)   { benchmarkDecode(b, WithCodec(AllCompress, CodecZstd)) }
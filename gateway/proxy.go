@@ -0,0 +1,264 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// DialFunc opens the TCP connection to address, the TLS handshake of the gateway is
+// done on top of it. net.Dialer.DialContext is a DialFunc.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+const (
+	socks5Version        = 5
+	socks5AuthNone       = 0
+	socks5AuthPassword   = 2
+	socks5AuthNoAccepted = 0xff
+	socks5CmdConnect     = 1
+	socks5AddrIpv4       = 1
+	socks5AddrDomain     = 3
+	socks5AddrIpv6       = 4
+)
+
+// newDialFunc returns the dialer of the gateway connections: config.DialContext or a
+// net.Dialer with the keepalive of the config, through config.Proxy if set.
+func newDialFunc(config AgwConfig) (DialFunc, error) {
+	dial := config.DialContext
+	if dial == nil {
+		dialer := &net.Dialer{KeepAlive: config.KeepAlive}
+		dial = dialer.DialContext
+	}
+	if config.Proxy == "" {
+		return dial, nil
+	}
+	proxyUrl, err := url.Parse(config.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", config.Proxy, err)
+	}
+	if proxyUrl.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q: missing host", config.Proxy)
+	}
+	switch proxyUrl.Scheme {
+	case "http":
+		return httpConnectDialer(proxyUrl, dial), nil
+	case "socks5", "socks5h":
+		return socks5Dialer(proxyUrl, dial), nil
+	}
+	return nil, fmt.Errorf("invalid proxy %q: unsupported scheme %s", config.Proxy, proxyUrl.Scheme)
+}
+
+// proxyAddress returns the host:port of the proxy, with the default port of its scheme
+func proxyAddress(proxyUrl *url.URL) string {
+	if proxyUrl.Port() != "" {
+		return proxyUrl.Host
+	}
+	if proxyUrl.Scheme == "http" {
+		return net.JoinHostPort(proxyUrl.Hostname(), "80")
+	}
+	return net.JoinHostPort(proxyUrl.Hostname(), "1080")
+}
+
+// withDeadline bounds the proxy handshake on conn by the deadline of ctx
+func withDeadline(ctx context.Context, conn net.Conn, handshake func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	return handshake()
+}
+
+// httpConnectDialer tunnels the connections through an HTTP proxy with CONNECT, the
+// user info of the proxy url is sent as basic Proxy-Authorization.
+func httpConnectDialer(proxyUrl *url.URL, forward DialFunc) DialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := forward(ctx, network, proxyAddress(proxyUrl))
+		if err != nil {
+			return nil, fmt.Errorf("dial proxy %s: %w", proxyUrl.Host, err)
+		}
+		var tunnel net.Conn
+		err = withDeadline(ctx, conn, func() error {
+			req := &http.Request{
+				Method: http.MethodConnect,
+				URL:    &url.URL{Opaque: address},
+				Host:   address,
+				Header: make(http.Header),
+			}
+			if user := proxyUrl.User; user != nil {
+				password, _ := user.Password()
+				credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+				req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+			}
+			if err := req.Write(conn); err != nil {
+				return err
+			}
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, req)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("proxy responded %s", resp.Status)
+			}
+			tunnel = conn
+			if br.Buffered() > 0 {
+				tunnel = &bufferedConn{Conn: conn, r: br}
+			}
+			return nil
+		})
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("connect %s through proxy %s: %w", address, proxyUrl.Host, err)
+		}
+		return tunnel, nil
+	}
+}
+
+// bufferedConn keeps the bytes read past the response of the proxy
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// socks5Dialer tunnels the connections through a SOCKS5 proxy (RFC 1928), with the
+// username/password authentication (RFC 1929) if the proxy url has user info.
+// Host names are resolved by the proxy.
+func socks5Dialer(proxyUrl *url.URL, forward DialFunc) DialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := forward(ctx, network, proxyAddress(proxyUrl))
+		if err != nil {
+			return nil, fmt.Errorf("dial proxy %s: %w", proxyUrl.Host, err)
+		}
+		err = withDeadline(ctx, conn, func() error {
+			return socks5Connect(conn, proxyUrl.User, address)
+		})
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("connect %s through proxy %s: %w", address, proxyUrl.Host, err)
+		}
+		return conn, nil
+	}
+}
+
+func socks5Connect(conn net.Conn, user *url.Userinfo, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %s", portStr)
+	}
+
+	methods := []byte{socks5AuthNone}
+	if user != nil {
+		methods = append(methods, socks5AuthPassword)
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected socks version %d", reply[0])
+	}
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if user == nil {
+			return errors.New("socks proxy requires a password")
+		}
+		if err := socks5Authenticate(conn, user); err != nil {
+			return err
+		}
+	case socks5AuthNoAccepted:
+		return errors.New("no socks authentication method accepted")
+	default:
+		return fmt.Errorf("unexpected socks authentication method %d", reply[1])
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %s", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIpv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIpv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// version, reply, reserved and address type, then the bound address
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		return fmt.Errorf("socks connect failed with reply %d", header[1])
+	}
+	var addrLen int
+	switch header[3] {
+	case socks5AddrIpv4:
+		addrLen = net.IPv4len
+	case socks5AddrIpv6:
+		addrLen = net.IPv6len
+	case socks5AddrDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return err
+		}
+		addrLen = int(length[0])
+	default:
+		return fmt.Errorf("unexpected socks address type %d", header[3])
+	}
+	// the bound address and port are of no use
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+func socks5Authenticate(conn net.Conn, user *url.Userinfo) error {
+	username := user.Username()
+	password, _ := user.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("socks username or password too long")
+	}
+	req := []byte{1, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("socks authentication failed")
+	}
+	return nil
+}
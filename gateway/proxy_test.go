@@ -0,0 +1,314 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveTest accepts the connections of a local server until the returned func closes it
+func serveTest(t *testing.T, serve func(net.Conn)) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+// greetAndEcho greets its clients with "hello", then echoes what they send
+func greetAndEcho(conn net.Conn) {
+	io.WriteString(conn, "hello")
+	io.Copy(conn, conn)
+}
+
+func tunnel(client, target net.Conn) {
+	defer target.Close()
+	go io.Copy(target, client)
+	io.Copy(client, target)
+}
+
+// httpProxy answers CONNECT with status, it sends the greeting of the target in the
+// same write as its response when the tunnel is established.
+func httpProxy(status int, requests chan<- *http.Request) func(net.Conn) {
+	return func(conn net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		requests <- req
+		if status != http.StatusOK {
+			fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n\r\n", status, http.StatusText(status))
+			return
+		}
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			return
+		}
+		greeting := make([]byte, len("hello"))
+		io.ReadFull(target, greeting)
+		conn.Write(append([]byte("HTTP/1.1 200 Connection established\r\n\r\n"), greeting...))
+		tunnel(conn, target)
+	}
+}
+
+// socksProxy is a SOCKS5 proxy requiring the password of user if set, it fails the
+// connect requests with reply if not zero.
+type socksProxy struct {
+	user, password string
+	reply          byte
+	addresses      chan string
+}
+
+func (p *socksProxy) serve(conn net.Conn) {
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return
+	}
+	methods := make([]byte, head[1])
+	io.ReadFull(conn, methods)
+	if p.user == "" {
+		conn.Write([]byte{socks5Version, socks5AuthNone})
+	} else {
+		if !strings.Contains(string(methods), string([]byte{socks5AuthPassword})) {
+			conn.Write([]byte{socks5Version, socks5AuthNoAccepted})
+			return
+		}
+		conn.Write([]byte{socks5Version, socks5AuthPassword})
+		var version [1]byte
+		io.ReadFull(conn, version[:])
+		user := readSocksString(conn)
+		password := readSocksString(conn)
+		if user != p.user || password != p.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return
+	}
+	var host string
+	switch header[3] {
+	case socks5AddrIpv4:
+		ip := make([]byte, net.IPv4len)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case socks5AddrIpv6:
+		ip := make([]byte, net.IPv6len)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		host = readSocksString(conn)
+	}
+	var port [2]byte
+	io.ReadFull(conn, port[:])
+	address := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+	p.addresses <- address
+	if p.reply != 0 {
+		conn.Write([]byte{socks5Version, p.reply, 0, socks5AddrIpv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	target, err := net.Dial("tcp", address)
+	if err != nil {
+		return
+	}
+	conn.Write([]byte{socks5Version, 0, 0, socks5AddrDomain, 5, 'p', 'r', 'o', 'x', 'y', 0, 0})
+	tunnel(conn, target)
+}
+
+// readSocksString reads a string prefixed by its length byte
+func readSocksString(r io.Reader) string {
+	var length [1]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return ""
+	}
+	b := make([]byte, length[0])
+	io.ReadFull(r, b)
+	return string(b)
+}
+
+// checkTunnel reads the greeting of the target through conn, then an echo
+func checkTunnel(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	b := make([]byte, len("hello"))
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "hello" {
+		t.Fatalf("greeting %q through the tunnel, %v", b, err)
+	}
+	io.WriteString(conn, "ping")
+	b = b[:len("ping")]
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatalf("echo %q through the tunnel, %v", b, err)
+	}
+}
+
+func TestNewDialFuncInvalidProxy(t *testing.T) {
+	for _, proxy := range []string{"http://[::1", "socks5:///", "ftp://proxy:21"} {
+		if _, err := newDialFunc(AgwConfig{Proxy: proxy}); err == nil {
+			t.Errorf("proxy %q accepted", proxy)
+		}
+	}
+	cases := map[string]string{
+		"http://proxy":        "proxy:80",
+		"socks5://proxy":      "proxy:1080",
+		"socks5h://[::1]":     "[::1]:1080",
+		"http://proxy:3128":   "proxy:3128",
+		"socks5://proxy:9050": "proxy:9050",
+	}
+	for proxy, want := range cases {
+		dial, err := newDialFunc(AgwConfig{Proxy: proxy, DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, fmt.Errorf("dialed %s", address)
+		}})
+		if err != nil {
+			t.Fatalf("proxy %q: %v", proxy, err)
+		}
+		if _, err := dial(context.Background(), "tcp", "gateway:8443"); err == nil || !strings.Contains(err.Error(), "dialed "+want) {
+			t.Errorf("proxy %q dialed %v, want %s", proxy, err, want)
+		}
+	}
+}
+
+func TestHttpConnectProxy(t *testing.T) {
+	target, closeTarget := serveTest(t, greetAndEcho)
+	defer closeTarget()
+	cases := []struct {
+		name   string
+		user   string
+		status int
+	}{
+		{"anonymous", "", http.StatusOK},
+		{"basic auth", "agent:secret", http.StatusOK},
+		{"refused", "agent:wrong", http.StatusProxyAuthRequired},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			requests := make(chan *http.Request, 1)
+			proxy, closeProxy := serveTest(t, httpProxy(c.status, requests))
+			defer closeProxy()
+			proxyUrl := "http://" + proxy
+			if c.user != "" {
+				proxyUrl = "http://" + c.user + "@" + proxy
+			}
+			dial, err := newDialFunc(AgwConfig{Proxy: proxyUrl})
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := dial(context.Background(), "tcp", target)
+			req := <-requests
+			if req.Method != http.MethodConnect || req.Host != target {
+				t.Fatalf("proxy got %s %s, want CONNECT %s", req.Method, req.Host, target)
+			}
+			wantAuth := ""
+			if c.user != "" {
+				wantAuth = "Basic " + base64.StdEncoding.EncodeToString([]byte(c.user))
+			}
+			if auth := req.Header.Get("Proxy-Authorization"); auth != wantAuth {
+				t.Fatalf("Proxy-Authorization %q, want %q", auth, wantAuth)
+			}
+			if c.status != http.StatusOK {
+				if err == nil || !strings.Contains(err.Error(), strconv.Itoa(c.status)) {
+					t.Fatalf("dial through a refusing proxy returned %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTunnel(t, conn)
+		})
+	}
+}
+
+func TestSocks5Proxy(t *testing.T) {
+	target, closeTarget := serveTest(t, greetAndEcho)
+	defer closeTarget()
+	_, port, _ := net.SplitHostPort(target)
+	cases := []struct {
+		name    string
+		proxy   socksProxy
+		user    string
+		address string
+		ok      bool
+	}{
+		{"no auth", socksProxy{}, "", target, true},
+		{"password", socksProxy{user: "agent", password: "secret"}, "agent:secret", target, true},
+		{"domain resolved by the proxy", socksProxy{}, "", net.JoinHostPort("localhost", port), true},
+		{"wrong password", socksProxy{user: "agent", password: "secret"}, "agent:wrong", target, false},
+		{"password required", socksProxy{user: "agent", password: "secret"}, "", target, false},
+		{"connect refused", socksProxy{reply: 5}, "", target, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			proxy := c.proxy
+			proxy.addresses = make(chan string, 1)
+			proxyAddr, closeProxy := serveTest(t, proxy.serve)
+			defer closeProxy()
+			proxyUrl := "socks5://" + proxyAddr
+			if c.user != "" {
+				proxyUrl = "socks5://" + c.user + "@" + proxyAddr
+			}
+			dial, err := newDialFunc(AgwConfig{Proxy: proxyUrl})
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := dial(context.Background(), "tcp", c.address)
+			if !c.ok {
+				if err == nil {
+					conn.Close()
+					t.Fatal("dial succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if address := <-proxy.addresses; address != c.address {
+				t.Fatalf("proxy asked to connect %s, want %s", address, c.address)
+			}
+			checkTunnel(t, conn)
+		})
+	}
+}
+
+func TestProxyHandshakeDeadline(t *testing.T) {
+	// a proxy which accepts the connection and never answers
+	proxy, closeProxy := serveTest(t, func(conn net.Conn) { io.Copy(ioutil.Discard, conn) })
+	defer closeProxy()
+	for _, scheme := range []string{"http", "socks5"} {
+		dial, err := newDialFunc(AgwConfig{Proxy: scheme + "://" + proxy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		started := time.Now()
+		_, err = dial(ctx, "tcp", "gateway:8443")
+		cancel()
+		if err == nil || time.Since(started) > time.Second {
+			t.Fatalf("%s proxy handshake returned %v after %v, want a timeout", scheme, err, time.Since(started))
+		}
+	}
+}
@@ -2,7 +2,11 @@ package gateway
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"sync/atomic"
+	"time"
 )
 
 func runReaderCoroutine(conn *AgwConn) {
@@ -15,12 +19,19 @@ func runReaderCoroutine(conn *AgwConn) {
 
 	c := *(conn.conn)
 	//*bufio.Reader
-	bufReader := bufio.NewReaderSize(c, 128)
+	bufReader := bufio.NewReaderSize(c, default_read_buffer_size)
 
+	limits := conn.pool.client.config.FrameLimits
+	streams := NewStreamAssembler(limits.MaxDecompressedSize)
 	for {
 		msg := NewAgwMessage()
-		if err := msg.Decode(bufReader); err != nil {
-			if msg.ReqId() != 0 && msg.outerReqId != "" {
+		if err := msg.DecodeLimited(bufReader, limits); err != nil {
+			var decodeErr *DecodeError
+			if errors.As(err, &decodeErr) {
+				atomic.AddUint64(&conn.pool.client.metrics.decodeErrors, 1)
+				logWarnf("AGW bad frame on connection %d, closing it, error:%v, reqId:%d",
+					conn.connId, err, msg.ReqId())
+			} else if msg.ReqId() != 0 && msg.outerReqId != "" {
 				logWarnf("AGW exit read coroutine, error:%s, reqId:%d, outerReqId:%s",
 					err.Error(), msg.ReqId(), msg.OuterReqId())
 			} else {
@@ -29,13 +40,35 @@ func runReaderCoroutine(conn *AgwConn) {
 			conn.close()
 			return
 		}
+		if r := conn.pool.client.recorder; r != nil {
+			r.record(CaptureInbound, conn.connId, msg)
+		}
+		if msg.MessageType() == MessageTypeStream {
+			whole, err := streams.Add(msg)
+			if err != nil {
+				atomic.AddUint64(&conn.pool.client.metrics.decodeErrors, 1)
+				logWarnf("AGW bad stream on connection %d, closing it, error:%v, reqId:%d",
+					conn.connId, err, msg.ReqId())
+				conn.close()
+				return
+			}
+			if whole == nil {
+				continue
+			}
+			msg = whole
+		} else if streams.Len() > 0 {
+			streams.Expire(time.Now())
+		}
 
 		if msg.MessageType() == MessageTypeBiz && msg.MessageDirection() == MessageDirectionResponse {
 			notify(conn, msg)
 		} else if msg.MessageType() == MessageTypeBiz && msg.MessageDirection() == MessageDirectionRequest {
-			handleRequest(msg, conn)
+			conn.pool.client.dispatcher.dispatch(msg, conn)
 		} else if msg.MessageType() == MessageTypeHeartbeat && msg.MessageDirection() == MessageDirectionResponse {
-			//todo : handle unexpected response case
+			conn.onPong(msg)
+			if msg.HandlerName() == CapabilitiesHandlerName {
+				notify(conn, msg)
+			}
 		} else if msg.MessageType() == MessageTypeHeartbeat && msg.MessageDirection() == MessageDirectionRequest {
 			msg.SetMessageDirection(MessageDirectionResponse)
 			go conn.write(msg)
@@ -47,22 +80,26 @@ func runReaderCoroutine(conn *AgwConn) {
 
 }
 
-func handleRequest(msg *AgwMessage, conn *AgwConn) {
+func handleRequest(req *inboundRequest, d *dispatcher) {
+	msg, conn := req.msg, req.conn
 
 	tsUtil := newTimestampUtil(msg.ReqId(), msg.OuterReqId())
 	tsUtil.mark("gateway_call_client")
 
 	handlerName := msg.HandlerName()
-	handler, ok := handlers[handlerName]
+	_, span := conn.pool.client.tracer.StartSpan(context.Background(), SpanHandle,
+		Attribute{Key: AttrServerName, Value: msg.ServerName()},
+		Attribute{Key: AttrHandlerName, Value: handlerName},
+		Attribute{Key: AttrOuterReqId, Value: msg.OuterReqId()},
+		Attribute{Key: AttrReqId, Value: msg.ReqId()},
+		Attribute{Key: AttrConnId, Value: conn.connId})
+	handler, ok := conn.pool.client.getHandler(handlerName, msg.Version())
 	if !ok {
 		logWarnf("AGW cannot get client handler by handlerName:%s, reqId:%d, outerReqId:%s",
 			handlerName, msg.ReqId(), msg.OuterReqId())
 
-		msg.SetInnerCode(8034)
-		msg.SetInnerMsg("can not get client handler by handlerName")
-		msg.SetMessageDirection(MessageDirectionResponse)
-
-		go conn.write(msg)
+		replyError(msg, conn, InnerCodeNoHandler, "can not get client handler by handlerName")
+		endSpan(span, InnerCodeNoHandler, errors.New("no handler "+handlerName))
 
 		tsUtil.mark("no_handler_exception")
 		logDebug(tsUtil.GetResult())
@@ -70,18 +107,58 @@ func handleRequest(msg *AgwMessage, conn *AgwConn) {
 		return
 	}
 
+	release, ok := d.acquire(handlerName)
+	if !ok {
+		logWarnf("AGW client handler %s reaches its concurrency limit, reqId:%d, outerReqId:%s",
+			handlerName, msg.ReqId(), msg.OuterReqId())
+
+		replyError(msg, conn, InnerCodeBusy, "client busy, handler concurrency limit reached")
+		endSpan(span, InnerCodeBusy, errors.New("handler concurrency limit reached"))
+
+		tsUtil.mark("busy_exception")
+		logDebug(tsUtil.GetResult())
+
+		return
+	}
+
+	// the time spent in the queue counts against the timeout of the gateway
+	var deadline time.Time
+	if msg.TimeoutMs() > 0 {
+		deadline = req.received.Add(time.Duration(msg.TimeoutMs()) * time.Millisecond)
+	}
+
+	metrics := conn.pool.client.metrics
 	tsUtil.mark("before_handle")
-	response, err := handler.Handle(msg.Body())
+	started := time.Now()
+	metrics.observePhase(PhaseBeforeHandle, started.Sub(req.received))
+	if streamHandler, ok := handler.(StreamHandler); ok && conn.streaming() {
+		err := runStreamHandler(streamHandler, msg, conn, deadline, release)
+		tsUtil.mark("after_handle")
+		metrics.observePhase(PhaseAfterHandle, time.Since(started))
+		if err != nil {
+			logWarnf("AGW executing client stream handler wrong, reqId:%d, outerReqId:%s, err:%s", msg.ReqId(), msg.OuterReqId(), err.Error())
+			endSpan(span, InnerCodeHandlerError, err)
+			tsUtil.mark("handle_exception")
+		} else {
+			span.End(nil)
+			tsUtil.mark("write_ok")
+		}
+		logDebug(tsUtil.GetResult())
+		return
+	}
+	response, err := runHandler(handler, msg.Body(), deadline, release)
 	tsUtil.mark("after_handle")
+	metrics.observePhase(PhaseAfterHandle, time.Since(started))
 
 	if err != nil {
-		logWarnf("AGW executing client handler wrong, reqId:%d, outerReqId:%s", msg.ReqId(), msg.OuterReqId(), err.Error())
-
-		msg.SetInnerCode(8035)
-		msg.SetInnerMsg(fmt.Sprintf("executing client handler wrong : %s", err.Error()))
-		msg.SetMessageDirection(MessageDirectionResponse)
+		logWarnf("AGW executing client handler wrong, reqId:%d, outerReqId:%s, err:%s", msg.ReqId(), msg.OuterReqId(), err.Error())
 
-		go conn.write(msg)
+		code := uint32(InnerCodeHandlerError)
+		if err == errHandlerTimeout {
+			code = InnerCodeHandlerTimeout
+		}
+		replyError(msg, conn, code, fmt.Sprintf("executing client handler wrong : %s", err.Error()))
+		endSpan(span, code, err)
 
 		tsUtil.mark("handle_exception")
 		logDebug(tsUtil.GetResult())
@@ -92,8 +169,21 @@ func handleRequest(msg *AgwMessage, conn *AgwConn) {
 	msg.SetMessageDirection(MessageDirectionResponse)
 	msg.SetBody(response)
 
-	go conn.write(msg)
+	go func() {
+		if err := conn.write(msg); errors.Is(err, ErrFrameTooLarge) {
+			logWarnf("AGW response of client handler exceeds the frame size of the gateway, reqId:%d, outerReqId:%s",
+				msg.ReqId(), msg.OuterReqId())
+			replyError(msg, conn, InnerCodeHandlerError, err.Error())
+		}
+	}()
+	span.End(nil)
 
 	tsUtil.mark("write_ok")
 	logDebug(tsUtil.GetResult())
 }
+
+// endSpan ends the span of a request answered with an error code
+func endSpan(span Span, code uint32, err error) {
+	span.SetAttributes(Attribute{Key: AttrInnerCode, Value: code})
+	span.End(err)
+}
@@ -0,0 +1,80 @@
+package gateway
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	connStateIdle int32 = iota
+	connStateConnecting
+	connStateReady
+	connStateFailed
+)
+
+var connStateNames = map[int32]string{
+	connStateIdle:       "idle",
+	connStateConnecting: "connecting",
+	connStateReady:      "ready",
+	connStateFailed:     "failed",
+}
+
+// connSlot tracks the dial state of one connection id in the pool.
+// The fields are written under lock, which is never held across the network dial,
+// and state may be read atomically without it.
+type connSlot struct {
+	connId   uint32
+	lock     sync.Mutex
+	state    int32
+	failures uint32
+	retryAt  time.Time
+	lastErr  error
+	// whether the slot has ever been connected, a later dial is a reconnection
+	connected bool
+	// closed when the dial of the connecting state ends
+	dialDone chan struct{}
+}
+
+func (s *connSlot) setState(state int32) {
+	atomic.StoreInt32(&s.state, state)
+}
+
+func (s *connSlot) loadState() int32 {
+	return atomic.LoadInt32(&s.state)
+}
+
+// beginDial claims the dial of the slot for the caller, who must hold s.lock and
+// then call ConnectionPool.dial without it.
+func (s *connSlot) beginDial() {
+	s.setState(connStateConnecting)
+	s.dialDone = make(chan struct{})
+}
+
+// reconnectBackoff returns the delay before the next dial after the given number
+// of consecutive failures: exponential growth from the base delay, capped at the
+// max delay, with jitter on the upper half so that instances do not redial together.
+func reconnectBackoff(config AgwConfig, failures uint32) time.Duration {
+	base := config.ReconnectBaseDelay
+	if base <= 0 {
+		base = default_reconnect_base_delay_ms * time.Millisecond
+	}
+	max := config.ReconnectMaxDelay
+	if max <= 0 {
+		max = default_reconnect_max_delay_ms * time.Millisecond
+	}
+	if max < base {
+		max = base
+	}
+
+	backoff := base
+	for i := uint32(1); i < failures && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
@@ -0,0 +1,47 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	config := AgwConfig{ReconnectBaseDelay: 100 * time.Millisecond, ReconnectMaxDelay: time.Second}
+	nominal := []time.Duration{
+		100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond,
+		time.Second, time.Second, time.Second,
+	}
+	for i, want := range nominal {
+		failures := uint32(i + 1)
+		for n := 0; n < 100; n++ {
+			// jitter on the upper half of the nominal delay
+			if got := reconnectBackoff(config, failures); got < want/2 || got > want {
+				t.Fatalf("%d failures: backoff %v, want within [%v, %v]", failures, got, want/2, want)
+			}
+		}
+	}
+	if got := reconnectBackoff(config, 1<<31); got > time.Second {
+		t.Fatalf("backoff %v after many failures, want capped at %v", got, time.Second)
+	}
+
+	defaults := []struct {
+		name   string
+		config AgwConfig
+		max    time.Duration
+	}{
+		{"defaults", AgwConfig{}, default_reconnect_max_delay_ms * time.Millisecond},
+		{"max below base", AgwConfig{ReconnectBaseDelay: time.Second, ReconnectMaxDelay: time.Millisecond}, time.Second},
+	}
+	for _, c := range defaults {
+		base := c.config.ReconnectBaseDelay
+		if base == 0 {
+			base = default_reconnect_base_delay_ms * time.Millisecond
+		}
+		if got := reconnectBackoff(c.config, 1); got < base/2 || got > base {
+			t.Errorf("%s: first backoff %v, want within [%v, %v]", c.name, got, base/2, base)
+		}
+		if got := reconnectBackoff(c.config, 64); got < c.max/2 || got > c.max {
+			t.Errorf("%s: backoff %v after many failures, want within [%v, %v]", c.name, got, c.max/2, c.max)
+		}
+	}
+}
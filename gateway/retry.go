@@ -0,0 +1,164 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	default_retry_budget_max_tokens  = 10
+	default_retry_budget_token_ratio = 0.1
+)
+
+// RetryPolicy controls how AgwClient retries a failed call.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first one, 1 disables retry
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubled for each later retry
+	Backoff time.Duration
+	// MaxBackoff caps the delay between two attempts, zero means no cap
+	MaxBackoff time.Duration
+	// RetryOn lists the error classes which are retried, matched with errors.Is.
+	// Defaults to ErrTimeout and ErrConnClosed.
+	RetryOn []error
+	// HandlerOverrides replaces the policy for some handlers, keyed by
+	// "serverName_handlerName" or by handlerName alone
+	HandlerOverrides map[string]*RetryPolicy
+	// Budget limits the retries of the whole client, nil does not limit them
+	Budget *RetryBudget
+}
+
+// RetryBudget is a token bucket shared by all calls of a client: every failed attempt
+// takes one token, every successful call gives back TokenRatio token, and retrying is
+// only allowed while more than half of MaxTokens are left.
+type RetryBudget struct {
+	// MaxTokens is the size of the bucket, 10 if not positive
+	MaxTokens float64
+	// TokenRatio is given back per successful call, 0.1 if not positive
+	TokenRatio float64
+}
+
+func defaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: default_req_retry_time,
+		RetryOn:     []error{ErrTimeout, ErrConnClosed},
+	}
+}
+
+// policyFor returns the policy of the handler, with defaults filled in.
+func (p *RetryPolicy) policyFor(rpcMetadata RpcMetadata) *RetryPolicy {
+	if p == nil {
+		return defaultRetryPolicy()
+	}
+	policy := p
+	if override, ok := p.HandlerOverrides[rpcMetadata.ServerName+"_"+rpcMetadata.HandlerName]; ok && override != nil {
+		policy = override
+	} else if override, ok := p.HandlerOverrides[rpcMetadata.HandlerName]; ok && override != nil {
+		policy = override
+	}
+	if policy.MaxAttempts > 0 && len(policy.RetryOn) > 0 {
+		return policy
+	}
+	filled := *policy
+	if filled.MaxAttempts <= 0 {
+		filled.MaxAttempts = default_req_retry_time
+	}
+	if len(filled.RetryOn) == 0 {
+		filled.RetryOn = []error{ErrTimeout, ErrConnClosed}
+	}
+	return &filled
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	for _, target := range p.RetryOn {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before the given retry, starting from 1
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	backoff := p.Backoff
+	for i := 1; i < retry && backoff > 0; i++ {
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return backoff
+}
+
+type retryBudget struct {
+	lock       sync.Mutex
+	tokens     float64
+	maxTokens  float64
+	tokenRatio float64
+}
+
+// newRetryBudget returns the budget of the config, nil if there is none. A nil budget
+// allows every retry.
+func newRetryBudget(config *RetryBudget) *retryBudget {
+	if config == nil {
+		return nil
+	}
+	budget := &retryBudget{
+		maxTokens:  default_retry_budget_max_tokens,
+		tokenRatio: default_retry_budget_token_ratio,
+	}
+	if config.MaxTokens > 0 {
+		budget.maxTokens = config.MaxTokens
+	}
+	if config.TokenRatio > 0 {
+		budget.tokenRatio = config.TokenRatio
+	}
+	budget.tokens = budget.maxTokens
+	return budget
+}
+
+func (b *retryBudget) onSuccess() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens += b.tokenRatio
+	if b.tokens > b.maxTokens {
+		b.tokens = b.maxTokens
+	}
+}
+
+// onFailure takes a token and returns whether a retry is still allowed
+func (b *retryBudget) onFailure() bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens--
+	if b.tokens < 0 {
+		b.tokens = 0
+	}
+	return b.tokens > b.maxTokens/2
+}
+
+// sleepContext waits for d, it returns false if ctx is done before
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,116 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyFor(t *testing.T) {
+	override := &RetryPolicy{MaxAttempts: 5}
+	policy := &RetryPolicy{
+		MaxAttempts: 3,
+		RetryOn:     []error{ErrTimeout},
+		HandlerOverrides: map[string]*RetryPolicy{
+			"Sentinel_metric": override,
+			"heartbeat":       {MaxAttempts: 1, RetryOn: []error{ErrConnClosed}},
+		},
+	}
+	cases := []struct {
+		name        string
+		policy      *RetryPolicy
+		metadata    RpcMetadata
+		maxAttempts int
+		retryOn     []error
+	}{
+		{"nil policy", nil, RpcMetadata{HandlerName: "rule"}, default_req_retry_time, []error{ErrTimeout, ErrConnClosed}},
+		{"client policy", policy, RpcMetadata{ServerName: "Sentinel", HandlerName: "rule"}, 3, []error{ErrTimeout}},
+		{"server and handler override", policy, RpcMetadata{ServerName: "Sentinel", HandlerName: "metric"}, 5, []error{ErrTimeout, ErrConnClosed}},
+		{"other server", policy, RpcMetadata{ServerName: "Other", HandlerName: "metric"}, 3, []error{ErrTimeout}},
+		{"handler override", policy, RpcMetadata{ServerName: "Any", HandlerName: "heartbeat"}, 1, []error{ErrConnClosed}},
+		{"defaults filled", &RetryPolicy{}, RpcMetadata{HandlerName: "rule"}, default_req_retry_time, []error{ErrTimeout, ErrConnClosed}},
+	}
+	for _, c := range cases {
+		got := c.policy.policyFor(c.metadata)
+		if got.MaxAttempts != c.maxAttempts || fmt.Sprint(got.RetryOn) != fmt.Sprint(c.retryOn) {
+			t.Errorf("%s: %d attempts on %v, want %d on %v", c.name, got.MaxAttempts, got.RetryOn, c.maxAttempts, c.retryOn)
+		}
+	}
+	if override.MaxAttempts != 5 || len(override.RetryOn) != 0 {
+		t.Fatalf("override modified while filling the defaults: %+v", override)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	policy := defaultRetryPolicy()
+	cases := map[error]bool{
+		ErrTimeout:                            true,
+		fmt.Errorf("call: %w", ErrConnClosed): true,
+		ErrClientClosed:                       false,
+		&RemoteError{Code: 8034}:              false,
+		errors.New("other"):                   false,
+	}
+	for err, want := range cases {
+		if got := policy.retryable(err); got != want {
+			t.Errorf("retryable(%v) = %v, want %v", err, got, want)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := &RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, w := range want {
+		if got := policy.backoff(i + 1); got != w {
+			t.Errorf("retry %d: backoff %v, want %v", i+1, got, w)
+		}
+	}
+	if got := (&RetryPolicy{}).backoff(3); got != 0 {
+		t.Errorf("backoff %v without a configured backoff", got)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	if budget := newRetryBudget(nil); budget != nil {
+		t.Fatal("budget enabled without a config")
+	}
+	var disabled *retryBudget
+	for i := 0; i < 100; i++ {
+		if !disabled.onFailure() {
+			t.Fatal("retry refused without a budget")
+		}
+	}
+	disabled.onSuccess()
+
+	budget := newRetryBudget(&RetryBudget{MaxTokens: 4})
+	if budget.maxTokens != 4 || budget.tokenRatio != default_retry_budget_token_ratio {
+		t.Fatalf("budget %+v, want the default ratio when it is not set", budget)
+	}
+	// 4 tokens: retries allowed while more than 2 are left
+	if !budget.onFailure() {
+		t.Fatal("first retry refused")
+	}
+	if budget.onFailure() {
+		t.Fatal("retry allowed with half of the tokens left")
+	}
+	budget.onFailure()
+	budget.onFailure()
+	budget.onFailure()
+	if budget.tokens != 0 {
+		t.Fatalf("%v tokens, want 0 at least", budget.tokens)
+	}
+	// 0.1 token per success, 31 successes leave more than half once the failure is taken
+	for i := 0; i < 31; i++ {
+		budget.onSuccess()
+	}
+	if !budget.onFailure() {
+		t.Fatalf("retry refused after the budget refilled to %v tokens", budget.tokens+1)
+	}
+	for i := 0; i < 100; i++ {
+		budget.onSuccess()
+	}
+	if budget.tokens != budget.maxTokens {
+		t.Fatalf("%v tokens, want capped at %v", budget.tokens, budget.maxTokens)
+	}
+}
@@ -3,4 +3,39 @@ package gateway
 const (
 	req_timeout_sec        = 3
 	default_req_retry_time = 2
+	default_pool_size      = 2
+
+	default_reconnect_base_delay_ms = 1000
+	default_reconnect_max_delay_ms  = 60000
+	default_connect_timeout_ms      = 5000
+	default_failback_interval_sec   = 300
+
+	default_max_body_size         = 16 << 20
+	default_max_field_size        = 64 << 10
+	default_max_decompressed_size = 64 << 20
+
+	default_pooled_buffer_size = 4 << 10
+	max_pooled_buffer_size     = 1 << 20
+	default_read_buffer_size   = 32 << 10
+	default_write_buffer_size  = 64 << 10
+	default_write_queue_size   = 256
+
+	default_compress_threshold = 1024
+
+	default_max_missed_heartbeats = 3
+	default_handshake_timeout_ms  = 3000
+
+	default_stream_chunk_size      = 64 << 10
+	default_max_open_streams       = 64
+	default_stream_idle_timeout_ms = 60000
+
+	default_workers           = 8
+	default_worker_queue_size = 256
+
+	default_capture_max_size_mb = 100
+	default_capture_max_backups = 3
+
+	default_cert_refresh_interval_sec = 60
+	default_cert_renew_before_sec     = 24 * 3600
+	default_tls_reload_interval_sec   = 3600
 )
@@ -0,0 +1,295 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errStreamClosed is returned by the writes of a handler after its stream ended
+var errStreamClosed = errors.New("stream closed")
+
+// StreamHandler is an AgwHandler which can write its response in chunks. On the
+// connections which negotiated streaming, see Capabilities, HandleStream is called
+// instead of Handle and every chunk written to w is sent once it overflows, between
+// the other frames of the connection. Like the requests of the client, a response
+// which fits one chunk is sent as a single frame. Handle answers the gateways
+// without streaming.
+type StreamHandler interface {
+	AgwHandler
+	HandleStream(request string, w io.Writer) error
+}
+
+// A streamed body is sent as MessageTypeStream frames sharing the reqId and the
+// header of the message, each with a chunk of the body. A frame with an empty body
+// ends the stream, its innerCode and innerMsg are the ones of the whole message.
+
+// streamWriter sends the body written to it as the chunks of the stream of msg. A
+// chunk is sent when more bytes follow it, so that a body which fits one chunk is
+// sent as msg with a single frame.
+type streamWriter struct {
+	conn      *AgwConn
+	header    AgwMessage
+	chunkSize int
+	// the message type of msg, header has MessageTypeStream
+	messageType uint8
+
+	lock sync.Mutex
+	buf  []byte
+	// whether a chunk has been written to the connection
+	sent   bool
+	closed bool
+}
+
+func newStreamWriter(conn *AgwConn, msg *AgwMessage) *streamWriter {
+	chunkSize := default_stream_chunk_size
+	if limit := conn.peerMaxFrameSize(); limit > 0 && int(limit) < chunkSize {
+		chunkSize = int(limit)
+	}
+	w := &streamWriter{conn: conn, header: *msg, chunkSize: chunkSize, messageType: msg.messageType}
+	w.header.messageType = MessageTypeStream
+	w.header.body = ""
+	return w
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return 0, errStreamClosed
+	}
+	n := len(p)
+	for len(p) > 0 {
+		if w.buf == nil {
+			w.buf = make([]byte, 0, w.chunkSize)
+		}
+		if len(w.buf) == w.chunkSize {
+			if err := w.flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+		free := w.chunkSize - len(w.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+		w.buf = append(w.buf, p[:free]...)
+		p = p[free:]
+	}
+	return n, nil
+}
+
+// flush sends the buffered chunk, the caller must hold w.lock.
+func (w *streamWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	chunk := w.header
+	chunk.body = string(w.buf)
+	w.buf = w.buf[:0]
+	sent, err := w.conn.send(&chunk)
+	w.sent = w.sent || sent
+	if err != nil {
+		w.closed = true
+	}
+	return err
+}
+
+// close sends the buffered chunk and the end of the stream with the inner code and
+// message, the buffered chunk is dropped if code is not zero. If no chunk was sent,
+// the message is sent whole instead.
+func (w *streamWriter) close(code uint32, innerMsg string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return errStreamClosed
+	}
+	if !w.sent {
+		// nothing streamed yet, the whole message fits one frame
+		w.closed = true
+		whole := w.header
+		whole.messageType = w.messageType
+		whole.innerCode = code
+		whole.innerMsg = innerMsg
+		if code == 0 {
+			whole.body = string(w.buf)
+		}
+		sent, err := w.conn.send(&whole)
+		w.sent = sent
+		return err
+	}
+	if code == 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	w.closed = true
+	end := w.header
+	end.innerCode = code
+	end.innerMsg = innerMsg
+	sent, err := w.conn.send(&end)
+	w.sent = w.sent || sent
+	return err
+}
+
+func (w *streamWriter) wasSent() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.sent
+}
+
+// streaming tells whether the connection negotiated streamed bodies
+func (c *AgwConn) streaming() bool {
+	caps := c.capabilities()
+	return caps != nil && caps.Streaming
+}
+
+// sendStream sends msg as a stream, see send.
+func (c *AgwConn) sendStream(msg *AgwMessage) (bool, error) {
+	w := newStreamWriter(c, msg)
+	if _, err := io.WriteString(w, msg.body); err != nil {
+		return w.wasSent(), err
+	}
+	err := w.close(msg.innerCode, msg.innerMsg)
+	return w.wasSent(), err
+}
+
+// runStreamHandler runs the handler like runHandler, with its response streamed on
+// conn. A failure of the handler, a panic or the deadline ends the stream with an
+// error code, the chunks written before are not taken back.
+func runStreamHandler(handler StreamHandler, msg *AgwMessage, conn *AgwConn, deadline time.Time, release func()) error {
+	response := *msg
+	response.messageDirection = MessageDirectionResponse
+	response.innerCode = 0
+	response.innerMsg = "ok"
+	w := newStreamWriter(conn, &response)
+
+	done := make(chan error, 1)
+	go func() {
+		defer release()
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("handler panic: %v", r)
+			}
+		}()
+		done <- handler.HandleStream(msg.Body(), w)
+	}()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var err error
+	select {
+	case err = <-done:
+	case <-timeout:
+		err = errHandlerTimeout
+	}
+
+	if err == nil {
+		return w.close(0, "ok")
+	}
+	code := uint32(InnerCodeHandlerError)
+	if err == errHandlerTimeout {
+		code = InnerCodeHandlerTimeout
+	}
+	w.close(code, fmt.Sprintf("executing client handler wrong : %s", err.Error()))
+	return err
+}
+
+type streamKey struct {
+	syncId    string
+	direction uint8
+}
+
+type streamBuffer struct {
+	msg  *AgwMessage
+	body strings.Builder
+	// when the last chunk arrived
+	lastSeen time.Time
+}
+
+// StreamAssembler joins the chunks of the streams received on one connection into
+// whole MessageTypeBiz messages. At most default_max_open_streams are open at once,
+// the partial bodies of the streams idle for default_stream_idle_timeout_ms are
+// dropped. It is not safe for concurrent use.
+type StreamAssembler struct {
+	limit       uint32
+	maxStreams  int
+	idleTimeout time.Duration
+	streams     map[streamKey]*streamBuffer
+}
+
+// NewStreamAssembler returns an assembler failing the streams whose body exceeds
+// limit, 0 meaning default_max_decompressed_size.
+func NewStreamAssembler(limit uint32) *StreamAssembler {
+	if limit == 0 {
+		limit = default_max_decompressed_size
+	}
+	return &StreamAssembler{
+		limit:       limit,
+		maxStreams:  default_max_open_streams,
+		idleTimeout: default_stream_idle_timeout_ms * time.Millisecond,
+		streams:     make(map[streamKey]*streamBuffer),
+	}
+}
+
+// Add takes a MessageTypeStream frame, it returns the whole message once the frame
+// ends its stream, nil before. A body beyond the limit, or a stream beyond the open
+// streams, fails with a *DecodeError.
+func (a *StreamAssembler) Add(msg *AgwMessage) (*AgwMessage, error) {
+	now := time.Now()
+	a.Expire(now)
+	key := streamKey{syncId: msg.getSyncId(), direction: msg.messageDirection}
+	s, ok := a.streams[key]
+	if msg.body == "" {
+		delete(a.streams, key)
+		whole := *msg
+		if ok {
+			whole = *s.msg
+			whole.body = s.body.String()
+			whole.innerCode = msg.innerCode
+			whole.innerMsg = msg.innerMsg
+		}
+		whole.messageType = MessageTypeBiz
+		return &whole, nil
+	}
+	if !ok {
+		if len(a.streams) >= a.maxStreams {
+			return nil, &DecodeError{Field: "stream", Size: uint64(len(a.streams) + 1), Limit: uint64(a.maxStreams), Err: ErrTooManyStreams}
+		}
+		header := *msg
+		header.body = ""
+		s = &streamBuffer{msg: &header}
+		a.streams[key] = s
+	}
+	if size := uint64(s.body.Len()) + uint64(len(msg.body)); size > uint64(a.limit) {
+		delete(a.streams, key)
+		return nil, &DecodeError{Field: "stream", Size: size, Limit: uint64(a.limit), Err: ErrFrameTooLarge}
+	}
+	s.body.WriteString(msg.body)
+	s.lastSeen = now
+	return nil, nil
+}
+
+// Expire drops the partial bodies of the streams which got no chunk within the idle
+// timeout before now. Add calls it, the reader of a connection also calls it on the
+// other frames so that the buffers of abandoned streams do not wait for a next stream.
+func (a *StreamAssembler) Expire(now time.Time) {
+	for key, s := range a.streams {
+		if now.Sub(s.lastSeen) > a.idleTimeout {
+			logWarnf("[AGW] Drop the stream of reqId:%d after %v without chunk, %d bytes received",
+				s.msg.reqId, a.idleTimeout, s.body.Len())
+			delete(a.streams, key)
+		}
+	}
+}
+
+// Len returns the number of open streams
+func (a *StreamAssembler) Len() int {
+	return len(a.streams)
+}
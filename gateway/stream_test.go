@@ -0,0 +1,108 @@
+package gateway
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newChunk returns a stream frame of the request reqId carrying body
+func newChunk(reqId uint64, direction uint8, body string) *AgwMessage {
+	msg := newTestMessage(direction, NoCompress, body)
+	msg.SetReqId(reqId)
+	msg.SetMessageType(MessageTypeStream)
+	return msg
+}
+
+func TestStreamAssemblerJoinsChunks(t *testing.T) {
+	a := NewStreamAssembler(0)
+	for _, chunk := range []string{"first,", "second,", "third"} {
+		if whole, err := a.Add(newChunk(1, MessageDirectionResponse, chunk)); whole != nil || err != nil {
+			t.Fatalf("chunk %q ended the stream: %v, %v", chunk, whole, err)
+		}
+	}
+	// a request sharing the reqId is another stream
+	if _, err := a.Add(newChunk(1, MessageDirectionRequest, "request")); err != nil {
+		t.Fatal(err)
+	}
+	if a.Len() != 2 {
+		t.Fatalf("%d open streams, want 2", a.Len())
+	}
+
+	end := newChunk(1, MessageDirectionResponse, "")
+	end.SetInnerCode(InnerCodeHandlerError)
+	end.SetInnerMsg("failed")
+	whole, err := a.Add(end)
+	if err != nil || whole == nil {
+		t.Fatalf("empty chunk did not end the stream: %v, %v", whole, err)
+	}
+	if whole.MessageType() != MessageTypeBiz || whole.Body() != "first,second,third" {
+		t.Fatalf("joined message of type %d with body %q", whole.MessageType(), whole.Body())
+	}
+	if whole.InnerCode() != InnerCodeHandlerError || whole.InnerMsg() != "failed" {
+		t.Fatalf("joined message [%d:%s], want the code of the last frame", whole.InnerCode(), whole.InnerMsg())
+	}
+	if a.Len() != 1 {
+		t.Fatalf("%d open streams after the end of one, want 1", a.Len())
+	}
+
+	// an empty chunk without a stream is a message with an empty body
+	whole, err = a.Add(newChunk(2, MessageDirectionResponse, ""))
+	if err != nil || whole == nil || whole.MessageType() != MessageTypeBiz || whole.Body() != "" {
+		t.Fatalf("empty stream ended with %v, %v", whole, err)
+	}
+}
+
+func TestStreamAssemblerLimits(t *testing.T) {
+	a := NewStreamAssembler(10)
+	if _, err := a.Add(newChunk(1, MessageDirectionRequest, "123456")); err != nil {
+		t.Fatal(err)
+	}
+	_, err := a.Add(newChunk(1, MessageDirectionRequest, "78901"))
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || !errors.Is(err, ErrFrameTooLarge) || decodeErr.Size != 11 || decodeErr.Limit != 10 {
+		t.Fatalf("body beyond the limit returned %v, want %v", err, ErrFrameTooLarge)
+	}
+	if a.Len() != 0 {
+		t.Fatal("stream beyond the limit kept open")
+	}
+	if _, err := a.Add(newChunk(2, MessageDirectionRequest, strings.Repeat("x", 10))); err != nil {
+		t.Fatalf("body at the limit returned %v", err)
+	}
+
+	a = NewStreamAssembler(0)
+	a.maxStreams = 2
+	for reqId := uint64(1); reqId <= 2; reqId++ {
+		if _, err := a.Add(newChunk(reqId, MessageDirectionRequest, "chunk")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.Add(newChunk(3, MessageDirectionRequest, "chunk")); !errors.Is(err, ErrTooManyStreams) {
+		t.Fatalf("stream beyond the open streams returned %v, want %v", err, ErrTooManyStreams)
+	}
+	if _, err := a.Add(newChunk(1, MessageDirectionRequest, "more")); err != nil {
+		t.Fatalf("chunk of an open stream refused at the open streams limit: %v", err)
+	}
+}
+
+func TestStreamAssemblerExpire(t *testing.T) {
+	a := NewStreamAssembler(0)
+	a.idleTimeout = 50 * time.Millisecond
+	if _, err := a.Add(newChunk(1, MessageDirectionRequest, "stale")); err != nil {
+		t.Fatal(err)
+	}
+	a.Expire(time.Now())
+	if a.Len() != 1 {
+		t.Fatal("stream dropped before the idle timeout")
+	}
+	a.Expire(time.Now().Add(100 * time.Millisecond))
+	if a.Len() != 0 {
+		t.Fatal("idle stream not dropped")
+	}
+	// the end of the dropped stream carries none of its chunks
+	whole, err := a.Add(newChunk(1, MessageDirectionRequest, ""))
+	if err != nil || whole.Body() != "" {
+		t.Fatalf("end of a dropped stream returned %q, %v", whole.Body(), err)
+	}
+}
@@ -1,38 +1,46 @@
 package gateway
 
 import (
-	"errors"
-	"fmt"
+	"context"
 	"strings"
-	"time"
+	"sync/atomic"
 )
 
-func wait(conn *AgwConn, msg *AgwMessage) (*AgwMessage, error) {
+// register creates the channel receiving the response of msg, it has to be
+// done before the request is written.
+func register(conn *AgwConn, msg *AgwMessage) (string, chan *AgwMessage, error) {
 	msgId := msg.getSyncId()
 	channel := make(chan *AgwMessage, 1)
 
-	_, loaded := conn.channels.LoadOrStore(msgId, channel)
-
-	if loaded {
-		close(channel)
-		return nil, errors.New(ErrorMsgDupId)
+	if _, loaded := conn.channels.LoadOrStore(msgId, channel); loaded {
+		return "", nil, ErrDuplicateId
 	}
+	atomic.AddInt32(&conn.inFlight, 1)
+	return msgId, channel, nil
+}
+
+func unregister(conn *AgwConn, msgId string) {
+	conn.channels.Delete(msgId)
+	atomic.AddInt32(&conn.inFlight, -1)
+}
 
-	ticker := time.NewTicker(req_timeout_sec * time.Second)
-	defer ticker.Stop()
+// wait blocks until the response of the registered request arrives or ctx is done. The
+// deadline of ctx is reported as a request timeout, so that the caller may retry it.
+// The channel is never closed, a late notify or connection close can still send to it.
+func wait(ctx context.Context, conn *AgwConn, msgId string, channel chan *AgwMessage) (*AgwMessage, error) {
+	defer unregister(conn, msgId)
 
 	select {
 	case msg := <-channel:
-		conn.channels.Delete(msgId)
-		close(channel)
-
 		if strings.Compare(msg.innerMsg, ErrorMsgConnClosed) == 0 {
-			return nil, errors.New(ErrorMsgConnClosed)
+			return nil, ErrConnClosed
 		}
 		return msg, nil
-	case <-ticker.C:
-		conn.channels.Delete(msgId)
-		return nil, errors.New(fmt.Sprintf(ErrorMsgRequestTimeout))
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrTimeout
+		}
+		return nil, ctx.Err()
 	}
 }
 
@@ -47,6 +55,10 @@ func notify(conn *AgwConn, msg *AgwMessage) {
 
 	conn.channels.Delete(msgId)
 	if ch, ok := channel.(chan *AgwMessage); ok {
-		ch <- msg
+		// never block the reader, the channel may be filled by a connection close already
+		select {
+		case ch <- msg:
+		default:
+		}
 	}
 }
@@ -0,0 +1,167 @@
+package gateway
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// TlsConfig controls how the certificate of the gateway is verified when TlsFlag is set.
+type TlsConfig struct {
+	// ServerName is verified against the gateway certificate, it defaults to the gateway host
+	ServerName string
+	// CaFile is a PEM bundle of the trusted roots. If it is empty, the gateway
+	// certificate downloaded to CertPath is the trusted root.
+	CaFile string
+	// UseSystemRoots trusts the roots of the system together with CaFile or the
+	// downloaded certificate, they are not trusted by default
+	UseSystemRoots bool
+	// CertFile and KeyFile are the PEM client certificate and key for mutual TLS
+	CertFile string
+	KeyFile  string
+	// CertSpki lists base64 encoded SHA-256 digests of SubjectPublicKeyInfo which
+	// authenticate the certificate downloaded to CertPath: every certificate of the
+	// download has a pinned key or is signed by one which has. Pinning the key of the
+	// issuer, or a key kept across renewals, lets the renewed certificates in. When it
+	// is empty, the keys of the first download are pinned, see certPinPath.
+	CertSpki []string
+	// PinnedSpki lists base64 encoded SHA-256 digests of SubjectPublicKeyInfo, when set
+	// one certificate of the verified chain has to match one of them
+	PinnedSpki []string
+	// InsecureSkipVerify disables the verification of the chain and the server name,
+	// pins are still checked. It is meant for tests only.
+	InsecureSkipVerify bool
+}
+
+// usesDownloadedCert tells whether the gateway certificate downloaded to CertPath is the
+// trusted root, it is unless a CaFile replaces it.
+func (t TlsConfig) usesDownloadedCert() bool {
+	return t.CaFile == "" && !t.InsecureSkipVerify
+}
+
+// buildTlsConfig builds the client TLS config of the gateway connections.
+func buildTlsConfig(config AgwConfig) (*tls.Config, error) {
+	tlsConfig := config.Tls
+	conf := &tls.Config{
+		ServerName:         tlsConfig.ServerName,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: tlsConfig.InsecureSkipVerify,
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = config.GatewayIp
+	}
+
+	roots, err := loadRootCAs(tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	conf.RootCAs = roots
+
+	if tlsConfig.CertFile != "" || tlsConfig.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client cert failed, %v", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(tlsConfig.PinnedSpki) > 0 {
+		pins := make(map[string]bool, len(tlsConfig.PinnedSpki))
+		for _, pin := range tlsConfig.PinnedSpki {
+			pins[pin] = true
+		}
+		conf.VerifyPeerCertificate = verifyPins(pins)
+	}
+	if tlsConfig.InsecureSkipVerify {
+		logWarn("[AGW] TLS verification of the gateway is disabled")
+	}
+	return conf, nil
+}
+
+// loadRootCAs returns the trusted roots: CaFile or the downloaded certificate, and the
+// roots of the system if UseSystemRoots is set.
+func loadRootCAs(tlsConfig TlsConfig) (*x509.CertPool, error) {
+	caFile := tlsConfig.CaFile
+	if tlsConfig.usesDownloadedCert() {
+		caFile = CertPath
+	}
+	var roots *x509.CertPool
+	if tlsConfig.UseSystemRoots {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("load system cert pool failed, %v", err)
+		}
+		roots = pool
+	} else {
+		roots = x509.NewCertPool()
+	}
+	if caFile == "" {
+		return roots, nil
+	}
+	caBytes, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read cert file failed, %v", err)
+	}
+	if !roots.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("parse cert file failed, %s", caFile)
+	}
+	return roots, nil
+}
+
+// verifyPins checks the SPKI pins against the verified chains, or against the raw
+// certificates when the chain is not verified.
+func verifyPins(pins map[string]bool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if pins[spkiDigest(cert)] {
+					return nil
+				}
+			}
+		}
+		if len(verifiedChains) == 0 {
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err == nil && pins[spkiDigest(cert)] {
+					return nil
+				}
+			}
+		}
+		return errors.New("no certificate of the gateway matches the pinned public keys")
+	}
+}
+
+func spkiDigest(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// getTlsConn dials the endpoint and does the TLS handshake within the deadline of ctx.
+// Without a configured server name, the certificate is verified against the host of the endpoint.
+func getTlsConn(ctx context.Context, config AgwConfig, endpoint Endpoint, dial DialFunc, certs *certManager) (net.Conn, error) {
+	conf, err := certs.current()
+	if err != nil {
+		return nil, err
+	}
+	if config.Tls.ServerName == "" && conf.ServerName != endpoint.Host {
+		conf = conf.Clone()
+		conf.ServerName = endpoint.Host
+	}
+	rawConn, err := dial(ctx, "tcp", endpoint.address())
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(rawConn, conf)
+	err = withDeadline(ctx, rawConn, conn.Handshake)
+	if err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
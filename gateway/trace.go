@@ -0,0 +1,164 @@
+package gateway
+
+import "context"
+
+// Names of the spans started by the client
+const (
+	// SpanCall is a call of the client, from Call to its result, retries included
+	SpanCall = "agw.call"
+	// SpanAttempt is one attempt of a call, a child of its SpanCall
+	SpanAttempt = "agw.attempt"
+	// SpanHandle is a request of the gateway run by a handler of the client
+	SpanHandle = "agw.handle"
+)
+
+// Keys of the span attributes
+const (
+	AttrServerName  = "agw.server_name"
+	AttrHandlerName = "agw.handler_name"
+	// AttrOuterReqId is the request id shared by the client, the gateway and the
+	// console, the key to correlate the spans of a request across them
+	AttrOuterReqId = "agw.outer_req_id"
+	AttrReqId      = "agw.req_id"
+	AttrConnId     = "agw.conn_id"
+	// AttrAttempt numbers the attempts of a call from 1
+	AttrAttempt = "agw.attempt"
+	// AttrRetries is the number of attempts of a call after the first one
+	AttrRetries   = "agw.retry_count"
+	AttrInnerCode = "agw.inner_code"
+)
+
+// Attribute is a key and value set on a span, the values are strings, integers or bools.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Tracer starts the spans of the calls, of their attempts and of the requests of the
+// gateway, see AgwConfig.Tracer. It is called concurrently.
+type Tracer interface {
+	// StartSpan starts a span named name, a child of the span carried by ctx if any.
+	// The returned context carries the new span.
+	StartSpan(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is an operation traced by a Tracer.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	// End ends the span, err is the failure of the operation, nil if it succeeded.
+	// It is called exactly once.
+	End(err error)
+}
+
+type noopTracer struct{}
+
+func (noopTracer) StartSpan(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(attrs ...Attribute) {}
+
+func (noopSpan) End(err error) {}
+
+// SpanKind is the kind of an OpenTelemetry span, with the values of trace.SpanKind
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// StatusCode is the status of an OpenTelemetry span, with the values of codes.Code
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusError StatusCode = 1
+	StatusOk    StatusCode = 2
+)
+
+// OtelSpan is the part of an OpenTelemetry trace.Span driven by the adapter, see
+// NewOtelTracer. A trace.Span fits it with a thin wrapper converting the attributes
+// with attribute.String, attribute.Int64 and attribute.Bool.
+type OtelSpan interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	SetStatus(code StatusCode, description string)
+	End()
+}
+
+// OtelStartFunc starts an OpenTelemetry span, typically with trace.Tracer.Start and
+// trace.WithSpanKind(trace.SpanKind(kind)).
+type OtelStartFunc func(ctx context.Context, name string, kind SpanKind) (context.Context, OtelSpan)
+
+// NewOtelTracer returns a Tracer creating OpenTelemetry spans which follow the RPC
+// conventions: the attempts are client spans and the requests of the gateway server
+// spans, named "serverName/handlerName", with rpc.system "agw", rpc.service and
+// rpc.method. The other attributes keep their agw.* keys.
+func NewOtelTracer(start OtelStartFunc) Tracer {
+	return &otelTracer{start: start}
+}
+
+type otelTracer struct {
+	start OtelStartFunc
+}
+
+func (t *otelTracer) StartSpan(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	kind := SpanKindInternal
+	switch name {
+	case SpanAttempt:
+		kind = SpanKindClient
+	case SpanHandle:
+		kind = SpanKindServer
+	}
+	var serverName, handlerName string
+	for _, attr := range attrs {
+		switch attr.Key {
+		case AttrServerName:
+			serverName, _ = attr.Value.(string)
+		case AttrHandlerName:
+			handlerName, _ = attr.Value.(string)
+		}
+	}
+	spanName := handlerName
+	if serverName != "" {
+		spanName = serverName + "/" + handlerName
+	}
+	if spanName == "" {
+		spanName = name
+	}
+
+	ctx, span := t.start(ctx, spanName, kind)
+	s := &otelSpan{span: span}
+	s.SetAttributes(append([]Attribute{{Key: "rpc.system", Value: "agw"}, {Key: "agw.span", Value: name}}, attrs...)...)
+	return ctx, s
+}
+
+type otelSpan struct {
+	span OtelSpan
+}
+
+func (s *otelSpan) SetAttributes(attrs ...Attribute) {
+	mapped := make([]Attribute, len(attrs))
+	for i, attr := range attrs {
+		mapped[i] = attr
+		switch attr.Key {
+		case AttrServerName:
+			mapped[i].Key = "rpc.service"
+		case AttrHandlerName:
+			mapped[i].Key = "rpc.method"
+		}
+	}
+	s.span.SetAttributes(mapped...)
+}
+
+func (s *otelSpan) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(StatusError, err.Error())
+	}
+	s.span.End()
+}
@@ -0,0 +1,123 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type otelKey struct{}
+
+// fakeOtelSpan records what the adapter does to an OpenTelemetry span
+type fakeOtelSpan struct {
+	name        string
+	kind        SpanKind
+	parent      *fakeOtelSpan
+	attrs       map[string]interface{}
+	errs        []error
+	status      StatusCode
+	description string
+	ended       int
+}
+
+func (s *fakeOtelSpan) SetAttributes(attrs ...Attribute) {
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *fakeOtelSpan) RecordError(err error) {
+	s.errs = append(s.errs, err)
+}
+
+func (s *fakeOtelSpan) SetStatus(code StatusCode, description string) {
+	s.status, s.description = code, description
+}
+
+func (s *fakeOtelSpan) End() {
+	s.ended++
+}
+
+func TestOtelTracer(t *testing.T) {
+	var started []*fakeOtelSpan
+	tracer := NewOtelTracer(func(ctx context.Context, name string, kind SpanKind) (context.Context, OtelSpan) {
+		parent, _ := ctx.Value(otelKey{}).(*fakeOtelSpan)
+		span := &fakeOtelSpan{name: name, kind: kind, parent: parent, attrs: make(map[string]interface{})}
+		started = append(started, span)
+		return context.WithValue(ctx, otelKey{}, span), span
+	})
+
+	ctx, call := tracer.StartSpan(context.Background(), SpanCall,
+		Attribute{Key: AttrServerName, Value: "Sentinel"},
+		Attribute{Key: AttrHandlerName, Value: "rule"},
+		Attribute{Key: AttrOuterReqId, Value: "outer-1"})
+	_, attempt := tracer.StartSpan(ctx, SpanAttempt,
+		Attribute{Key: AttrServerName, Value: "Sentinel"},
+		Attribute{Key: AttrHandlerName, Value: "rule"},
+		Attribute{Key: AttrAttempt, Value: 1})
+	attempt.SetAttributes(Attribute{Key: AttrConnId, Value: uint32(2)}, Attribute{Key: AttrHandlerName, Value: "renamed"})
+	failure := &RemoteError{Code: InnerCodeBusy, Msg: "busy"}
+	attempt.End(failure)
+	call.End(nil)
+	_, handle := tracer.StartSpan(context.Background(), SpanHandle, Attribute{Key: AttrHandlerName, Value: "connect"})
+	handle.End(nil)
+	_, anonymous := tracer.StartSpan(context.Background(), SpanHandle)
+	anonymous.End(nil)
+
+	if len(started) != 4 {
+		t.Fatalf("%d spans started, want 4", len(started))
+	}
+	cases := []struct {
+		name   string
+		kind   SpanKind
+		parent *fakeOtelSpan
+		span   string
+	}{
+		{"Sentinel/rule", SpanKindInternal, nil, SpanCall},
+		{"Sentinel/rule", SpanKindClient, started[0], SpanAttempt},
+		{"connect", SpanKindServer, nil, SpanHandle},
+		{SpanHandle, SpanKindServer, nil, SpanHandle},
+	}
+	for i, c := range cases {
+		span := started[i]
+		if span.name != c.name || span.kind != c.kind || span.parent != c.parent {
+			t.Errorf("span %d named %q of kind %d, want %q of kind %d", i, span.name, span.kind, c.name, c.kind)
+		}
+		if span.attrs["rpc.system"] != "agw" || span.attrs["agw.span"] != c.span {
+			t.Errorf("span %d has rpc.system %v and agw.span %v", i, span.attrs["rpc.system"], span.attrs["agw.span"])
+		}
+		if span.ended != 1 {
+			t.Errorf("span %d ended %d times", i, span.ended)
+		}
+	}
+
+	// the service and method follow the RPC conventions, the other keys are kept
+	call0, attempt0 := started[0], started[1]
+	if call0.attrs["rpc.service"] != "Sentinel" || call0.attrs["rpc.method"] != "rule" || call0.attrs[AttrOuterReqId] != "outer-1" {
+		t.Fatalf("call attributes %v", call0.attrs)
+	}
+	if _, ok := call0.attrs[AttrServerName]; ok {
+		t.Fatalf("call attributes %v keep %s", call0.attrs, AttrServerName)
+	}
+	if attempt0.attrs["rpc.method"] != "renamed" || attempt0.attrs[AttrConnId] != uint32(2) || attempt0.attrs[AttrAttempt] != 1 {
+		t.Fatalf("attempt attributes %v", attempt0.attrs)
+	}
+
+	if len(attempt0.errs) != 1 || !errors.Is(attempt0.errs[0], failure) || attempt0.status != StatusError || attempt0.description != failure.Error() {
+		t.Fatalf("failed attempt recorded %v with status %d %q", attempt0.errs, attempt0.status, attempt0.description)
+	}
+	// a success leaves the status unset, as the RPC conventions ask of client spans
+	if len(call0.errs) != 0 || call0.status != StatusUnset {
+		t.Fatalf("successful call recorded %v with status %d", call0.errs, call0.status)
+	}
+}
+
+func TestNoopTracer(t *testing.T) {
+	ctx := context.WithValue(context.Background(), otelKey{}, "parent")
+	spanCtx, span := noopTracer{}.StartSpan(ctx, SpanCall, Attribute{Key: AttrReqId, Value: uint64(1)})
+	if spanCtx != ctx {
+		t.Fatal("noop tracer changed the context")
+	}
+	span.SetAttributes(Attribute{Key: AttrRetries, Value: 0})
+	span.End(errors.New("failed"))
+}
@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// writeRequest is a frame queued to the writer coroutine of a connection
+type writeRequest struct {
+	msg  *AgwMessage
+	done chan error
+	// set before done is signaled, whether the frame went (maybe partially) to the socket
+	written bool
+}
+
+// runWriterCoroutine is the only writer of the connection: it encodes the queued
+// frames into one buffer, coalescing the frames queued meanwhile, and writes them
+// with a single Write.
+func runWriterCoroutine(conn *AgwConn) {
+	logInfof("AGW writer coroutine %d started", conn.connId)
+
+	threshold := conn.pool.client.config.CompressThreshold
+	buf := make([]byte, 0, default_write_buffer_size)
+	batch := make([]*writeRequest, 0, default_write_queue_size)
+	for {
+		var maxBody uint32
+		select {
+		case req := <-conn.writeCh:
+			maxBody = conn.peerMaxFrameSize()
+			buf, batch = encodeRequest(buf[:0], batch[:0], req, threshold, maxBody)
+		case <-conn.closing:
+			return
+		}
+
+	coalesce:
+		for len(buf) < default_write_buffer_size {
+			select {
+			case req := <-conn.writeCh:
+				buf, batch = encodeRequest(buf, batch, req, threshold, maxBody)
+			default:
+				break coalesce
+			}
+		}
+
+		if len(batch) == 0 {
+			continue
+		}
+		var err error
+		if _, e := (*conn.conn).Write(buf); e != nil {
+			logWarnf("[AGW] gateway write err: %+v", e.Error())
+			err = fmt.Errorf("%w: %v", ErrConnClosed, e)
+		}
+		if r := conn.pool.client.recorder; r != nil && err == nil {
+			for _, req := range batch {
+				r.record(CaptureOutbound, conn.connId, req.msg)
+			}
+		}
+		for _, req := range batch {
+			req.written = true
+			req.done <- err
+		}
+		if err != nil {
+			conn.close()
+			return
+		}
+		if cap(buf) > default_write_buffer_size*4 {
+			// do not keep the buffer of an exceptionally large frame
+			buf = make([]byte, 0, default_write_buffer_size)
+		}
+	}
+}
+
+// encodeRequest appends the frame of req to buf, a frame which can not be encoded
+// or whose body exceeds maxBody, if not zero, fails its own request only.
+func encodeRequest(buf []byte, batch []*writeRequest, req *writeRequest, threshold int, maxBody uint32) ([]byte, []*writeRequest) {
+	start := len(buf)
+	buf, err := req.msg.appendFrame(buf, threshold)
+	if err != nil {
+		req.done <- fmt.Errorf("encode wrong: %v", err)
+		return buf, batch
+	}
+	if size := binary.BigEndian.Uint32(buf[start:]); maxBody > 0 && size > maxBody {
+		req.done <- fmt.Errorf("%w: body of %d bytes exceeds the gateway limit %d", ErrFrameTooLarge, size, maxBody)
+		return buf[:start], batch
+	}
+	return buf, append(batch, req)
+}
@@ -0,0 +1,111 @@
+package gateway
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingConn counts the Write calls, the syscalls the writer saves
+type countingConn struct {
+	net.Conn
+	writes int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	return c.Conn.Write(p)
+}
+
+func (c *countingConn) report(b *testing.B) {
+	b.ReportMetric(float64(atomic.LoadInt64(&c.writes))/float64(b.N), "writes/op")
+}
+
+// newBenchConn returns a TCP loopback connection whose peer discards what it reads
+func newBenchConn(b *testing.B) *countingConn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		peer, err := listener.Accept()
+		listener.Close()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- peer
+		io.Copy(ioutil.Discard, peer)
+		peer.Close()
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	if <-accepted == nil {
+		b.Fatal("accept failed")
+	}
+	return &countingConn{Conn: conn}
+}
+
+// benchSenders is the number of concurrent senders per GOMAXPROCS
+const benchSenders = 16
+
+func newBenchMessage() *AgwMessage {
+	return newTestMessage(MessageDirectionRequest, NoCompress, `{"resource":"GET:/api/orders","passQps":12,"blockQps":0}`)
+}
+
+// BenchmarkWriter sends small frames from concurrent callers. The direct case is the
+// write path before the writer coroutine, every caller encodes its frame and writes
+// it to the socket itself. The coalesced case queues the frames to the writer
+// coroutine, which writes the frames queued meanwhile with one Write.
+func BenchmarkWriter(b *testing.B) {
+	b.Run("direct", func(b *testing.B) {
+		conn := newBenchConn(b)
+		defer conn.Close()
+		b.ReportAllocs()
+		b.SetParallelism(benchSenders)
+		b.RunParallel(func(pb *testing.PB) {
+			msg := newBenchMessage()
+			for pb.Next() {
+				frame, _ := msg.Encode()
+				if _, err := conn.Write(frame); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+		conn.report(b)
+	})
+	b.Run("coalesced", func(b *testing.B) {
+		pool := &ConnectionPool{client: newAgwClient(), slots: []*connSlot{{}}, size: 1}
+		counting := newBenchConn(b)
+		conn := newAgwConn(0, counting, pool)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runWriterCoroutine(conn)
+		}()
+		defer func() {
+			conn.close()
+			wg.Wait()
+		}()
+		b.ReportAllocs()
+		b.SetParallelism(benchSenders)
+		b.RunParallel(func(pb *testing.PB) {
+			msg := newBenchMessage()
+			for pb.Next() {
+				if _, err := conn.send(msg); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+		counting.report(b)
+	})
+}
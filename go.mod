@@ -8,6 +8,8 @@ require (
 	github.com/buger/jsonparser v0.0.0-20191204142016-1a29609e0929 // indirect
 	github.com/go-ole/go-ole v1.2.5 // indirect
 	github.com/golang/mock v1.4.0 // indirect
+	github.com/golang/snappy v0.0.4
+	github.com/klauspost/compress v1.12.3
 	github.com/kr/text v0.2.0 // indirect
 	github.com/nacos-group/nacos-sdk-go v1.0.9
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
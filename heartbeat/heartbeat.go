@@ -1,8 +1,8 @@
 package heartbeat
 
 import (
+	"context"
 	"github.com/sumansoul/aliyun-ahas-go-sdk/logger"
-	"github.com/sumansoul/aliyun-ahas-go-sdk/meta"
 	"github.com/sumansoul/aliyun-ahas-go-sdk/tools"
 	"github.com/sumansoul/aliyun-ahas-go-sdk/transport"
 	"time"
@@ -18,6 +18,8 @@ type Config struct {
 
 type heartbeat struct {
 	period time.Duration
+	ctx    context.Context
+	cancel context.CancelFunc
 	*transport.Transport
 }
 
@@ -28,8 +30,11 @@ func New(config Config, trans *transport.Transport) *heartbeat {
 	}
 	handler := &GetPingHandler().AgwRequestHandler
 	trans.RegisterHandler(transport.Ping, handler)
+	ctx, cancel := context.WithCancel(context.Background())
 	return &heartbeat{
 		period:    time.Duration(config.PeriodMs) * time.Millisecond,
+		ctx:       ctx,
+		cancel:    cancel,
 		Transport: trans,
 	}
 }
@@ -39,20 +44,32 @@ func (beat *heartbeat) Start() *heartbeat {
 	ticker := time.NewTicker(beat.period)
 	go func() {
 		defer tools.PrintPanicStack()
-		for range ticker.C {
-			uri := transport.NewUri(transport.SentinelService, transport.Heartbeat)
-			request := transport.NewRequest()
-			beat.sendHeartbeat(uri, request)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				uri := transport.NewUri(transport.SentinelService, transport.Heartbeat)
+				request := transport.NewRequest()
+				beat.sendHeartbeat(uri, request)
+			case <-beat.ctx.Done():
+				logger.Info("AGW heartbeat service stopped")
+				return
+			}
 		}
 	}()
 	logger.Infof("AGW heartbeat service started successfully, cid: %s, ver: %s, vpcId: %s",
-		meta.Cid(), meta.CurrentVersion(), meta.VpcId())
-	return nil
+		beat.Metadata().Cid(), beat.Metadata().Version(), beat.Metadata().VpcId())
+	return beat
+}
+
+//Stop heartbeat service, the heartbeat in flight is cancelled
+func (beat *heartbeat) Stop() {
+	beat.cancel()
 }
 
 // sendHeartbeat
 func (beat *heartbeat) sendHeartbeat(uri transport.Uri, request *transport.Request) {
-	response, err := beat.Invoke(uri, request)
+	response, err := beat.InvokeContext(beat.ctx, uri, request)
 	if err != nil {
 		logger.Warnf("Send heartbeat failed: %s", err.Error())
 		beat.record(false)
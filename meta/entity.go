@@ -1,28 +1,48 @@
 package meta
 
+import "sync"
+
 type Meta struct {
 	license   string
 	namespace string
 	deployEnv string
 
-	inVpc        bool
-	regionId     string
-	vpcId        string
-	privateIp    string
-	hostIp       string
-	hostName     string
-	pid          string
-	cid          string
-	tid          string
-	instanceId   string
-	deviceType   int
-	uid          string
-	version      string
-	ahasEndpoint string
+	inVpc      bool
+	regionId   string
+	vpcId      string
+	privateIp  string
+	hostIp     string
+	hostName   string
+	pid        string
+	cid        string
+	tid        string
+	instanceId string
+	deviceType int
+	uid        string
+	version    string
+	// in preference order, see AhasEndpoints
+	ahasEndpoints []Endpoint
+	// the plain endpoint when the transport is secure and the region has a TLS one
+	insecureEndpoint string
 
 	tidChan chan string
 
 	debugging bool
+
+	// guards uid, tid and cid which are refreshed on every connect handshake
+	lock sync.RWMutex
+}
+
+func (m *Meta) License() string {
+	return m.license
+}
+
+func (m *Meta) Namespace() string {
+	return m.namespace
+}
+
+func (m *Meta) DeployEnv() string {
+	return m.deployEnv
 }
 
 func (m *Meta) TidChan() chan string {
@@ -30,19 +50,31 @@ func (m *Meta) TidChan() chan string {
 }
 
 func (m *Meta) SetUid(uid string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	m.uid = uid
 }
 
 func (m *Meta) SetTid(tid string) {
+	m.lock.Lock()
 	m.tid = tid
-	m.tidChan <- tid
+	m.lock.Unlock()
+	// the handshake may run again after reconnection, never block on a full channel
+	select {
+	case m.tidChan <- tid:
+	default:
+	}
 }
 
 func (m *Meta) SetCid(cid string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	m.cid = cid
 }
 
 func (m *Meta) Cid() string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
 	return m.cid
 }
 
@@ -55,10 +87,14 @@ func (m *Meta) InstanceId() string {
 }
 
 func (m *Meta) Tid() string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
 	return m.tid
 }
 
 func (m *Meta) Uid() string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
 	return m.uid
 }
 
@@ -66,8 +102,31 @@ func (m *Meta) Pid() string {
 	return m.pid
 }
 
+// Endpoint is a host:port address of the AHAS gateway
+type Endpoint struct {
+	Address string
+	Tls     bool
+}
+
+// AhasEndpoint returns the address of the preferred gateway endpoint
 func (m *Meta) AhasEndpoint() string {
-	return m.ahasEndpoint
+	if len(m.ahasEndpoints) == 0 {
+		return ""
+	}
+	return m.ahasEndpoints[0].Address
+}
+
+// AhasEndpoints returns the gateway endpoints of the env and region: the TLS endpoint
+// when the transport is secure and the region has one, the plain one otherwise.
+func (m *Meta) AhasEndpoints() []Endpoint {
+	return m.ahasEndpoints
+}
+
+// AhasInsecureEndpoint returns the plain endpoint of the env and region when the
+// transport is secure and the region has a TLS endpoint, empty otherwise. It is only dialed when the transport opts in
+// to the insecure fallback.
+func (m *Meta) AhasInsecureEndpoint() string {
+	return m.insecureEndpoint
 }
 
 func (m *Meta) HostName() string {
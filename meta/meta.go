@@ -44,7 +44,49 @@ func resolvePrivateIp(inVpc bool, deviceType int) (string, error) {
 	return ip, nil
 }
 
+// InitMetadata resolves the metadata of the default instance, which backs the package level functions
 func InitMetadata(license, namespace, env, regionId string, secureTransport bool) (*Meta, error) {
+	return resolveMetadata(metadata, license, namespace, env, regionId, secureTransport)
+}
+
+// NewMetadata resolves a standalone metadata, the package level functions are not affected
+func NewMetadata(license, namespace, env, regionId string, secureTransport bool) (*Meta, error) {
+	m := &Meta{
+		version: CurrentSdkVersion,
+		tidChan: make(chan string, 5),
+	}
+	return resolveMetadata(m, license, namespace, env, regionId, secureTransport)
+}
+
+// NewLocalMetadata returns a standalone metadata of a host outside of Aliyun which
+// connects to the given gateway endpoints instead of the ones of a region, e.g. a
+// gatewaytest server. Nothing is fetched from the instance metadata service.
+func NewLocalMetadata(license, namespace string, endpoints []Endpoint) (*Meta, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("no gateway endpoint")
+	}
+	ip, err := resolveFirstIp()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot resolve privateIp")
+	}
+	return &Meta{
+		license:       license,
+		namespace:     namespace,
+		regionId:      aliyun.CnPublic,
+		vpcId:         license,
+		hostName:      resolveHostName(),
+		instanceId:    resolveHostName(),
+		pid:           resolveProcessId(),
+		privateIp:     ip,
+		hostIp:        ip,
+		deviceType:    Host,
+		version:       CurrentSdkVersion,
+		ahasEndpoints: endpoints,
+		tidChan:       make(chan string, 5),
+	}, nil
+}
+
+func resolveMetadata(metadata *Meta, license, namespace, env, regionId string, secureTransport bool) (*Meta, error) {
 	metadata.license = license
 	metadata.namespace = namespace
 	metadata.deployEnv = env
@@ -100,23 +142,27 @@ func InitMetadata(license, namespace, env, regionId string, secureTransport bool
 	metadata.hostIp = hostIp
 
 	envKey := env + "-" + metadata.regionId
-	var endpoint string
-	var envSupported bool
+	var endpoints []Endpoint
+	plainEndpoint, _ := aliyun.GetAhasProxyEndpoint(envKey)
 	if secureTransport {
-		endpoint, envSupported = aliyun.GetAhasProxyTlsEndpoint(envKey)
-		if !envSupported {
-			// Fallback to non-TLS endpoint
-			endpoint, envSupported = aliyun.GetAhasProxyEndpoint(envKey)
+		if endpoint, ok := aliyun.GetAhasProxyTlsEndpoint(envKey); ok && endpoint != "" {
+			endpoints = append(endpoints, Endpoint{Address: endpoint, Tls: true})
+			// the plain endpoint is not a fallback of the TLS one unless the transport opts in
+			metadata.insecureEndpoint = plainEndpoint
+		} else if plainEndpoint != "" {
+			// Fallback to non-TLS endpoint, the region has no TLS one
+			logger.Warnf("No TLS AHAS endpoint in %s, using the plain endpoint %s", envKey, plainEndpoint)
+			endpoints = append(endpoints, Endpoint{Address: plainEndpoint})
 		}
-	} else {
-		endpoint, envSupported = aliyun.GetAhasProxyEndpoint(envKey)
+	} else if plainEndpoint != "" {
+		endpoints = append(endpoints, Endpoint{Address: plainEndpoint})
 	}
 
-	if !envSupported || endpoint == "" {
+	if len(endpoints) == 0 {
 		logger.Warn("No available AHAS endpoint, env not supported: " + envKey)
 		return nil, errors.New("No available AHAS endpoint, env not supported: " + envKey)
 	}
-	metadata.ahasEndpoint = endpoint
+	metadata.ahasEndpoints = endpoints
 	metadata.version = CurrentSdkVersion
 
 	return metadata, nil
@@ -155,7 +201,7 @@ func Pid() string {
 }
 
 func Cid() string {
-	return metadata.cid
+	return metadata.Cid()
 }
 
 func LocalIp() string {
@@ -179,11 +225,14 @@ func resolveHostName() string {
 	return name
 }
 
+// resolveFirstIp returns the first IPv4 address of the interfaces which are up,
+// or the first global IPv6 address on IPv6 only hosts.
 func resolveFirstIp() (string, error) {
 	ifs, err := net.Interfaces()
 	if err != nil {
 		return "", err
 	}
+	var ipv6 net.IP
 	for _, i := range ifs {
 		if i.Flags&net.FlagUp == 0 {
 			continue
@@ -210,12 +259,23 @@ func resolveFirstIp() (string, error) {
 			if ip == nil || ip.IsLoopback() {
 				continue
 			}
-			ip = ip.To4()
-			if ip == nil {
-				continue
+			if ip4 := ip.To4(); ip4 != nil {
+				return ip4.String(), nil
+			}
+			// link-local addresses are not routable without a zone
+			if ipv6 == nil && ip.IsGlobalUnicast() {
+				ipv6 = ip
 			}
-			return ip.String(), nil
 		}
 	}
+	if ipv6 != nil {
+		return ipv6.String(), nil
+	}
 	return "", errors.New("Cannot get host ip address")
 }
+
+// IsIpv6 returns whether ip is an IPv6 address, IPv4-mapped addresses are IPv4
+func IsIpv6(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() == nil
+}
@@ -0,0 +1,20 @@
+package meta
+
+import "testing"
+
+func TestIsIpv6(t *testing.T) {
+	cases := map[string]bool{
+		"10.0.0.1":        false,
+		"::ffff:10.0.0.1": false,
+		"2001:db8::1":     true,
+		"fe80::1":         true,
+		"::1":             true,
+		"":                false,
+		"not an ip":       false,
+	}
+	for ip, want := range cases {
+		if got := IsIpv6(ip); got != want {
+			t.Errorf("IsIpv6(%q) = %v, want %v", ip, got, want)
+		}
+	}
+}
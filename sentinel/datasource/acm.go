@@ -2,6 +2,7 @@ package datasource
 
 import (
 	"encoding/json"
+	"sync"
 	"time"
 
 	"github.com/alibaba/sentinel-golang/core/circuitbreaker"
@@ -18,6 +19,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sumansoul/aliyun-ahas-go-sdk/logger"
 	"github.com/sumansoul/aliyun-ahas-go-sdk/meta"
+	"github.com/sumansoul/aliyun-ahas-go-sdk/tools"
 )
 
 const (
@@ -29,6 +31,30 @@ const (
 	ParamFlowRuleDataIdPrefix       = "param-flow-rule-"
 )
 
+// AcmDataSource loads the Sentinel rules of an application from ACM.
+type AcmDataSource struct {
+	acmHost   string
+	conf      Config
+	metadata  *meta.Meta
+	mutex     sync.Mutex
+	client    config_client.IConfigClient
+	listeners []vo.ConfigParam
+	closed    chan struct{}
+}
+
+var defaultAcm *AcmDataSource
+var defaultAcmMutex sync.Mutex
+
+// NewAcmDataSource creates an ACM data source, the rule listeners are registered by Start.
+func NewAcmDataSource(acmHost string, conf Config, m *meta.Meta) *AcmDataSource {
+	return &AcmDataSource{
+		acmHost:  acmHost,
+		conf:     conf,
+		metadata: m,
+		closed:   make(chan struct{}),
+	}
+}
+
 func formFlowRuleDataId(userId, namespace, appName string) string {
 	return FlowRuleDataIdPrefix + userId + "-" + namespace + "-" + appName
 }
@@ -45,20 +71,53 @@ func formParamFlowRuleDataId(userId, namespace, appName string) string {
 	return ParamFlowRuleDataIdPrefix + userId + "-" + namespace + "-" + appName
 }
 
+// InitAcm starts the default ACM data source, which can be closed by CloseAcm.
 func InitAcm(acmHost string, conf Config, m *meta.Meta) error {
+	defaultAcmMutex.Lock()
+	if defaultAcm == nil {
+		defaultAcm = NewAcmDataSource(acmHost, conf, m)
+	}
+	ds := defaultAcm
+	defaultAcmMutex.Unlock()
+	return ds.Start()
+}
+
+// CloseAcm closes the default ACM data source, an InitAcm still waiting for the
+// AHAS transport returns immediately.
+func CloseAcm() error {
+	defaultAcmMutex.Lock()
+	if defaultAcm == nil {
+		// InitAcm has not run yet, make it exit as soon as it runs
+		defaultAcm = &AcmDataSource{closed: make(chan struct{})}
+	}
+	ds := defaultAcm
+	defaultAcmMutex.Unlock()
+	return ds.Close()
+}
+
+// Start waits for the tid issued by the AHAS transport and registers the rule listeners.
+func (ds *AcmDataSource) Start() error {
+	select {
+	case <-ds.closed:
+		return errors.New("ACM data source closed")
+	default:
+	}
+	m := ds.metadata
 	ch := m.TidChan()
 	select {
 	case <-ch:
 		break
+	case <-ds.closed:
+		return errors.New("ACM data source closed")
 	case <-time.After(30 * time.Second):
 		return errors.New("wait AHAS transport timeout")
 	}
 
 	clientConfig := constant.ClientConfig{
-		TimeoutMs:      conf.TimeoutMs,
-		ListenInterval: conf.ListenIntervalMs,
+		TimeoutMs:      ds.conf.TimeoutMs,
+		ListenInterval: ds.conf.ListenIntervalMs,
 		NamespaceId:    m.Tid(),
-		Endpoint:       acmHost + ":8080",
+		Endpoint:       ds.acmHost + ":8080",
 	}
 	configClient, err := clients.CreateConfigClient(map[string]interface{}{
 		"clientConfig": clientConfig,
@@ -66,28 +125,37 @@ func InitAcm(acmHost string, conf Config, m *meta.Meta) error {
 	if err != nil {
 		return err
 	}
+	ds.mutex.Lock()
+	select {
+	case <-ds.closed:
+		ds.mutex.Unlock()
+		return errors.New("ACM data source closed")
+	default:
+	}
+	ds.client = configClient
+	ds.mutex.Unlock()
 
 	// Add flow/isolation rule config listener.
-	flowRuleDataId := formFlowRuleDataId(m.Uid(), meta.Namespace(), sentinelConf.AppName())
-	err = registerRuleDataSource(flowRuleDataId, onFlowRuleChange, configClient)
+	flowRuleDataId := formFlowRuleDataId(m.Uid(), m.Namespace(), sentinelConf.AppName())
+	err = ds.registerRuleDataSource(configClient, flowRuleDataId, onFlowRuleChange)
 	if err != nil {
 		return err
 	}
 	// Add system rule config listener.
-	systemRuleDataId := formSystemRuleDataId(m.Uid(), meta.Namespace(), sentinelConf.AppName())
-	err = registerRuleDataSource(systemRuleDataId, onSystemRuleChange, configClient)
+	systemRuleDataId := formSystemRuleDataId(m.Uid(), m.Namespace(), sentinelConf.AppName())
+	err = ds.registerRuleDataSource(configClient, systemRuleDataId, onSystemRuleChange)
 	if err != nil {
 		return err
 	}
 	// Add circuit breaking rule config listener.
-	circuitBreakerRuleDataId := formCircuitBreakingRuleDataId(m.Uid(), meta.Namespace(), sentinelConf.AppName())
-	err = registerRuleDataSource(circuitBreakerRuleDataId, onCircuitBreakingRuleChange, configClient)
+	circuitBreakerRuleDataId := formCircuitBreakingRuleDataId(m.Uid(), m.Namespace(), sentinelConf.AppName())
+	err = ds.registerRuleDataSource(configClient, circuitBreakerRuleDataId, onCircuitBreakingRuleChange)
 	if err != nil {
 		return err
 	}
 	// Add param flow rule config listener.
-	paramFlowRuleDataId := formParamFlowRuleDataId(m.Uid(), meta.Namespace(), sentinelConf.AppName())
-	err = registerRuleDataSource(paramFlowRuleDataId, onParamFlowRuleChange, configClient)
+	paramFlowRuleDataId := formParamFlowRuleDataId(m.Uid(), m.Namespace(), sentinelConf.AppName())
+	err = ds.registerRuleDataSource(configClient, paramFlowRuleDataId, onParamFlowRuleChange)
 	if err != nil {
 		return err
 	}
@@ -97,7 +165,17 @@ func InitAcm(acmHost string, conf Config, m *meta.Meta) error {
 	return nil
 }
 
-func registerRuleDataSource(dataId string, handler func(string), nacosClient config_client.IConfigClient) error {
+// registerRuleDataSource listens to dataId with the client created by Start, which is
+// passed in as Close may reset ds.client meanwhile.
+func (ds *AcmDataSource) registerRuleDataSource(nacosClient config_client.IConfigClient, dataId string, handler func(string)) error {
+	ds.mutex.Lock()
+	select {
+	case <-ds.closed:
+		ds.mutex.Unlock()
+		return errors.New("ACM data source closed")
+	default:
+	}
+	ds.mutex.Unlock()
 	nacosConfig := vo.ConfigParam{
 		Group:  AcmGroupId,
 		DataId: dataId,
@@ -113,7 +191,42 @@ func registerRuleDataSource(dataId string, handler func(string), nacosClient con
 			handler(data)
 		}
 	}()
-	return nacosClient.ListenConfig(nacosConfig)
+	if err := nacosClient.ListenConfig(nacosConfig); err != nil {
+		return err
+	}
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	select {
+	case <-ds.closed:
+		// Close has already run, do not leave the listener behind.
+		_ = nacosClient.CancelListenConfig(nacosConfig)
+		return errors.New("ACM data source closed")
+	default:
+	}
+	ds.listeners = append(ds.listeners, nacosConfig)
+	return nil
+}
+
+// Close cancels all the rule listeners registered by Start.
+// A Start still waiting for the AHAS transport returns immediately.
+func (ds *AcmDataSource) Close() error {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	tools.SafeClose(ds.closed)
+	if ds.client == nil {
+		return nil
+	}
+	var lastErr error
+	for _, param := range ds.listeners {
+		if err := ds.client.CancelListenConfig(param); err != nil {
+			logging.Error(err, "Failed to cancel ACM listener", "dataId", param.DataId)
+			lastErr = err
+		}
+	}
+	ds.listeners = nil
+	ds.client = nil
+	logger.Info("ACM data source closed")
+	return lastErr
 }
 
 func onFlowRuleChange(data string) {
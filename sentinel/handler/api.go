@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"encoding/json"
+
+	"github.com/sumansoul/aliyun-ahas-go-sdk/transport"
+)
+
+const (
+	ApiCommandName = "api"
+)
+
+type CommandVO struct {
+	Url      string   `json:"url"`
+	Versions []uint16 `json:"versions,omitempty"`
+}
+
+// ApiHandler answers the commands registered on the transport, itself included
+type ApiHandler struct {
+	transport *transport.Transport
+}
+
+func NewApiHandler(tsp *transport.Transport) *ApiHandler {
+	return &ApiHandler{transport: tsp}
+}
+
+func (h *ApiHandler) Handle(_ *transport.Request) *transport.Response {
+	commands := h.transport.Commands()
+	voList := make([]*CommandVO, 0, len(commands))
+	for _, c := range commands {
+		voList = append(voList, &CommandVO{Url: "/" + c.Name, Versions: c.Versions})
+	}
+	bs, err := json.Marshal(voList)
+	if err != nil {
+		return transport.ReturnFail(transport.Code[transport.ServerError], "bad data")
+	}
+	return transport.ReturnSuccess(string(bs))
+}
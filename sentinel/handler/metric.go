@@ -2,6 +2,7 @@ package handler
 
 import (
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 
@@ -28,6 +29,15 @@ func NewFetchMetricHandler() *FetchMetricHandler {
 }
 
 func (h *FetchMetricHandler) Handle(request *transport.Request) *transport.Response {
+	b := strings.Builder{}
+	if response := h.HandleStream(request, &b); response != nil {
+		return response
+	}
+	return transport.ReturnSuccess(b.String())
+}
+
+// HandleStream writes the metric lines to w one by one, see transport.StreamRequestHandler
+func (h *FetchMetricHandler) HandleStream(request *transport.Request, w io.Writer) *transport.Response {
 	// TODO: handle panic
 	var startTime, endTime uint64
 	var err error
@@ -67,17 +77,16 @@ func (h *FetchMetricHandler) Handle(request *transport.Request) *transport.Respo
 	if identity == "" {
 		list = append(list, h.fetchCpuAndLoadMetric()...)
 	}
-	b := strings.Builder{}
 	for _, item := range list {
 		str, err := item.ToThinString()
 		if err != nil {
 			return transport.ReturnFail(transport.Code[transport.ServerError], fmt.Sprintf("Unexpected error: %v", err.Error()))
 		}
-		b.Write([]byte(str))
-		b.WriteByte('\n')
+		if _, err := io.WriteString(w, str+"\n"); err != nil {
+			return transport.ReturnFail(transport.Code[transport.ServerError], fmt.Sprintf("Write metric error: %v", err.Error()))
+		}
 	}
-	result := b.String()
-	return transport.ReturnSuccess(result)
+	return nil
 }
 
 func (h *FetchMetricHandler) fetchCpuAndLoadMetric() []*base.MetricItem {
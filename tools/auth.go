@@ -22,24 +22,54 @@ const (
 )
 
 var metaFile = path.Join(GetUserHome(), ".ahas-go.meta")
-var localSoleilKey = ""
-var localLuneKey = ""
-var mutex = sync.RWMutex{}
+
+// Credentials holds the key pair of a client, which is issued by the server on connecting.
+type Credentials struct {
+	// file the keys are saved to, empty to keep them in memory only
+	metaFile  string
+	soleilKey string
+	luneKey   string
+	lock      sync.RWMutex
+}
+
+var defaultCredentials = NewCredentials(metaFile)
+
+// NewCredentials creates an empty key holder which saves the keys to the given file
+func NewCredentials(metaFile string) *Credentials {
+	return &Credentials{metaFile: metaFile}
+}
+
+// DefaultCredentials returns the credentials used by the package level functions
+func DefaultCredentials() *Credentials {
+	return defaultCredentials
+}
 
 func GetSoleilKey() string {
-	mutex.RLock()
-	defer mutex.RUnlock()
-	return localSoleilKey
+	return defaultCredentials.SoleilKey()
 }
 
 func GetLuneKey() string {
-	mutex.RLock()
-	defer mutex.RUnlock()
-	return localLuneKey
+	return defaultCredentials.LuneKey()
 }
 
 func Sign(signData string) string {
-	sum256 := sha256.Sum256([]byte((signData + localLuneKey)))
+	return defaultCredentials.Sign(signData)
+}
+
+func (c *Credentials) SoleilKey() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.soleilKey
+}
+
+func (c *Credentials) LuneKey() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.luneKey
+}
+
+func (c *Credentials) Sign(signData string) string {
+	sum256 := sha256.Sum256([]byte((signData + c.LuneKey())))
 	encodeToString := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%x", string(sum256[:]))))
 	return encodeToString
 }
@@ -59,7 +89,11 @@ func splitToChunk(encodeString string, size int) string {
 }
 
 func Auth(sign, signData string) bool {
-	expectSign := Sign(signData)
+	return defaultCredentials.Auth(sign, signData)
+}
+
+func (c *Credentials) Auth(sign, signData string) bool {
+	expectSign := c.Sign(signData)
 	if expectSign != sign {
 		logger.Warnf("Sign not equal. ExpectSign: %s, receiveSign: %s", expectSign, sign)
 		return false
@@ -68,29 +102,35 @@ func Auth(sign, signData string) bool {
 }
 
 func SaveMetadataToFile(k1, k2 string) error {
+	return defaultCredentials.Save(k1, k2)
+}
+
+// Save keeps the key pair and writes it to the meta file if any
+func (c *Credentials) Save(k1, k2 string) error {
 	if k1 == "" || k2 == "" {
 		return errors.New("SaveMetadataToFile failed: key is empty")
 	}
-	mutex.Lock()
-	defer mutex.Unlock()
-	var err error
-	file, err := os.OpenFile(metaFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
-	defer file.Close()
-	if err != nil {
-		logger.Warnf("SaveMetadataToFile failed: open file <%s> failed: %+v", metaFile, err)
-		return err
-	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.metaFile != "" {
+		file, err := os.OpenFile(c.metaFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			logger.Warnf("SaveMetadataToFile failed: open file <%s> failed: %+v", c.metaFile, err)
+			return err
+		}
+		defer file.Close()
 
-	_, err = file.WriteString(strings.Join([]string{SoleilKeyName, k1}, Delimiter) + "\n")
-	if err != nil {
-		return err
-	}
-	_, err = file.WriteString(strings.Join([]string{LuneKeyName, k2}, Delimiter))
-	if err != nil {
-		return err
+		_, err = file.WriteString(strings.Join([]string{SoleilKeyName, k1}, Delimiter) + "\n")
+		if err != nil {
+			return err
+		}
+		_, err = file.WriteString(strings.Join([]string{LuneKeyName, k2}, Delimiter))
+		if err != nil {
+			return err
+		}
 	}
-	localSoleilKey = k1
-	localLuneKey = k2
+	c.soleilKey = k1
+	c.luneKey = k2
 	return nil
 }
 
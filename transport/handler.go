@@ -2,14 +2,27 @@ package transport
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/sumansoul/aliyun-ahas-go-sdk/meta"
 	"github.com/sumansoul/aliyun-ahas-go-sdk/service"
+	"github.com/sumansoul/aliyun-ahas-go-sdk/tools"
+	"io"
 )
 
 type RequestHandler interface {
 	Handle(request *Request) *Response
 }
 
+// StreamRequestHandler is a RequestHandler whose result, a string, can be written in
+// chunks, so that a large result is never held in memory at once. Handle still
+// answers the gateways which do not support streaming.
+type StreamRequestHandler interface {
+	RequestHandler
+	// HandleStream writes the result of the successful response to w and returns nil,
+	// or returns the failed response. A failure after the first write aborts the response.
+	HandleStream(request *Request, w io.Writer) *Response
+}
+
 type AgwRequestHandler struct {
 	Interceptor RequestInterceptor
 	Handler     RequestHandler
@@ -27,7 +40,7 @@ func (handler *AgwRequestHandler) DoStop() error {
 //NewCommonHandler with default interceptor
 func NewCommonHandler(handler RequestHandler) AgwRequestHandler {
 	requestHandler := AgwRequestHandler{
-		Interceptor: buildInterceptor(),
+		Interceptor: buildInterceptor(tools.DefaultCredentials()),
 		Handler:     handler,
 	}
 	requestHandler.Controller = service.NewController(&requestHandler)
@@ -36,27 +49,9 @@ func NewCommonHandler(handler RequestHandler) AgwRequestHandler {
 }
 
 func (handler *AgwRequestHandler) Handle(request string) (string, error) {
-	var response *Response = nil
-	select {
-	case <-handler.Ctx.Done():
-		response = ReturnFail(Code[HandlerClosed], Code[HandlerClosed].Msg)
-	default:
-		// decode
-		req := &Request{}
-		err := json.Unmarshal([]byte(request), req)
-		if err != nil {
-			return "", err
-		}
-		var ok = true
-		// interceptor
-		interceptor := handler.Interceptor
-		if interceptor != nil && !meta.DebugEnabled() {
-			response, ok = interceptor.Handle(req)
-		}
-		if ok {
-			// Call Handler only when passing the interceptor
-			response = handler.Handler.Handle(req)
-		}
+	response, err := handler.handle(request, nil)
+	if err != nil {
+		return "", err
 	}
 	// encode
 	bytes, err := json.Marshal(response)
@@ -65,3 +60,58 @@ func (handler *AgwRequestHandler) Handle(request string) (string, error) {
 	}
 	return string(bytes), nil
 }
+
+// HandleStream writes the response to w, the result of a StreamRequestHandler in
+// chunks as it is produced, see gateway.StreamHandler.
+func (handler *AgwRequestHandler) HandleStream(request string, w io.Writer) error {
+	rw := &resultWriter{w: w}
+	response, err := handler.handle(request, rw)
+	if err != nil {
+		return err
+	}
+	if rw.streamed && response == nil {
+		return rw.finish()
+	}
+	if rw.started {
+		// the failure comes after a part of the result, only the stream can tell it
+		if err := response.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("handler %T returned a response after streaming", handler.Handler)
+	}
+	bytes, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(bytes)
+	return err
+}
+
+// handle decodes and intercepts the request, then runs the handler. The result of a
+// StreamRequestHandler goes to w if set, its response is nil on success.
+func (handler *AgwRequestHandler) handle(request string, w *resultWriter) (*Response, error) {
+	select {
+	case <-handler.Ctx.Done():
+		return ReturnFail(Code[HandlerClosed], Code[HandlerClosed].Msg), nil
+	default:
+	}
+	// decode
+	req := &Request{}
+	err := json.Unmarshal([]byte(request), req)
+	if err != nil {
+		return nil, err
+	}
+	// interceptor
+	interceptor := handler.Interceptor
+	if interceptor != nil && !meta.DebugEnabled() {
+		if response, ok := interceptor.Handle(req); !ok {
+			return response, nil
+		}
+	}
+	// Call Handler only when passing the interceptor
+	if streamHandler, ok := handler.Handler.(StreamRequestHandler); ok && w != nil {
+		w.streamed = true
+		return streamHandler.HandleStream(req, w), nil
+	}
+	return handler.Handler.Handle(req), nil
+}
@@ -1,8 +1,8 @@
 package transport
 
 import (
+	"context"
 	"encoding/json"
-	"github.com/pkg/errors"
 	"github.com/sumansoul/aliyun-ahas-go-sdk/gateway"
 	"github.com/sumansoul/aliyun-ahas-go-sdk/logger"
 	"github.com/sumansoul/aliyun-ahas-go-sdk/tools"
@@ -12,10 +12,12 @@ import (
 //RequestInvoker invoke remote service and return response
 type RequestInvoker interface {
 	Invoke(uri Uri, request *Request) (*Response, error)
+	// InvokeContext is like Invoke but the call is abandoned once ctx is done
+	InvokeContext(ctx context.Context, uri Uri, request *Request) (*Response, error)
 }
 
 type doRequestInvoker interface {
-	doInvoker(uri Uri, jsonParam string) (string, error)
+	doInvoker(ctx context.Context, uri Uri, jsonParam string) (string, error)
 }
 
 // invoker with interceptor
@@ -26,11 +28,15 @@ type agwRequestInvoker struct {
 }
 
 func (invoker *agwRequestInvoker) Invoke(uri Uri, request *Request) (*Response, error) {
+	return invoker.InvokeContext(context.Background(), uri, request)
+}
+
+func (invoker *agwRequestInvoker) InvokeContext(ctx context.Context, uri Uri, request *Request) (*Response, error) {
 	// interceptor
 	interceptor := invoker.interceptor
 	if interceptor != nil {
 		if response, ok := interceptor.Invoke(request); !ok {
-			return response, errors.New(response.Error)
+			return response, response.Err()
 		}
 	}
 
@@ -46,7 +52,7 @@ func (invoker *agwRequestInvoker) Invoke(uri Uri, request *Request) (*Response,
 		return nil, err
 	}
 	// doInvoke
-	result, err := invoker.doInvoker(uri, string(bytes))
+	result, err := invoker.doInvoker(ctx, uri, string(bytes))
 	if err != nil {
 		logger.Warnf("Invoke failed, requestId: %s, error: %s", requestId, err.Error())
 		return nil, err
@@ -71,10 +77,14 @@ func NewInvoker(client *gateway.AgwClient, needInterceptor bool) RequestInvoker
 	//  Not need request interceptor when first connect,
 	var interceptor RequestInterceptor
 	if needInterceptor {
-		interceptor = buildInterceptor()
+		interceptor = buildInterceptor(tools.DefaultCredentials())
 	} else {
 		interceptor = nil
 	}
+	return newInvoker(client, interceptor)
+}
+
+func newInvoker(client *gateway.AgwClient, interceptor RequestInterceptor) RequestInvoker {
 	// entry invoker
 	invoker := &agwClientRequestInvoker{
 		client,
@@ -87,9 +97,9 @@ func NewInvoker(client *gateway.AgwClient, needInterceptor bool) RequestInvoker
 	return invoker
 }
 
-func buildInterceptor() RequestInterceptor {
+func buildInterceptor(credentials *tools.Credentials) RequestInterceptor {
 	// auth
-	authInterceptor := &authInterceptor{}
+	authInterceptor := &authInterceptor{credentials: credentials}
 	chain := requestInterceptorChain{}
 	chain.chain = nil
 	chain.RequestInterceptor = &chain
@@ -107,15 +117,16 @@ func buildInterceptor() RequestInterceptor {
 	return timestampInterceptor
 }
 
-func (invoker *agwClientRequestInvoker) doInvoker(uri Uri, jsonParam string) (string, error) {
+func (invoker *agwClientRequestInvoker) doInvoker(ctx context.Context, uri Uri, jsonParam string) (string, error) {
 	ver, err := strconv.Atoi(uri.CompressVersion)
 	if err != nil {
 		ver = gateway.AllCompress
 	}
 	metadata := gateway.RpcMetadata{
-		ServerName:  uri.ServerName,
-		HandlerName: uri.HandlerName,
-		Version:     uint32(ver),
+		ServerName:    uri.ServerName,
+		HandlerName:   uri.HandlerName,
+		Version:       uint32(ver),
+		NonIdempotent: uri.NonIdempotent,
 	}
-	return invoker.client.Call(uri.RequestId, metadata, jsonParam)
+	return invoker.client.CallContext(ctx, uri.RequestId, metadata, jsonParam)
 }
@@ -14,6 +14,8 @@ const (
 	Tid        = "tid"
 	Pid        = "pid"
 	Uid        = "uid"
+	Codecs     = "codecs"
+	IpVersion  = "ipVersion"
 )
 
 var (
@@ -73,7 +75,11 @@ type Uri struct {
 	Pid             string
 	Tag             string
 	RequestId       string
+	// CompressVersion is the compress mode of the call, the codec is negotiated on connect
+	// and bodies below the compress threshold are sent as they are
 	CompressVersion string
+	// NonIdempotent marks a call which must not be retried once it has been sent
+	NonIdempotent bool
 }
 
 // NewUri: create a new one
@@ -1,5 +1,7 @@
 package transport
 
+import "fmt"
+
 const (
 	OK                      = "OK"
 	InvalidTimestamp        = "InvalidTimestamp"
@@ -59,6 +61,53 @@ var Code = map[string]CodeType{
 	JavaAgentCmdError:       {704, "cannot handle the javaagent cmd"},
 }
 
+// Errors of the failed responses, matched by code with errors.Is against the error returned by Response.Err
+var (
+	ErrInvalidTimestamp        = codeError(InvalidTimestamp)
+	ErrForbidden               = codeError(Forbidden)
+	ErrHandlerNotFound         = codeError(HandlerNotFound)
+	ErrTokenNotFound           = codeError(TokenNotFound)
+	ErrServiceNotOpened        = codeError(ServiceNotOpened)
+	ErrServiceNotAuthorized    = codeError(ServiceNotAuthorized)
+	ErrServerError             = codeError(ServerError)
+	ErrHandlerClosed           = codeError(HandlerClosed)
+	ErrTimeout                 = codeError(Timeout)
+	ErrUninitialized           = codeError(Uninitialized)
+	ErrEncodeError             = codeError(EncodeError)
+	ErrDecodeError             = codeError(DecodeError)
+	ErrFileNotFound            = codeError(FileNotFound)
+	ErrDownloadError           = codeError(DownloadError)
+	ErrDeployError             = codeError(DeployError)
+	ErrServiceSwitchError      = codeError(ServiceSwitchError)
+	ErrUpgrading               = codeError(Upgrading)
+	ErrParameterEmpty          = codeError(ParameterEmpty)
+	ErrParameterTypeError      = codeError(ParameterTypeError)
+	ErrFaultInjectCmdError     = codeError(FaultInjectCmdError)
+	ErrFaultInjectExecuteError = codeError(FaultInjectExecuteError)
+	ErrFaultInjectNotSupport   = codeError(FaultInjectNotSupport)
+	ErrJavaAgentCmdError       = codeError(JavaAgentCmdError)
+)
+
+// ResponseError is the error of a failed response
+type ResponseError struct {
+	Code int32
+	Msg  string
+}
+
+func codeError(name string) *ResponseError {
+	return &ResponseError{Code: Code[name].Code, Msg: Code[name].Msg}
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("[%d] %s", e.Code, e.Msg)
+}
+
+// Is reports whether target is a *ResponseError of the same code
+func (e *ResponseError) Is(target error) bool {
+	t, ok := target.(*ResponseError)
+	return ok && t.Code == e.Code
+}
+
 type Response struct {
 	Code    int32       `json:"code"`
 	Success bool        `json:"success"`
@@ -83,3 +132,20 @@ func ReturnFail(codeType CodeType, err string) *Response {
 func ReturnSuccess(result interface{}) *Response {
 	return &Response{Code: Code[OK].Code, Success: true, Result: result}
 }
+
+//Err returns nil if the response is successful, otherwise a *ResponseError carrying its code and error
+func (response *Response) Err() error {
+	if response == nil || response.Success {
+		return nil
+	}
+	msg := response.Error
+	if msg == "" {
+		for _, codeType := range Code {
+			if codeType.Code == response.Code {
+				msg = codeType.Msg
+				break
+			}
+		}
+	}
+	return &ResponseError{Code: response.Code, Msg: msg}
+}
@@ -0,0 +1,93 @@
+package transport
+
+import (
+	"encoding/json"
+	"io"
+	"unicode/utf8"
+)
+
+// resultWriter writes a successful response whose result string is streamed: the
+// JSON of the response up to the result on the first write, then the escaped result.
+type resultWriter struct {
+	w io.Writer
+	// whether the handler streams its result, and whether a byte went to w
+	streamed bool
+	started  bool
+	// the first bytes of a multi-byte character split across writes
+	partial []byte
+}
+
+// successPrefix is the JSON of a successful response up to its result string
+func successPrefix() []byte {
+	bytes, _ := json.Marshal(ReturnSuccess(""))
+	// drop the empty string and the closing brace
+	return bytes[:len(bytes)-2]
+}
+
+func (rw *resultWriter) start() error {
+	if rw.started {
+		return nil
+	}
+	rw.started = true
+	_, err := rw.w.Write(successPrefix())
+	return err
+}
+
+// Write escapes p as the content of a JSON string the way json.Marshal does, invalid
+// UTF-8 included, so that a streamed result reads like the one of Handle. The bytes
+// of a multi-byte character may be split across writes.
+func (rw *resultWriter) Write(p []byte) (int, error) {
+	if err := rw.start(); err != nil {
+		return 0, err
+	}
+	data := append(rw.partial, p...)
+	end := len(data) - incompleteSuffix(data)
+	if err := rw.writeEscaped(data[:end]); err != nil {
+		return 0, err
+	}
+	rw.partial = append(rw.partial[:0], data[end:]...)
+	return len(p), nil
+}
+
+// writeEscaped writes p as the content of a JSON string. json.Marshal escapes each
+// character on its own, so the pieces of a result split on character boundaries
+// concatenate to the escaping of the whole.
+func (rw *resultWriter) writeEscaped(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	escaped, err := json.Marshal(string(p))
+	if err != nil {
+		return err
+	}
+	_, err = rw.w.Write(escaped[1 : len(escaped)-1])
+	return err
+}
+
+// incompleteSuffix returns the length of the multi-byte character p ends with if it
+// misses bytes, zero otherwise.
+func incompleteSuffix(p []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(p); i++ {
+		if utf8.RuneStart(p[len(p)-i]) {
+			if utf8.FullRune(p[len(p)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
+
+// finish closes the result string and the response, the bytes of a character left
+// incomplete are invalid and written like json.Marshal writes them.
+func (rw *resultWriter) finish() error {
+	if err := rw.start(); err != nil {
+		return err
+	}
+	if err := rw.writeEscaped(rw.partial); err != nil {
+		return err
+	}
+	rw.partial = nil
+	_, err := io.WriteString(rw.w, `"}`)
+	return err
+}
@@ -0,0 +1,50 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestResultWriterMatchesMarshal(t *testing.T) {
+	results := map[string]string{
+		"empty":          "",
+		"plain":          "1700000000000|GET:/api/orders|12|0|3\n",
+		"escaped":        "\"quoted\" \\ \t\r\n\x00\x1f <html> & \u2028 \u2029",
+		"multi-byte":     "限流 é 𝄞",
+		"invalid":        "a\xffb\xc3(c\xed\xa0\x80d",
+		"truncated end":  "é\xe2\x82",
+		"lone trailing":  "\x80\xbf",
+		"truncated 4/4":  "\xf0\x9d\x84",
+		"mixed in error": "\xe6\x9c\x80\xe6\x9c",
+	}
+	for name, result := range results {
+		want, err := json.Marshal(ReturnSuccess(result))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// every split of the result, characters cut in the middle included
+		for split := 0; split <= len(result); split++ {
+			var out bytes.Buffer
+			rw := &resultWriter{w: &out}
+			rw.Write([]byte(result[:split]))
+			rw.Write([]byte(result[split:]))
+			if err := rw.finish(); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != string(want) {
+				t.Errorf("%s split at %d: %s, want %s", name, split, out.String(), want)
+			}
+		}
+		// one byte at a time
+		var out bytes.Buffer
+		rw := &resultWriter{w: &out}
+		for i := 0; i < len(result); i++ {
+			rw.Write([]byte{result[i]})
+		}
+		rw.finish()
+		if out.String() != string(want) {
+			t.Errorf("%s by byte: %s, want %s", name, out.String(), want)
+		}
+	}
+}
@@ -1,13 +1,17 @@
 package transport
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	sentinelConf "github.com/alibaba/sentinel-golang/core/config"
@@ -17,35 +21,91 @@ import (
 	"github.com/sumansoul/aliyun-ahas-go-sdk/tools"
 )
 
+const (
+	// minimum interval between two connect handshakes triggered by failures
+	reconnectIntervalMs = 5000
+)
+
+// handlerKey identifies a registered handler by command name and api version
+type handlerKey struct {
+	name    string
+	version uint16
+}
+
 type Transport struct {
-	client   *gateway.AgwClient
-	invoker  RequestInvoker
-	handlers map[string]*AgwRequestHandler
-	mutex    sync.Mutex
-	config   *Config
-	metadata *meta.Meta
+	client      *gateway.AgwClient
+	invoker     RequestInvoker
+	handlers    map[handlerKey]*AgwRequestHandler
+	mutex       sync.Mutex
+	config      *Config
+	metadata    *meta.Meta
+	credentials *tools.Credentials
+	// serves the commands in debug mode, see DebugHandler
+	debugMux   *http.ServeMux
+	debugPaths map[string]bool
+
+	reconnecting  int32
+	lastReconnect int64
+	shutdown      int32
 }
 
-func (t *Transport) Shutdown() error {
-	return nil
+// Shutdown notifies the server that the client is going away, stops all registered
+// handlers and closes the gateway client, waiting for in-flight calls until ctx is done.
+func (t *Transport) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&t.shutdown, 1)
+	if err := t.disconnect(ctx); err != nil {
+		logger.Warnf("Failed to send close request to server: %+v", err)
+	}
+	if err := t.Stop(); err != nil {
+		logger.Warnf("Failed to stop transport handlers: %+v", err)
+	}
+	return t.client.Close(ctx)
 }
 
+// New creates the transport on the default gateway client and the default credentials
 func New(conf *Config, metadata *meta.Meta) (*Transport, error) {
+	return newTransport(conf, metadata, gateway.GetAgwClientInstance(), tools.DefaultCredentials())
+}
+
+// NewIndependent creates a transport which owns a new gateway client and the given
+// credentials, so that several transports can live in one process.
+func NewIndependent(conf *Config, metadata *meta.Meta, credentials *tools.Credentials) (*Transport, error) {
+	if credentials == nil {
+		return nil, errors.New("nil credentials")
+	}
+	return newTransport(conf, metadata, nil, credentials)
+}
+
+func newTransport(conf *Config, metadata *meta.Meta, client *gateway.AgwClient, credentials *tools.Credentials) (*Transport, error) {
 	if conf == nil {
 		return nil, errors.New("nil transport config")
 	}
 	if metadata == nil {
 		return nil, errors.New("nil metadata")
 	}
-	client := gateway.GetAgwClientInstance()
 
-	hostAndPort := strings.SplitN(metadata.AhasEndpoint(), ":", 2)
-	port, err := strconv.Atoi(hostAndPort[1])
+	resolved := metadata.AhasEndpoints()
+	if insecure := metadata.AhasInsecureEndpoint(); insecure != "" && conf.InsecureFallback && !conf.TlsOnly {
+		logger.Errorf("Insecure fallback enabled, the credentials may be sent in clear to the gateway endpoint %s", insecure)
+		resolved = append(append([]meta.Endpoint(nil), resolved...), meta.Endpoint{Address: insecure})
+	}
+	endpoints, err := gatewayEndpoints(resolved, conf)
 	if err != nil {
 		return nil, err
 	}
-	// tag: pluginType:privateIp:pid
-	processFlag := meta.GoSDK + ":" + metadata.PrivateIp() + ":" + metadata.Pid()
+	if conf.TlsOnly {
+		for _, e := range endpoints {
+			if !e.Tls {
+				return nil, fmt.Errorf("plain gateway endpoint %s refused, the transport is TLS only", e)
+			}
+		}
+	}
+	// tag: pluginType:privateIp:pid, an IPv6 address is bracketed to keep the tag splittable
+	privateIp := metadata.PrivateIp()
+	if meta.IsIpv6(privateIp) {
+		privateIp = "[" + privateIp + "]"
+	}
+	processFlag := meta.GoSDK + ":" + privateIp + ":" + metadata.Pid()
 
 	if conf.TimeoutMs == 0 {
 		conf.TimeoutMs = 3000
@@ -54,46 +114,212 @@ func New(conf *Config, metadata *meta.Meta) (*Transport, error) {
 		ClientVpcId:       metadata.VpcId(),
 		ClientIp:          metadata.HostIp(),
 		ClientProcessFlag: processFlag,
-		GatewayIp:         hostAndPort[0],
-		GatewayPort:       uint32(port),
+		GatewayIp:         endpoints[0].Host,
+		GatewayPort:       endpoints[0].Port,
 		Timeout:           time.Duration(conf.TimeoutMs) * time.Millisecond,
 		ClientRegionId:    metadata.RegionId(),
-		ClientEnv:         meta.DeployEnv(),
+		ClientInVpc:       metadata.InVpc(),
+		ClientEnv:         metadata.DeployEnv(),
 		// Whether enable TLS
-		TlsFlag: conf.Secure,
+		TlsFlag: endpoints[0].Tls,
+		Tls: gateway.TlsConfig{
+			ServerName:     conf.ServerName,
+			CaFile:         conf.CaFile,
+			UseSystemRoots: conf.UseSystemRoots,
+			CertFile:       conf.CertFile,
+			KeyFile:        conf.KeyFile,
+			CertSpki:       conf.CertSpki,
+			PinnedSpki:     conf.PinnedSpki,
+		},
+		ReconnectBaseDelay: time.Duration(conf.ReconnectBaseDelayMs) * time.Millisecond,
+		ReconnectMaxDelay:  time.Duration(conf.ReconnectMaxDelayMs) * time.Millisecond,
+		PoolSize:           conf.PoolSize,
+		FrameLimits: gateway.FrameLimits{
+			MaxBodySize:         conf.MaxFrameSize,
+			MaxFieldSize:        conf.MaxFieldSize,
+			MaxDecompressedSize: conf.MaxDecompressedSize,
+		},
+		Codecs:              conf.Codecs,
+		CompressThreshold:   conf.CompressThreshold,
+		HeartbeatInterval:   time.Duration(conf.GatewayHeartbeatIntervalMs) * time.Millisecond,
+		MaxMissedHeartbeats: conf.MaxMissedHeartbeats,
+		Workers:             conf.Workers,
+		WorkerQueueSize:     conf.WorkerQueueSize,
+		HandlerConcurrency:  conf.HandlerConcurrency,
+		DialContext:         conf.DialContext,
+		Tracer:              conf.Tracer,
+		DisableHandshake:    conf.DisableHandshake,
+		Proxy:               conf.Proxy,
+		ConnectTimeout:      time.Duration(conf.ConnectTimeoutMs) * time.Millisecond,
+		KeepAlive:           time.Duration(conf.KeepAliveMs) * time.Millisecond,
+		Endpoints:           endpoints,
+		FailbackInterval:    time.Duration(conf.FailbackIntervalMs) * time.Millisecond,
+	}
+	if conf.CaptureFile != "" {
+		agwConfig.Capture = &gateway.CaptureConfig{File: conf.CaptureFile}
+	}
+	if client == nil {
+		client, err = gateway.NewAgwClient(agwConfig)
+	} else {
+		err = client.Init(agwConfig)
 	}
-	err = client.Init(agwConfig)
 	if err != nil {
 		return nil, err
 	}
 	return &Transport{
-		client:   client,
-		invoker:  NewInvoker(client, true),
-		handlers: make(map[string]*AgwRequestHandler),
-		mutex:    sync.Mutex{},
-		config:   conf,
-		metadata: metadata,
+		client:      client,
+		invoker:     newInvoker(client, buildInterceptor(credentials)),
+		handlers:    make(map[handlerKey]*AgwRequestHandler),
+		mutex:       sync.Mutex{},
+		config:      conf,
+		metadata:    metadata,
+		credentials: credentials,
+		debugMux:    http.NewServeMux(),
+		debugPaths:  make(map[string]bool),
 	}, nil
 }
 
-//addHandler register handler
-func (t *Transport) RegisterHandler(handlerName string, handler *AgwRequestHandler) {
+// gatewayEndpoints returns the endpoints resolved by the metadata followed by the
+// extra endpoints of the config, duplicates removed.
+func gatewayEndpoints(resolved []meta.Endpoint, conf *Config) ([]gateway.Endpoint, error) {
+	var endpoints []gateway.Endpoint
+	seen := make(map[string]bool)
+	add := func(address string, tls bool) error {
+		host, portStr, err := net.SplitHostPort(address)
+		if err != nil {
+			return fmt.Errorf("invalid gateway endpoint %q: %w", address, err)
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid gateway endpoint %q: bad port", address)
+		}
+		endpoint := gateway.Endpoint{Host: host, Port: uint32(port), Tls: tls}
+		if !seen[endpoint.String()] {
+			seen[endpoint.String()] = true
+			endpoints = append(endpoints, endpoint)
+		}
+		return nil
+	}
+	for _, e := range resolved {
+		if err := add(e.Address, e.Tls); err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range conf.Endpoints {
+		var err error
+		switch {
+		case strings.HasPrefix(e, "tls://"):
+			err = add(strings.TrimPrefix(e, "tls://"), true)
+		case strings.HasPrefix(e, "tcp://"):
+			err = add(strings.TrimPrefix(e, "tcp://"), false)
+		default:
+			err = add(e, conf.Secure)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("no gateway endpoint")
+	}
+	return endpoints, nil
+}
+
+// Metadata returns the metadata of the client
+func (t *Transport) Metadata() *meta.Meta {
+	return t.metadata
+}
+
+// ConnStats returns the state and heartbeat figures of the gateway connections
+func (t *Transport) ConnStats() []gateway.ConnStats {
+	return t.client.ConnStats()
+}
+
+// Stats returns the call counters and latencies of the gateway client
+func (t *Transport) Stats() gateway.Stats {
+	return t.client.Stats()
+}
+
+// RegisterHandler registers the handler of every api version of the command, it
+// fails with gateway.ErrHandlerExists if the command is already registered.
+func (t *Transport) RegisterHandler(handlerName string, handler *AgwRequestHandler) error {
+	return t.RegisterVersionedHandler(handlerName, gateway.AnyVersion, handler)
+}
+
+// RegisterVersionedHandler registers the handler of one api version of the command,
+// see gateway.WithApiVersion.
+func (t *Transport) RegisterVersionedHandler(handlerName string, apiVersion uint16, handler *AgwRequestHandler) error {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
-	if t.handlers[handlerName] == nil {
-		t.handlers[handlerName] = handler
-		t.client.AddHandler(handlerName, handler)
-	}
-	if meta.DebugEnabled() {
-		http.HandleFunc("/ahas/"+handlerName, func(writer http.ResponseWriter, request *http.Request) {
-			request.ParseForm()
-			response, err := handler.Handle(request.Form["body"][0])
-			if err != nil {
-				response = err.Error()
-			}
-			fmt.Fprintf(writer, response)
-		})
+	key := handlerKey{name: handlerName, version: apiVersion}
+	if t.handlers[key] != nil {
+		return fmt.Errorf("%w: %s, version %d", gateway.ErrHandlerExists, handlerName, apiVersion)
+	}
+	if _, ok := handler.Interceptor.(*timestampInterceptor); ok {
+		// the default interceptor has to verify requests with the keys of this
+		// transport, the handler of the caller may be registered on others
+		copied := *handler
+		copied.Interceptor = buildInterceptor(t.credentials)
+		handler = &copied
+	}
+	if err := t.client.AddVersionedHandler(handlerName, apiVersion, handler); err != nil {
+		return err
+	}
+	t.handlers[key] = handler
+	if meta.DebugEnabled() && apiVersion == gateway.AnyVersion && !t.debugPaths[handlerName] {
+		// the path outlives the handler, it serves the handler registered at the time of the request
+		t.debugPaths[handlerName] = true
+		t.debugMux.HandleFunc("/ahas/"+handlerName, t.serveDebug(handlerName))
+	}
+	return nil
+}
+
+// DebugHandler serves the commands registered in debug mode under /ahas/<name>, with
+// the request in the body form value, to be mounted on a local debug server.
+func (t *Transport) DebugHandler() http.Handler {
+	return t.debugMux
+}
+
+func (t *Transport) serveDebug(handlerName string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		t.mutex.Lock()
+		handler := t.handlers[handlerKey{name: handlerName, version: gateway.AnyVersion}]
+		t.mutex.Unlock()
+		if handler == nil {
+			http.NotFound(writer, request)
+			return
+		}
+		response, err := handler.Handle(request.FormValue("body"))
+		if err != nil {
+			response = err.Error()
+		}
+		io.WriteString(writer, response)
+	}
+}
+
+// UnregisterHandler removes and stops all versions of the command handler, the
+// subsequent requests of the command are answered as unknown by the gateway client.
+func (t *Transport) UnregisterHandler(handlerName string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.client.RemoveHandler(handlerName) {
+		return fmt.Errorf("handler %s not registered", handlerName)
 	}
+	for key, handler := range t.handlers {
+		if key.name != handlerName {
+			continue
+		}
+		delete(t.handlers, key)
+		if err := handler.Stop(); err != nil {
+			logger.Warnf("Failed to stop handler %s: %+v", handlerName, err)
+		}
+	}
+	return nil
+}
+
+// Commands lists the registered commands sorted by name
+func (t *Transport) Commands() []gateway.HandlerInfo {
+	return t.client.Handlers()
 }
 
 //Start Transport service
@@ -103,11 +329,41 @@ func (t *Transport) Start() (*Transport, error) {
 		logger.Errorf("Connection to server failed: %+v", err)
 		return nil, err
 	}
+	t.client.AddReconnectListener(func(connId uint32) {
+		t.reconnect(fmt.Sprintf("gateway connection %d re-established", connId))
+	})
 	logger.Info("AGW transport service started successfully")
 	return t, nil
 }
 
+//Stop all registered handlers, the subsequent requests from server will be answered with HandlerClosed
 func (t *Transport) Stop() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for key, handler := range t.handlers {
+		if err := handler.Stop(); err != nil {
+			logger.Warnf("Failed to stop handler %s: %+v", key.name, err)
+		}
+	}
+	logger.Info("AGW transport service stopped")
+	return nil
+}
+
+// disconnect tells the server to remove current client
+func (t *Transport) disconnect(ctx context.Context) error {
+	request := NewRequest()
+	request.AddParam("vpcId", t.metadata.VpcId())
+	request.AddParam("ip", t.metadata.PrivateIp())
+	request.AddParam("pid", t.metadata.Pid()).AddParam("type", meta.GoSDK)
+
+	uri := NewUri(SentinelService, Close)
+	response, err := t.InvokeContext(ctx, uri, request)
+	if err != nil {
+		return err
+	}
+	if !response.Success {
+		return fmt.Errorf("close request failed, %w", response.Err())
+	}
 	return nil
 }
 
@@ -120,10 +376,10 @@ func (t *Transport) connect() error {
 	request.AddParam("pid", t.metadata.Pid()).AddParam("type", meta.GoSDK)
 	request.AddParam("appName", sentinelConf.AppName())
 	request.AddParam("appType", strconv.Itoa(int(sentinelConf.AppType())))
-	request.AddParam("namespace", meta.Namespace())
+	request.AddParam("namespace", t.metadata.Namespace())
 
 	uid := t.metadata.Uid()
-	license := meta.License()
+	license := t.metadata.License()
 	if len(uid) > 0 {
 		request.AddParam("uid", uid)
 	}
@@ -140,26 +396,66 @@ func (t *Transport) connect() error {
 
 	request.AddParam("v", t.metadata.Version())
 	request.AddParam("hostIp", t.metadata.HostIp())
+	request.AddParam(IpVersion, ipVersion(t.metadata.HostIp()))
 	request.AddParam("cpuNum", strconv.Itoa(runtime.NumCPU()))
+	request.AddParam(Codecs, strings.Join(t.client.SupportedCodecs(), ","))
 
 	uri := NewUri(SentinelService, Connect)
-	invoker := NewInvoker(t.client, false)
+	// the codecs are not negotiated yet
+	uri.CompressVersion = NoCompress
+	invoker := newInvoker(t.client, nil)
 	response, err := invoker.Invoke(uri, request)
 	if err != nil {
 		return err
 	}
-	return handleConnectResponse(*response, t.metadata)
+	if err := handleConnectResponse(*response, t.metadata, t.credentials); err != nil {
+		return err
+	}
+	// for the connections of the gateways without capability handshake, the others
+	// negotiate their codec on their own
+	t.client.SetPeerCodecs(peerCodecs(response.Result))
+	return nil
+}
+
+// ipVersion tells the server whether the frames carry the client address in clientIp
+// or, for IPv6, as a string behind the version
+func ipVersion(ip string) string {
+	if meta.IsIpv6(ip) {
+		return "6"
+	}
+	return "4"
+}
+
+// peerCodecs returns the codecs accepted by the gateway, older servers do not answer any
+func peerCodecs(result interface{}) []string {
+	v, ok := result.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	switch codecs := v[Codecs].(type) {
+	case string:
+		return strings.Split(codecs, ",")
+	case []interface{}:
+		names := make([]string, 0, len(codecs))
+		for _, codec := range codecs {
+			if name, ok := codec.(string); ok {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	return nil
 }
 
 // Handle response: record ak/sk and uid information
-func handleConnectResponse(response Response, metadata *meta.Meta) error {
+func handleConnectResponse(response Response, metadata *meta.Meta, credentials *tools.Credentials) error {
 	if !response.Success {
 		if response.Code == Code[ServiceNotOpened].Code {
 			logger.Errorf("AHAS service not opened, please initiate it in the AHAS console")
 		} else if response.Code == Code[ServiceNotAuthorized].Code {
 			logger.Errorf("AHAS service not authorized")
 		}
-		return errors.New(fmt.Sprintf("connect server failed, %s", response.Error))
+		return fmt.Errorf("connect server failed, %w", response.Err())
 	}
 	result := response.Result
 
@@ -178,12 +474,59 @@ func handleConnectResponse(response Response, metadata *meta.Meta) error {
 	metadata.SetTid(v[Tid].(string))
 	metadata.SetCid(v[Aid].(string))
 
-	err := tools.SaveMetadataToFile(v["ak"].(string), v["sk"].(string))
+	err := credentials.Save(v["ak"].(string), v["sk"].(string))
 	return err
 }
 
+// reconnect re-runs the connect handshake in background, so that uid/tid/cid and
+// the keys are refreshed after the server forgot the client or the keys rotated.
+func (t *Transport) reconnect(reason string) {
+	if atomic.LoadInt32(&t.shutdown) == 1 {
+		return
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if now-atomic.LoadInt64(&t.lastReconnect) < reconnectIntervalMs {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&t.reconnecting, 0, 1) {
+		return
+	}
+	atomic.StoreInt64(&t.lastReconnect, now)
+	go func() {
+		defer atomic.StoreInt32(&t.reconnecting, 0)
+		defer tools.PrintPanicStack()
+		logger.Warnf("Re-running connect handshake, reason: %s", reason)
+		oldTid := t.metadata.Tid()
+		if err := t.connect(); err != nil {
+			logger.Errorf("Reconnection to server failed: %+v", err)
+			return
+		}
+		if oldTid != "" && oldTid != t.metadata.Tid() {
+			logger.Warnf("Tid changed from %s to %s after reconnection", oldTid, t.metadata.Tid())
+		}
+		logger.Info("Reconnection to server succeeded")
+	}()
+}
+
+// needReconnect returns true if the response indicates that the server does not know the client anymore
+func needReconnect(response *Response) bool {
+	if response == nil || response.Success {
+		return false
+	}
+	switch response.Code {
+	case Code[Forbidden].Code, Code[TokenNotFound].Code:
+		return true
+	}
+	return strings.Contains(strings.ToLower(response.Error), "not registered")
+}
+
 // Invoke remote service. Client communicates with server through this interface
 func (t *Transport) Invoke(uri Uri, request *Request) (*Response, error) {
+	return t.InvokeContext(context.Background(), uri, request)
+}
+
+// InvokeContext invokes remote service like Invoke, the call is abandoned once ctx is done
+func (t *Transport) InvokeContext(ctx context.Context, uri Uri, request *Request) (*Response, error) {
 	request.AddHeader(Pid, t.metadata.Pid())
 	uid := t.metadata.Uid()
 	if uid != "" {
@@ -194,5 +537,9 @@ func (t *Transport) Invoke(uri Uri, request *Request) (*Response, error) {
 
 	request.AddHeader("type", meta.GoSDK)
 	request.AddHeader("v", t.metadata.Version())
-	return t.invoker.Invoke(uri, request)
+	response, err := t.invoker.InvokeContext(ctx, uri, request)
+	if needReconnect(response) {
+		t.reconnect(fmt.Sprintf("%s_%s responded with code %d: %s", uri.ServerName, uri.HandlerName, response.Code, response.Error))
+	}
+	return response, err
 }
@@ -0,0 +1,233 @@
+package transport_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sumansoul/aliyun-ahas-go-sdk/gateway"
+	"github.com/sumansoul/aliyun-ahas-go-sdk/gateway/gatewaytest"
+	"github.com/sumansoul/aliyun-ahas-go-sdk/meta"
+	"github.com/sumansoul/aliyun-ahas-go-sdk/tools"
+	"github.com/sumansoul/aliyun-ahas-go-sdk/transport"
+)
+
+// newServer starts a gateway answering the connect handshake, connects counts them
+func newServer(t *testing.T, connects *int32) *gatewaytest.Server {
+	s, err := gatewaytest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Handle(transport.SentinelService, transport.Connect, func(req *gateway.AgwMessage) (string, error) {
+		n := atomic.AddInt32(connects, 1)
+		body, err := json.Marshal(transport.ReturnSuccess(map[string]string{
+			transport.Tid: fmt.Sprintf("tid-%d", n),
+			transport.Uid: "uid-1",
+			transport.Aid: "cid-1",
+			"ak":          "soleil",
+			"sk":          "lune",
+		}))
+		return string(body), err
+	})
+	return s
+}
+
+// newTransport creates a transport on its own gateway client connected to s, configure
+// adjusts the config if not nil. The caller shuts it down.
+func newTransport(t *testing.T, s *gatewaytest.Server, configure func(*transport.Config)) (*transport.Transport, *meta.Meta, *tools.Credentials) {
+	endpoint := s.Endpoint()
+	metadata, err := meta.NewLocalMetadata("license", "default", []meta.Endpoint{{Address: fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &transport.Config{TimeoutMs: 3000, PoolSize: 1, ReconnectBaseDelayMs: 10}
+	if configure != nil {
+		configure(conf)
+	}
+	credentials := tools.NewCredentials("")
+	tr, err := transport.NewIndependent(conf, metadata, credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr, metadata, credentials
+}
+
+func eventually(t *testing.T, timeout time.Duration, cond func() bool, format string, args ...interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func shutdown(tr *transport.Transport) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	tr.Shutdown(ctx)
+}
+
+func TestTransportConnect(t *testing.T) {
+	var connects int32
+	s := newServer(t, &connects)
+	defer s.Close()
+	tr, metadata, credentials := newTransport(t, s, nil)
+	defer shutdown(tr)
+
+	if _, err := tr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Uid() != "uid-1" || metadata.Tid() != "tid-1" || metadata.Cid() != "cid-1" {
+		t.Fatalf("metadata uid %q tid %q cid %q after connect", metadata.Uid(), metadata.Tid(), metadata.Cid())
+	}
+	if credentials.SoleilKey() != "soleil" || credentials.LuneKey() != "lune" {
+		t.Fatal("keys of the connect response not saved")
+	}
+	var connect *gatewaytest.Frame
+	for _, frame := range s.Frames() {
+		if frame.Inbound && frame.Msg.HandlerName() == transport.Connect {
+			connect = &frame
+			break
+		}
+	}
+	if connect == nil {
+		t.Fatal("no connect request received")
+	}
+	var request transport.Request
+	if err := json.Unmarshal([]byte(connect.Msg.Body()), &request); err != nil {
+		t.Fatal(err)
+	}
+	if request.Params["ak"] != "license" || request.Params["pid"] != metadata.Pid() {
+		t.Fatalf("connect params %v", request.Params)
+	}
+	ipVersion := "4"
+	if meta.IsIpv6(metadata.HostIp()) {
+		ipVersion = "6"
+	}
+	if request.Params[transport.IpVersion] != ipVersion {
+		t.Fatalf("ip version %q of the host ip %s", request.Params[transport.IpVersion], metadata.HostIp())
+	}
+}
+
+func TestTransportConnectFailure(t *testing.T) {
+	s, err := gatewaytest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Handle(transport.SentinelService, transport.Connect, func(req *gateway.AgwMessage) (string, error) {
+		body, err := json.Marshal(transport.Return(transport.Code[transport.ServiceNotOpened]))
+		return string(body), err
+	})
+	tr, _, _ := newTransport(t, s, nil)
+	defer shutdown(tr)
+	if _, err := tr.Start(); err == nil {
+		t.Fatal("transport started on a failed connect")
+	}
+}
+
+func TestTransportReconnectAfterDrop(t *testing.T) {
+	var connects int32
+	s := newServer(t, &connects)
+	defer s.Close()
+	tr, metadata, _ := newTransport(t, s, nil)
+	defer shutdown(tr)
+	if _, err := tr.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Handle(transport.SentinelService, "ping", func(req *gateway.AgwMessage) (string, error) {
+		body, err := json.Marshal(transport.ReturnSuccess("pong"))
+		return string(body), err
+	})
+
+	s.DropConnections()
+	// the connection is redialed by the next call
+	eventually(t, 3*time.Second, func() bool {
+		response, err := tr.Invoke(transport.NewUri(transport.SentinelService, "ping"), transport.NewRequest())
+		return err == nil && response.Success
+	}, "no call succeeded after the connection was dropped")
+	eventually(t, 3*time.Second, func() bool { return atomic.LoadInt32(&connects) == 2 },
+		"connect handshake not re-run after the connection was dropped")
+	eventually(t, time.Second, func() bool { return metadata.Tid() == "tid-2" },
+		"tid %q not refreshed by the reconnection", metadata.Tid())
+}
+
+func TestTransportHeartbeatMiss(t *testing.T) {
+	var connects int32
+	s := newServer(t, &connects)
+	defer s.Close()
+	tr, _, _ := newTransport(t, s, func(conf *transport.Config) {
+		conf.GatewayHeartbeatIntervalMs = 50
+		conf.MaxMissedHeartbeats = 2
+	})
+	defer shutdown(tr)
+	if _, err := tr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, 3*time.Second, func() bool {
+		stats := tr.ConnStats()
+		return len(stats) == 1 && !stats[0].LastPong.IsZero()
+	}, "no heartbeat answered")
+
+	s.SetHeartbeats(false)
+	eventually(t, 3*time.Second, func() bool { return atomic.LoadInt32(&connects) == 2 },
+		"connect handshake not re-run after the heartbeats were missed")
+	if stats := tr.Stats(); stats.Reconnects == 0 {
+		t.Fatalf("no reconnect counted, stats %+v", stats)
+	}
+}
+
+func TestTransportReconnectOnAuthFailure(t *testing.T) {
+	cases := []struct {
+		name      string
+		response  *transport.Response
+		reconnect bool
+	}{
+		{"forbidden", transport.Return(transport.Code[transport.Forbidden]), true},
+		{"token not found", transport.Return(transport.Code[transport.TokenNotFound]), true},
+		{"not registered", transport.ReturnFail(transport.Code[transport.ServerError], "client Not Registered"), true},
+		{"other failure", transport.Return(transport.Code[transport.ServerError]), false},
+		{"success", transport.ReturnSuccess("ok"), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var connects int32
+			s := newServer(t, &connects)
+			defer s.Close()
+			s.Handle(transport.SentinelService, "rule", func(req *gateway.AgwMessage) (string, error) {
+				body, err := json.Marshal(c.response)
+				return string(body), err
+			})
+			tr, metadata, _ := newTransport(t, s, nil)
+			defer shutdown(tr)
+			if _, err := tr.Start(); err != nil {
+				t.Fatal(err)
+			}
+
+			// a second failure right after the first does not run the handshake again
+			for i := 0; i < 2; i++ {
+				if _, err := tr.Invoke(transport.NewUri(transport.SentinelService, "rule"), transport.NewRequest()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if c.reconnect {
+				eventually(t, 3*time.Second, func() bool { return metadata.Tid() == "tid-2" },
+					"connect handshake not re-run, tid %q", metadata.Tid())
+			}
+			time.Sleep(100 * time.Millisecond)
+			want := int32(1)
+			if c.reconnect {
+				want = 2
+			}
+			if n := atomic.LoadInt32(&connects); n != want {
+				t.Fatalf("%d connect handshakes, want %d", n, want)
+			}
+		})
+	}
+}